@@ -0,0 +1,215 @@
+package gfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// A request, as written to the access log in the json format
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	// How long the request took, in milliseconds
+	Duration  float64 `json:"duration_ms"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+}
+
+// Writes a line for every request to the access log
+type AccessLogger struct {
+	format        string
+	authorization *AuthorizationHandler
+	lock          sync.Mutex
+	writer        io.Writer
+}
+
+// Creates the access logger. Returns nil if the access log is disabled.
+func NewAccessLogger(config *Config) (*AccessLogger, error) {
+	if config.Logging.AccessLog == "" {
+		return nil, nil
+	}
+
+	format := config.Logging.AccessLogFormat
+	if format == "" {
+		format = LogFormatCombined
+	}
+	if format != LogFormatCombined && format != LogFormatJson {
+		return nil, fmt.Errorf("Invalid access log format '%s'. Valid formats are: '%s' and '%s'", format, LogFormatCombined, LogFormatJson)
+	}
+
+	authorization, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var writer io.Writer = os.Stdout
+	if config.Logging.AccessLog != "-" {
+		writer, err = os.OpenFile(config.Logging.AccessLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &AccessLogger{
+		format:        format,
+		authorization: authorization,
+		writer:        writer,
+	}, nil
+}
+
+// Wraps the handler, so its requests are written to the access log.
+// Does nothing if the access log is disabled.
+func (l *AccessLogger) wrap(f http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return f
+	}
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		w := &accessLogWriter{ResponseWriter: writer}
+
+		f(w, request)
+
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		user, _ := l.authorization.GetAuthenticatedUser(request)
+		l.write(accessLogEntry{
+			Time:       start,
+			RemoteAddr: getRemoteHost(request),
+			User:       user,
+			Method:     request.Method,
+			Path:       redactQuery(request.URL),
+			Protocol:   request.Proto,
+			Status:     w.status,
+			Bytes:      w.bytes,
+			Duration:   float64(time.Since(start)) / float64(time.Millisecond),
+			Referer:    request.Referer(),
+			UserAgent:  request.UserAgent(),
+		})
+	}
+}
+
+func (l *AccessLogger) write(entry accessLogEntry) {
+	var line []byte
+	if l.format == LogFormatJson {
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			slog.Error("Unable to write access log", "error", err)
+			return
+		}
+	} else {
+		line = []byte(formatCombinedLogLine(entry))
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err := l.writer.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("Unable to write access log", "error", err)
+	}
+}
+
+// Formats the entry in the Apache combined log format, followed by the duration in milliseconds
+func formatCombinedLogLine(entry accessLogEntry) string {
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %q %q %.3f",
+		entry.RemoteAddr,
+		orDash(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method,
+		entry.Path,
+		entry.Protocol,
+		entry.Status,
+		orDash(fmt.Sprint(entry.Bytes)),
+		orDash(entry.Referer),
+		orDash(entry.UserAgent),
+		entry.Duration,
+	)
+}
+
+func orDash(value string) string {
+	if value == "" || value == "0" {
+		return "-"
+	}
+	return value
+}
+
+// Gets the address of the client, without the port
+func getRemoteHost(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Gets the path and query of the url, with the values of secret parameters removed
+func redactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	query := u.Query()
+	for key := range query {
+		if isSecretKey(key) {
+			query.Set(key, redacted)
+		}
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+// Remembers the status and size of the response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Event streams have to be flushed
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Websockets take over the connection
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The connection can't be taken over")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
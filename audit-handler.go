@@ -0,0 +1,109 @@
+package gfs
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+)
+
+const (
+	//language=html
+	AuditHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>Audit log</title>
+</head>
+<body>
+<h1>Audit log</h1>
+<form method="get">
+	<input type="text" name="from" placeholder="From (RFC 3339)" value="{{.Query.From}}" />
+	<input type="text" name="to" placeholder="To (RFC 3339)" value="{{.Query.To}}" />
+	<input type="text" name="user" placeholder="User" value="{{.Query.User}}" />
+	<input type="text" name="path" placeholder="Path" value="{{.Query.Path}}" />
+	<input type="text" name="action" placeholder="Action" value="{{.Query.Action}}" />
+	<input type="submit" value="Search" />
+</form>
+<hr />
+<table>
+    <thead>
+        <tr>
+            <th>Time</th>
+            <th>Action</th>
+            <th>User</th>
+            <th>IP</th>
+            <th>Token</th>
+            <th>Path</th>
+            <th>Details</th>
+        </tr>
+    </thead>
+    <tbody>
+		{{range .Entries}}
+		<tr>
+			<td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td>
+			<td>{{.Action}}</td>
+			<td>{{.User}}</td>
+			<td>{{.IP}}</td>
+			<td>{{.TokenID}}</td>
+			<td>{{.Path}}</td>
+			<td>{{.Details}}</td>
+		</tr>
+		{{end}}
+    </tbody>
+</table>
+</body>
+</html>`
+)
+
+var (
+	ErrNotAdmin = errors.New("Only admins are allowed to do this")
+)
+
+// The entries of the audit log matching a query, newest first
+type AuditResponse struct {
+	Entries []AuditEntry `json:"entries" xml:"entries"`
+	// The query as it was sent, so it can be shown in the search form
+	Query map[string]string `json:"-" xml:"-"`
+}
+
+type AuditHandler struct {
+	responseHandler
+	audit        *AuditLog
+	htmlTemplate *template.Template
+}
+
+func GetAuditHandler(audit *AuditLog) (*AuditHandler, error) {
+	t, err := template.New("Audit Html Template").Parse(AuditHtml)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditHandler{
+		audit:        audit,
+		htmlTemplate: t,
+	}, nil
+}
+
+// Writes the entries of the audit log matching the query parameters to the response
+func (h *AuditHandler) Handle(writer http.ResponseWriter, request *http.Request, format string) error {
+	values := request.URL.Query()
+	query, err := parseAuditQuery(values)
+	if err != nil {
+		return err
+	}
+
+	entries, err := h.audit.Query(query)
+	if err != nil {
+		return err
+	}
+
+	response := AuditResponse{
+		Entries: entries,
+		Query: map[string]string{
+			"From":   values.Get("from"),
+			"To":     values.Get("to"),
+			"User":   values.Get("user"),
+			"Path":   values.Get("path"),
+			"Action": values.Get("action"),
+		},
+	}
+	return h.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, response)
+}
@@ -0,0 +1,342 @@
+package gfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The actions recorded in the audit log
+const (
+	AuditLogin        string = "login"
+	AuditLoginFailed  string = "login_failed"
+	AuditUpload       string = "upload"
+	AuditOverwrite    string = "overwrite"
+	AuditDownload     string = "download"
+	AuditConfigChange string = "config_change"
+)
+
+const (
+	// The name of the file in the data path the audit log is written to
+	auditLogFilename string = "audit.log"
+	// Rotated audit logs are named with this prefix, followed by the time they were rotated
+	auditLogRotatedPrefix string = "audit-"
+	// The size the audit log is rotated at, unless configured otherwise
+	defaultAuditMaxSize int64 = 10 << 20
+	// The number of rotated audit logs kept, unless configured otherwise
+	defaultAuditMaxFiles int = 10
+	// The number of entries returned by queries, unless asked otherwise
+	defaultAuditQueryLimit int = 100
+	// The max number of entries returned by queries
+	maxAuditQueryLimit int = 10000
+)
+
+var (
+	ErrInvalidAuditQuery = errors.New("Invalid audit query. 'from' and 'to' has to be RFC 3339 times, and 'limit' a positive number")
+)
+
+// Settings for the audit log
+type AuditConfig struct {
+	// Enables the audit log
+	Enabled bool `json:"enabled"`
+	// The number of bytes the audit log can grow to before it's rotated. Defaults to 10MB
+	MaxSize int64 `json:"maxSize"`
+	// The number of rotated audit logs kept. Defaults to 10
+	MaxFiles int `json:"maxFiles"`
+}
+
+func (c AuditConfig) getMaxSize() int64 {
+	if c.MaxSize > 0 {
+		return c.MaxSize
+	}
+	return defaultAuditMaxSize
+}
+
+func (c AuditConfig) getMaxFiles() int {
+	if c.MaxFiles > 0 {
+		return c.MaxFiles
+	}
+	return defaultAuditMaxFiles
+}
+
+// Something a user did
+type AuditEntry struct {
+	Time time.Time `json:"time" xml:"time"`
+	// One of login, login_failed, upload, overwrite, download or config_change
+	Action string `json:"action" xml:"action"`
+	// The user who did it, or tried to log in
+	User string `json:"user,omitempty" xml:"user,omitempty"`
+	// The address the request came from
+	IP string `json:"ip" xml:"ip"`
+	// The id of the token the request was authenticated with, or the token given out by a login
+	TokenID string `json:"token_id,omitempty" xml:"token_id,omitempty"`
+	// The path of the file, relative to the serve root
+	Path string `json:"path,omitempty" xml:"path,omitempty"`
+	// What happened, if the action doesn't tell it all
+	Details string `json:"details,omitempty" xml:"details,omitempty"`
+}
+
+// Filters for the audit log. Zero values match everything.
+type AuditQuery struct {
+	From time.Time
+	To   time.Time
+	User string
+	// Only entries for this path, or paths below it
+	Path   string
+	Action string
+	// The max number of entries returned, newest first
+	Limit int
+}
+
+func parseAuditQuery(values url.Values) (AuditQuery, error) {
+	query := AuditQuery{
+		User:   values.Get("user"),
+		Path:   values.Get("path"),
+		Action: values.Get("action"),
+		Limit:  defaultAuditQueryLimit,
+	}
+
+	var err error
+	if from := values.Get("from"); from != "" {
+		query.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return query, ErrInvalidAuditQuery
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		query.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return query, ErrInvalidAuditQuery
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 {
+			return query, ErrInvalidAuditQuery
+		}
+		if query.Limit > maxAuditQueryLimit {
+			query.Limit = maxAuditQueryLimit
+		}
+	}
+	return query, nil
+}
+
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	return (q.From.IsZero() || !entry.Time.Before(q.From)) &&
+		(q.To.IsZero() || entry.Time.Before(q.To)) &&
+		(q.User == "" || entry.User == q.User) &&
+		(q.Path == "" || (entry.Path != "" && hasPathPrefix(entry.Path, q.Path))) &&
+		(q.Action == "" || entry.Action == q.Action)
+}
+
+// An append only log of what users did, kept in the data path as json lines
+type AuditLog struct {
+	config        *Config
+	authorization *AuthorizationHandler
+	lock          sync.Mutex
+	// Only used while holding the lock
+	file *os.File
+	size int64
+}
+
+// Opens the audit log. Returns nil if the audit log is disabled.
+func NewAuditLog(config *Config) (*AuditLog, error) {
+	if !config.Audit.Enabled {
+		return nil, nil
+	}
+
+	authorization, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AuditLog{
+		config:        config,
+		authorization: authorization,
+	}
+	err = l.open()
+	return l, err
+}
+
+func (l *AuditLog) getPath() string {
+	return path.Join(l.config.getDataPath(), auditLogFilename)
+}
+
+// Opens the current audit log for appending. Should only be called while holding the lock.
+func (l *AuditLog) open() error {
+	err := os.MkdirAll(l.config.getDataPath(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.getPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Records what the user did in the request. The address of the client and the
+// id of the token the request was authenticated with are added to the entry.
+// Does nothing if the audit log is disabled.
+func (l *AuditLog) RecordRequest(request *http.Request, entry AuditEntry) {
+	if l == nil {
+		return
+	}
+
+	entry.IP = getRemoteHost(request)
+	if entry.TokenID == "" {
+		entry.TokenID = l.authorization.GetTokenID(request)
+	}
+	l.Record(entry)
+}
+
+// Appends the entry to the audit log. Does nothing if the audit log is disabled.
+func (l *AuditLog) Record(entry AuditEntry) {
+	if l == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Unable to write audit log", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.config.Audit.getMaxSize() {
+		err = l.rotate()
+		if err != nil {
+			slog.Error("Unable to rotate audit log", "error", err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("Unable to write audit log", "error", err, "entry", string(line))
+	}
+}
+
+// Moves the current audit log aside and starts a new one. The oldest rotated
+// logs are deleted. Should only be called while holding the lock.
+func (l *AuditLog) rotate() error {
+	l.file.Close()
+
+	rotated := path.Join(l.config.getDataPath(), auditLogRotatedPrefix+time.Now().UTC().Format("20060102T150405.000000000Z")+".log")
+	err := os.Rename(l.getPath(), rotated)
+	if err != nil {
+		// Keep writing to the current log rather than losing entries
+		l.open()
+		return err
+	}
+
+	files, err := l.getRotatedFiles()
+	if err == nil {
+		for len(files) > l.config.Audit.getMaxFiles() {
+			os.Remove(files[0])
+			files = files[1:]
+		}
+	}
+
+	return l.open()
+}
+
+// Gets the rotated audit logs, oldest first
+func (l *AuditLog) getRotatedFiles() ([]string, error) {
+	infos, err := ioutil.ReadDir(l.config.getDataPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), auditLogRotatedPrefix) && strings.HasSuffix(info.Name(), ".log") {
+			files = append(files, path.Join(l.config.getDataPath(), info.Name()))
+		}
+	}
+	// The names contain the time they were rotated, so they sort chronologically
+	sort.Strings(files)
+	return files, nil
+}
+
+// Finds the entries matching the query, newest first
+func (l *AuditLog) Query(query AuditQuery) ([]AuditEntry, error) {
+	l.lock.Lock()
+	files, err := l.getRotatedFiles()
+	l.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, l.getPath())
+
+	entries := make([]AuditEntry, 0)
+	for _, file := range files {
+		err := readAuditLog(file, func(entry AuditEntry) {
+			if query.matches(entry) {
+				entries = append(entries, entry)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+	return entries, nil
+}
+
+// Reads every entry in the audit log file
+func readAuditLog(file string, found func(entry AuditEntry)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Rotated away while being queried
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		// A line can only be broken if gfs stopped while writing it
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		found(entry)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,140 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAuditQuery(t *testing.T) {
+	a := assert.New(t)
+
+	query, err := parseAuditQuery(url.Values{
+		"from":  {"2020-01-01T00:00:00Z"},
+		"user":  {"admin"},
+		"limit": {"1000000"},
+	})
+	a.NoError(err)
+	a.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), query.From)
+	a.True(query.To.IsZero())
+	a.Equal("admin", query.User)
+	a.Equal(maxAuditQueryLimit, query.Limit)
+
+	query, err = parseAuditQuery(url.Values{})
+	a.NoError(err)
+	a.Equal(defaultAuditQueryLimit, query.Limit)
+
+	for _, values := range []url.Values{{"from": {"yesterday"}}, {"to": {"2020-01-01"}}, {"limit": {"0"}}} {
+		_, err = parseAuditQuery(values)
+		a.Equal(ErrInvalidAuditQuery, err, values.Encode())
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-audit")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Data:  dir,
+		Audit: AuditConfig{Enabled: true, MaxSize: 300, MaxFiles: 2},
+	}
+	audit, err := NewAuditLog(config)
+	if !a.NoError(err) {
+		return
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		audit.Record(AuditEntry{
+			Time:   start.Add(time.Duration(i) * time.Hour),
+			Action: AuditUpload,
+			User:   []string{"alice", "bob"}[i%2],
+			Path:   []string{"/docs/a.txt", "/images/b.png"}[i%2],
+		})
+	}
+
+	t.Run("Logs are rotated", func(t *testing.T) {
+		a := assert.New(t)
+
+		files, err := audit.getRotatedFiles()
+		a.NoError(err)
+		a.Len(files, 2, "Only the newest rotated logs should be kept")
+
+		info, err := os.Stat(filepath.Join(dir, auditLogFilename))
+		a.NoError(err)
+		a.True(info.Size() <= 300)
+		a.Equal(os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("Queries are filtered", func(t *testing.T) {
+		a := assert.New(t)
+
+		entries, err := audit.Query(AuditQuery{User: "alice"})
+		a.NoError(err)
+		if a.NotEmpty(entries) {
+			for _, entry := range entries {
+				a.Equal("alice", entry.User)
+				a.Equal("/docs/a.txt", entry.Path)
+			}
+			a.Equal(start.Add(8*time.Hour), entries[0].Time.UTC(), "Newest entries should come first")
+		}
+
+		entries, err = audit.Query(AuditQuery{From: start.Add(8 * time.Hour), Path: "/images"})
+		a.NoError(err)
+		if a.Len(entries, 1) {
+			a.Equal("/images/b.png", entries[0].Path)
+		}
+
+		entries, err = audit.Query(AuditQuery{Path: "/doc"})
+		a.NoError(err)
+		a.Empty(entries, "Paths should only match whole directories")
+
+		entries, err = audit.Query(AuditQuery{Limit: 2})
+		a.NoError(err)
+		a.Len(entries, 2)
+	})
+
+	t.Run("Requests add the client", func(t *testing.T) {
+		a := assert.New(t)
+
+		request := httptest.NewRequest("POST", "/login", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		audit.RecordRequest(request, AuditEntry{Action: AuditLoginFailed, User: "mallory"})
+
+		entries, err := audit.Query(AuditQuery{Action: AuditLoginFailed})
+		a.NoError(err)
+		if a.Len(entries, 1) {
+			a.Equal("192.0.2.1", entries[0].IP)
+			a.Equal("mallory", entries[0].User)
+		}
+	})
+}
+
+func TestAuditLog_Disabled(t *testing.T) {
+	a := assert.New(t)
+
+	audit, err := NewAuditLog(&Config{})
+	a.NoError(err)
+	a.Nil(audit)
+	audit.Record(AuditEntry{Action: AuditLogin})
+}
+
+func TestConfig_IsAdmin(t *testing.T) {
+	a := assert.New(t)
+	config := &Config{Username: "root", Admins: []string{"alice"}}
+
+	a.True(config.isAdmin("root"))
+	a.True(config.isAdmin("alice"))
+	a.False(config.isAdmin("bob"))
+	a.False(config.isAdmin(""))
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -26,6 +27,10 @@ type LoginRequest struct {
 type AuthoizationFailedResponse struct {
 	Path  string `json:"redirect_path" xml:"redirect_path"`
 	Error string `json:"error" xml:"error"`
+	// The path prefix of every link to gfs
+	BasePath string `json:"-" xml:"-"`
+	// True if users can log in through the OpenID Connect provider
+	OidcLogin bool `json:"-" xml:"-"`
 }
 
 type AuthorizationSuccessResponse struct {
@@ -38,15 +43,36 @@ type AuthorizationResponse struct {
 	Token string `json:"token" xml:"token"`
 }
 
+var (
+	ErrInvalidCredentials = errors.New("Invalid username or password")
+)
+
 type AuthorizationHandler struct {
 	responseHandler
 	config              *Config
 	loginFailedTemplate *template.Template
+	// nil if forward auth is disabled
+	forwardAuth *forwardAuth
+	// nil if OpenID Connect is disabled
+	oidc *oidcClient
+	// nil if logging in through LDAP is disabled
+	ldap *ldapClient
+}
+
+func (h *AuthorizationHandler) failedResponse(request *http.Request, redirectPath string, err error) AuthoizationFailedResponse {
+	return AuthoizationFailedResponse{
+		Path:      redirectPath,
+		Error:     err.Error(),
+		BasePath:  getBasePath(request),
+		OidcLogin: h.oidc != nil,
+	}
 }
 
-func (h *AuthorizationHandler) Login(writer http.ResponseWriter, request *http.Request, format string) error {
+// Logs the user in, and responds with the token. Returns the name of the user and the id
+// of the token. The failure is written to the response as well if an error is returned.
+func (h *AuthorizationHandler) Login(writer http.ResponseWriter, request *http.Request, format string) (username, tokenID string, err error) {
 
-	var username, password, redirectPath string
+	var password, redirectPath string
 	contentType := getContentType(request)
 	switch contentType {
 	case FormatXFormUrlEncoded:
@@ -57,7 +83,7 @@ func (h *AuthorizationHandler) Login(writer http.ResponseWriter, request *http.R
 		var loginRequest LoginRequest
 		err := json.NewDecoder(request.Body).Decode(&loginRequest)
 		if err != nil {
-			return err
+			return "", "", err
 		}
 		username = loginRequest.Username
 		password = loginRequest.Password
@@ -65,68 +91,185 @@ func (h *AuthorizationHandler) Login(writer http.ResponseWriter, request *http.R
 		var loginRequest LoginRequest
 		err := xml.NewDecoder(request.Body).Decode(&loginRequest)
 		if err != nil {
-			return err
+			return "", "", err
 		}
 		username = loginRequest.Username
 		password = loginRequest.Password
 	default:
 		err := errors.New(fmt.Sprintf("Unknown request format '%s'. Accepted types are: '%s', '%s' and '%s'", contentType, FormatXFormUrlEncoded, FormatJson, FormatXml))
-		fail := AuthoizationFailedResponse{Path: redirectPath, Error: err.Error()}
-		return h.responseHandler.WriteResponse(writer, http.StatusBadRequest, h.loginFailedTemplate, format, fail)
+		fail := h.failedResponse(request, redirectPath, err)
+		h.responseHandler.WriteResponse(writer, http.StatusBadRequest, h.loginFailedTemplate, format, fail)
+		return "", "", err
+	}
+
+	data, err := h.checkCredentials(username, password)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrInvalidCredentials {
+			status = http.StatusBadRequest
+		} else if err == ErrLdapNotAllowed {
+			status = http.StatusForbidden
+		}
+		fail := h.failedResponse(request, redirectPath, err)
+		h.responseHandler.WriteResponse(writer, status, h.loginFailedTemplate, format, fail)
+		return username, "", err
 	}
 
+	// The directory can know the user by another spelling than the one typed in
+	username = data.Username
+	token, tokenID, err := newToken([]byte(h.config.Secret), data)
+	if err != nil {
+		fail := h.failedResponse(request, redirectPath, err)
+		h.responseHandler.WriteResponse(writer, http.StatusInternalServerError, h.loginFailedTemplate, format, fail)
+		return username, "", err
+	}
+
+	if format == FormatXml || format == FormatJson {
+		response := AuthorizationSuccessResponse{Token: token}
+		return username, tokenID, h.WriteResponse(writer, http.StatusOK, nil, format, response)
+	} else {
+		setTokenCookie(writer, request, token)
+		http.Redirect(writer, request, redirectPath, http.StatusFound)
+	}
+	return username, tokenID, nil
+}
+
+// Checks the username and password against the configured user, and otherwise the
+// LDAP directory, if enabled. Returns ErrInvalidCredentials if they don't match.
+func (h *AuthorizationHandler) checkCredentials(username, password string) (TokenData, error) {
 	if h.config.Username == username {
 		matches, err := CheckPassword(password, h.config.Password)
 		if err != nil {
-			fail := AuthoizationFailedResponse{Path: redirectPath, Error: err.Error()}
-			return h.responseHandler.WriteResponse(writer, http.StatusInternalServerError, h.loginFailedTemplate, format, fail)
+			return TokenData{}, err
 		}
 		if !matches {
-			fail := AuthoizationFailedResponse{Path: redirectPath, Error: "Invalid username or password"}
-			return h.responseHandler.WriteResponse(writer, http.StatusBadRequest, h.loginFailedTemplate, format, fail)
-		}
-
-		token, err := GetToken([]byte(h.config.Secret))
-		if err != nil {
-			fail := AuthoizationFailedResponse{Path: redirectPath, Error: err.Error()}
-			return h.responseHandler.WriteResponse(writer, http.StatusInternalServerError, h.loginFailedTemplate, format, fail)
+			return TokenData{}, ErrInvalidCredentials
 		}
+		return TokenData{Username: username}, nil
+	}
 
-		if format == FormatXml || format == FormatJson {
-			response := AuthorizationSuccessResponse{Token: token}
-			return h.WriteResponse(writer, http.StatusOK, nil, format, response)
-		} else {
-			cookie := &http.Cookie{
-				Name:    "token",
-				Value:   token,
-				Path:    "/",
-				Expires: time.Now().Add(31 * 24 * time.Hour),
-				MaxAge:  31 * 24 * 60 * 60,
-			}
-
-			http.SetCookie(writer, cookie)
-			http.Redirect(writer, request, redirectPath, http.StatusFound)
+	if h.ldap != nil {
+		data, err := h.ldap.authenticate(username, password)
+		// Another spelling of the configured user must not log in as it through the directory
+		if err == nil && data.Username == h.config.Username {
+			return TokenData{}, ErrInvalidCredentials
 		}
-		return nil
+		return data, err
 	}
-	fail := AuthoizationFailedResponse{Path: redirectPath, Error: "Invalid username or password"}
-	return h.responseHandler.WriteResponse(writer, http.StatusBadRequest, h.loginFailedTemplate, format, fail)
+	return TokenData{}, ErrInvalidCredentials
+}
+
+// Sets the cookie browsers are authenticated with
+func setTokenCookie(writer http.ResponseWriter, request *http.Request, token string) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:    "token",
+		Value:   token,
+		Path:    getBasePath(request) + "/",
+		Expires: time.Now().Add(31 * 24 * time.Hour),
+		MaxAge:  31 * 24 * 60 * 60,
+		// Behind a proxy terminating tls, the request to gfs itself isn't secure
+		Secure: isSecureRequest(request),
+	})
 }
 
 // Checks if the request is authenticated. Returns nil if request is authenticated
 func (h *AuthorizationHandler) CheckAuthenticated(request *http.Request) error {
-	token := request.Header.Get("gfs-token")
-	if token == "" {
-		cookie, err := request.Cookie("token")
-		if err != nil {
-			return err
+	_, err := h.GetAuthenticatedUser(request)
+	return err
+}
+
+// Gets the name of the user the request is authenticated as. Returns an error
+// if the request is not authenticated.
+func (h *AuthorizationHandler) GetAuthenticatedUser(request *http.Request) (string, error) {
+	data, err := h.authenticate(request)
+	return data.Username, err
+}
+
+// Checks if the request is authenticated as an admin, either by name or by being
+// in one of the admin groups of the OpenID Connect provider or LDAP directory
+func (h *AuthorizationHandler) IsAdmin(request *http.Request) bool {
+	data, err := h.authenticate(request)
+	if err != nil {
+		return false
+	}
+	// The name comes from a claim at the provider, which can match the name of a local admin
+	if data.Provider == oidcProvider {
+		return h.oidc != nil && h.oidc.config.isAdmin(data.Groups)
+	}
+	return h.config.isAdmin(data.Username) ||
+		(h.ldap != nil && h.ldap.config.isAdmin(data.Groups))
+}
+
+// Gets who the request is authenticated as. The user authenticated by a trusted proxy
+// is preferred, then bearer tokens from the OpenID Connect provider, and lastly the
+// token issued by gfs.
+func (h *AuthorizationHandler) authenticate(request *http.Request) (TokenData, error) {
+	if h.forwardAuth != nil {
+		if user, ok := h.forwardAuth.getUser(request); ok {
+			return TokenData{Username: user}, nil
 		}
+	}
 
-		token = cookie.Value
+	if h.oidc != nil {
+		if token := getBearerToken(request); token != "" {
+			return h.oidc.authenticateBearer(request.Context(), token)
+		}
 	}
 
-	err := GetTokenData(token, []byte(h.config.Secret), &struct{}{})
-	return err
+	token, err := getRequestToken(request)
+	if err != nil {
+		return TokenData{}, err
+	}
+
+	var data TokenData
+	err = GetTokenData(token, []byte(h.config.Secret), &data)
+	if err != nil {
+		return TokenData{}, err
+	}
+
+	// Only tokens given out at a login name a user
+	if data.Username == "" {
+		return TokenData{}, ErrTokenNoUser
+	}
+
+	return data, nil
+}
+
+// Gets the id of the token the request is authenticated with. Returns an empty
+// string if the request is not authenticated.
+func (h *AuthorizationHandler) GetTokenID(request *http.Request) string {
+	token, err := getRequestToken(request)
+	if err != nil {
+		return ""
+	}
+	id, err := GetTokenID(token, []byte(h.config.Secret))
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// Gets the token sent with the request, either in the gfs-token header or the token cookie
+func getRequestToken(request *http.Request) (string, error) {
+	token := request.Header.Get("gfs-token")
+	if token != "" {
+		return token, nil
+	}
+
+	cookie, err := request.Cookie("token")
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
+// Gets the token sent in the Authorization header, if any
+func getBearerToken(request *http.Request) string {
+	scheme, token, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
 }
 
 func GetAuthorizationHandler(config *Config) (*AuthorizationHandler, error) {
@@ -144,9 +287,21 @@ func GetAuthorizationHandler(config *Config) (*AuthorizationHandler, error) {
 		return nil, err
 	}
 
+	forwardAuth, err := newForwardAuth(config)
+	if err != nil {
+		return nil, err
+	}
+
 	h := &AuthorizationHandler{
 		config:              config,
 		loginFailedTemplate: loginFailedTemplate,
+		forwardAuth:         forwardAuth,
+	}
+	if config.Oidc.Enabled {
+		h.oidc = getOidcClient(config.Oidc)
+	}
+	if config.Ldap.Enabled {
+		h.ldap = getLdapClient(config.Ldap)
 	}
 
 	return h, nil
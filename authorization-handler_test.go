@@ -0,0 +1,45 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizationHandler_Tokens(t *testing.T) {
+	a := assert.New(t)
+
+	config := &Config{Username: "admin", Secret: "secret"}
+	authorization, err := GetAuthorizationHandler(config)
+	if !a.NoError(err) {
+		return
+	}
+	authenticate := func(token string) (string, error) {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("gfs-token", token)
+		return authorization.GetAuthenticatedUser(request)
+	}
+
+	token, _, err := newToken([]byte(config.Secret), TokenData{Username: "alice"})
+	if !a.NoError(err) {
+		return
+	}
+	user, err := authenticate(token)
+	a.NoError(err)
+	a.Equal("alice", user)
+
+	// Tokens without a user must never fall back to the configured user
+	token, err = GetToken([]byte(config.Secret))
+	if !a.NoError(err) {
+		return
+	}
+	_, err = authenticate(token)
+	a.Equal(ErrTokenNoUser, err)
+
+	token, _, err = newToken([]byte("another secret"), TokenData{Username: "admin"})
+	if !a.NoError(err) {
+		return
+	}
+	_, err = authenticate(token)
+	a.Error(err)
+}
@@ -0,0 +1,167 @@
+package gfs
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	//language=html
+	BandwidthHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>Bandwidth limits</title>
+</head>
+<body>
+<h1>Bandwidth limits</h1>
+<p>All limits are in bytes per second. 0 means unlimited.</p>
+<hr />
+<form action="{{.BasePath}}/bandwidth" method="post">
+    <label for="downloadInput">Download</label>
+    <input name="download" id="downloadInput" type="number" min="0" value="{{.Download}}" />
+    <label for="downloadPerConnectionInput">Download per connection</label>
+    <input name="downloadPerConnection" id="downloadPerConnectionInput" type="number" min="0" value="{{.DownloadPerConnection}}" />
+    <label for="uploadInput">Upload</label>
+    <input name="upload" id="uploadInput" type="number" min="0" value="{{.Upload}}" />
+    <label for="uploadPerConnectionInput">Upload per connection</label>
+    <input name="uploadPerConnection" id="uploadPerConnectionInput" type="number" min="0" value="{{.UploadPerConnection}}" />
+    <button type="submit">Save</button>
+</form>
+{{if .Users}}
+<hr />
+<table>
+    <thead>
+        <tr>
+            <th>User</th>
+            <th>Download</th>
+            <th>Upload</th>
+        </tr>
+    </thead>
+    <tbody>
+		{{range .Users}}
+		<tr>
+			<td>{{.Username}}</td>
+			<td>{{.Download}}</td>
+			<td>{{.Upload}}</td>
+		</tr>
+		{{end}}
+    </tbody>
+</table>
+{{end}}
+</body>
+</html>`
+)
+
+var (
+	ErrNegativeBandwidthLimit = errors.New("Bandwidth limits cannot be negative")
+)
+
+// The limits as shown on the bandwidth page, which has to know where gfs is served
+type bandwidthPage struct {
+	BandwidthLimits
+	BasePath string
+}
+
+type BandwidthHandler struct {
+	responseHandler
+	throttler    *Throttler
+	htmlTemplate *template.Template
+}
+
+func GetBandwidthHandler(throttler *Throttler) (h *BandwidthHandler, err error) {
+	t := template.New("Bandwidth Html Template")
+	t, err = t.Parse(BandwidthHtml)
+	if err != nil {
+		return nil, err
+	}
+	h = &BandwidthHandler{
+		throttler:    throttler,
+		htmlTemplate: t,
+	}
+
+	return h, nil
+}
+
+// Writes the current bandwidth limits to the response
+func (h *BandwidthHandler) Handle(writer http.ResponseWriter, request *http.Request, format string) {
+	var response interface{}
+	switch format {
+	case FormatJson, FormatNdjson, FormatXml:
+		response = h.throttler.Limits()
+	default:
+		response = bandwidthPage{BandwidthLimits: h.throttler.Limits(), BasePath: getBasePath(request)}
+	}
+	err := h.responseHandler.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, response)
+	if err != nil {
+		slog.Error("Something went wrong when responding", "error", err)
+	}
+}
+
+// Changes the bandwidth limits to the ones in the request. Returns an error if
+// the request is invalid.
+func (h *BandwidthHandler) Update(writer http.ResponseWriter, request *http.Request, format string) error {
+	limits := h.throttler.Limits()
+
+	contentType := getContentType(request)
+	switch contentType {
+	case FormatXFormUrlEncoded:
+		// The form only contains the global limits, so the user limits are kept
+		fields := map[string]*int64{
+			"download":              &limits.Download,
+			"downloadPerConnection": &limits.DownloadPerConnection,
+			"upload":                &limits.Upload,
+			"uploadPerConnection":   &limits.UploadPerConnection,
+		}
+		for name, field := range fields {
+			value := request.FormValue(name)
+			if value == "" {
+				continue
+			}
+			limit, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid value for '%s': %s", name, value)
+			}
+			*field = limit
+		}
+	case FormatJson:
+		limits = BandwidthLimits{}
+		err := json.NewDecoder(request.Body).Decode(&limits)
+		if err != nil {
+			return err
+		}
+	case FormatXml:
+		limits = BandwidthLimits{}
+		err := xml.NewDecoder(request.Body).Decode(&limits)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown request format '%s'. Accepted types are: '%s', '%s' and '%s'", contentType, FormatXFormUrlEncoded, FormatJson, FormatXml)
+	}
+
+	if limits.Download < 0 || limits.DownloadPerConnection < 0 || limits.Upload < 0 || limits.UploadPerConnection < 0 {
+		return ErrNegativeBandwidthLimit
+	}
+	for _, user := range limits.Users {
+		if user.Download < 0 || user.Upload < 0 {
+			return ErrNegativeBandwidthLimit
+		}
+	}
+
+	h.throttler.SetLimits(limits)
+	slog.Info("Bandwidth limits changed")
+
+	if format == FormatHtml || format == "" {
+		http.Redirect(writer, request, getBasePath(request)+"/bandwidth", http.StatusFound)
+		return nil
+	}
+
+	h.Handle(writer, request, format)
+	return nil
+}
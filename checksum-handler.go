@@ -0,0 +1,274 @@
+package gfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported checksum algorithms
+const (
+	ChecksumSha256 string = "sha256"
+)
+
+var (
+	ErrUnknownChecksumAlgorithm = errors.New("Unknown checksum algorithm. Supported algorithms are: 'sha256'")
+	ErrInvalidChecksumManifest  = errors.New("Invalid checksum manifest")
+)
+
+// A cached checksum. Only valid as long as the size and modification
+// time of the file matches.
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+type ChecksumHandler struct {
+	lock  sync.RWMutex
+	cache map[string]cachedChecksum
+}
+
+func GetChecksumHandler() (*ChecksumHandler, error) {
+	return &ChecksumHandler{
+		cache: make(map[string]cachedChecksum),
+	}, nil
+}
+
+// Responds with a sha256sum compatible manifest of all files in the given directory,
+// and all sub directories. Paths in the manifest are relative to the directory.
+// The manifest is built before anything is sent, so a failure never looks like a
+// manifest that is missing files.
+func (h *ChecksumHandler) Handle(writer http.ResponseWriter, fullpath, algorithm string) error {
+	if algorithm != ChecksumSha256 {
+		return ErrUnknownChecksumAlgorithm
+	}
+
+	var manifest bytes.Buffer
+	err := h.WriteManifest(&manifest, fullpath)
+	if err != nil {
+		return err
+	}
+
+	writer.Header().Set("content-type", "text/plain; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	_, err = manifest.WriteTo(writer)
+	return err
+}
+
+// Writes the manifest of the given directory to the writer
+func (h *ChecksumHandler) WriteManifest(writer io.Writer, fullpath string) error {
+	seen := make(map[string]bool)
+	err := filepath.Walk(fullpath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || isStagingFile(info.Name()) {
+			return nil
+		}
+
+		sum, err := h.getChecksum(p, info)
+		if err != nil {
+			return err
+		}
+		seen[p] = true
+
+		rel, err := filepath.Rel(fullpath, p)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(writer, formatManifestLine(sum, filepath.ToSlash(rel)))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	h.prune(fullpath, seen)
+	return nil
+}
+
+// Removes the cached checksums of files in the directory that no longer exists,
+// so deleted and renamed files doesn't stay in the cache forever
+func (h *ChecksumHandler) prune(fullpath string, seen map[string]bool) {
+	prefix := strings.TrimSuffix(fullpath, string(filepath.Separator)) + string(filepath.Separator)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for p := range h.cache {
+		if (p == fullpath || strings.HasPrefix(p, prefix)) && !seen[p] {
+			delete(h.cache, p)
+		}
+	}
+}
+
+// Gets the checksum of the given file, either from the cache, or by
+// hashing the file if the cache is out of date
+func (h *ChecksumHandler) getChecksum(p string, info os.FileInfo) (string, error) {
+	h.lock.RLock()
+	cached, ok := h.cache[p]
+	h.lock.RUnlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	sum, err := hashFile(p)
+	if err != nil {
+		return "", err
+	}
+
+	h.lock.Lock()
+	h.cache[p] = cachedChecksum{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		sum:     sum,
+	}
+	h.lock.Unlock()
+
+	return sum, nil
+}
+
+// Calculates the hex encoded sha256 sum of the given file
+func hashFile(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Names are escaped the way sha256sum does it. Lines of names containing a newline or
+// backslash starts with a backslash, and the newlines and backslashes are escaped.
+var (
+	manifestNameEscaper   = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	manifestNameUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n")
+)
+
+// Formats a line of a sha256sum compatible manifest
+func formatManifestLine(sum, name string) string {
+	if strings.ContainsAny(name, "\\\n") {
+		return "\\" + sum + "  " + manifestNameEscaper.Replace(name) + "\n"
+	}
+	return sum + "  " + name + "\n"
+}
+
+// Parses a sha256sum compatible manifest into a map from path to checksum
+func parseChecksumManifest(reader io.Reader) (map[string]string, error) {
+	sums := make(map[string]string)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+
+		// Lines are either "<sum>  <path>" or "<sum> *<path>" for binary mode
+		if len(line) < 2*sha256.Size+2 {
+			return nil, ErrInvalidChecksumManifest
+		}
+		sum := line[:2*sha256.Size]
+		separator := line[2*sha256.Size : 2*sha256.Size+2]
+		if separator != "  " && separator != " *" {
+			return nil, ErrInvalidChecksumManifest
+		}
+
+		name := line[2*sha256.Size+2:]
+		if escaped {
+			name = manifestNameUnescaper.Replace(name)
+		}
+		sums[name] = strings.ToLower(sum)
+	}
+
+	return sums, scanner.Err()
+}
+
+// The result of comparing a local directory against a remote directory
+type TreeVerification struct {
+	// Files that exists on the server, but not locally
+	Missing []string
+	// Files that exists locally, but not on the server
+	Extra []string
+	// Files that exists both places, but where the content differs
+	Mismatched []string
+}
+
+// True if the local tree is identical to the remote tree
+func (v *TreeVerification) Ok() bool {
+	return len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Mismatched) == 0
+}
+
+// Compares the files in the given local directory against the remote manifest
+func verifyTree(localDir string, remote map[string]string) (*TreeVerification, error) {
+	verification := &TreeVerification{}
+	seen := make(map[string]bool)
+
+	err := filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		remoteSum, ok := remote[rel]
+		if !ok {
+			verification.Extra = append(verification.Extra, rel)
+			return nil
+		}
+		seen[rel] = true
+
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		if sum != remoteSum {
+			verification.Mismatched = append(verification.Mismatched, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for p := range remote {
+		if !seen[p] {
+			verification.Missing = append(verification.Missing, p)
+		}
+	}
+
+	sort.Strings(verification.Missing)
+	sort.Strings(verification.Extra)
+	sort.Strings(verification.Mismatched)
+
+	return verification, nil
+}
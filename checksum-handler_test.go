@@ -0,0 +1,101 @@
+package gfs
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksumHandler(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-checksums")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	a.NoError(os.MkdirAll(filepath.Join(dir, "sub"), os.ModePerm))
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("world"), 0644))
+
+	h, err := GetChecksumHandler()
+	if !a.NoError(err) {
+		return
+	}
+
+	var buf bytes.Buffer
+	if !a.NoError(h.WriteManifest(&buf, dir)) {
+		return
+	}
+
+	a.Equal("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  a.txt\n"+
+		"486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7  sub/b.txt\n", buf.String())
+
+	t.Run("Prune cache", func(t *testing.T) {
+		a := assert.New(t)
+
+		h, err := GetChecksumHandler()
+		if !a.NoError(err) {
+			return
+		}
+		a.NoError(h.WriteManifest(ioutil.Discard, dir))
+		a.Len(h.cache, 2)
+
+		a.NoError(os.Rename(filepath.Join(dir, "sub", "b.txt"), filepath.Join(dir, "sub", "renamed.txt")))
+		defer os.Rename(filepath.Join(dir, "sub", "renamed.txt"), filepath.Join(dir, "sub", "b.txt"))
+		a.NoError(h.WriteManifest(ioutil.Discard, filepath.Join(dir, "sub")))
+		a.Len(h.cache, 2)
+		a.NotContains(h.cache, filepath.Join(dir, "sub", "b.txt"), "The old name should have been dropped")
+		a.Contains(h.cache, filepath.Join(dir, "a.txt"), "Files outside the directory should be kept")
+	})
+
+	t.Run("Escaped names", func(t *testing.T) {
+		a := assert.New(t)
+
+		sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		line := formatManifestLine(sum, "new\nline\\name")
+		a.Equal("\\"+sum+"  new\\nline\\\\name\n", line)
+
+		sums, err := parseChecksumManifest(strings.NewReader(line + formatManifestLine(sum, "plain")))
+		if a.NoError(err) {
+			a.Equal(map[string]string{"new\nline\\name": sum, "plain": sum}, sums)
+		}
+	})
+
+	t.Run("Failed walk", func(t *testing.T) {
+		a := assert.New(t)
+
+		recorder := httptest.NewRecorder()
+		err := h.Handle(recorder, filepath.Join(dir, "missing"), ChecksumSha256)
+		a.Error(err)
+		a.Empty(recorder.Body.String(), "Nothing should be sent, so the error can still be responded with")
+		a.Empty(recorder.Header().Get("content-type"))
+	})
+
+	t.Run("Verify tree", func(t *testing.T) {
+		a := assert.New(t)
+
+		remote, err := parseChecksumManifest(&buf)
+		if !a.NoError(err) {
+			return
+		}
+
+		a.NoError(ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644))
+		a.NoError(ioutil.WriteFile(filepath.Join(dir, "c.txt"), []byte("extra"), 0644))
+		a.NoError(os.Remove(filepath.Join(dir, "sub", "b.txt")))
+
+		verification, err := verifyTree(dir, remote)
+		if a.NoError(err) {
+			a.False(verification.Ok())
+			a.Equal([]string{"sub/b.txt"}, verification.Missing)
+			a.Equal([]string{"c.txt"}, verification.Extra)
+			a.Equal([]string{"a.txt"}, verification.Mismatched)
+		}
+	})
+}
@@ -2,7 +2,7 @@ package gfs
 
 import (
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
@@ -50,6 +50,6 @@ func (h *ClientErrorHandler) Handle(writer http.ResponseWriter, err error, forma
 
 	err = h.responseHandler.WriteResponse(writer, errorCode, h.htmlTemplate, format, response)
 	if err != nil {
-		log.Println("Something went wrong when responding", err.Error())
+		slog.Error("Something went wrong when responding", "error", err)
 	}
 }
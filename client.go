@@ -1,7 +1,9 @@
 package gfs
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -9,13 +11,17 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Client struct {
 	url    *url.URL
 	token  string
 	client http.Client
+	// The context requests are sent with. The trace context in it is sent along
+	ctx context.Context
 }
 
 func urlJoin(p1, p2 string) string {
@@ -30,17 +36,55 @@ func urlJoin(p1, p2 string) string {
 	return p1 + p2
 }
 
+// Gets the url of the path on the server. Paths are relative to the path of the
+// url the client was created with, so servers under a base path can be used.
 func (c *Client) getUrl(p string) (string, error) {
 	target, err := url.Parse(p)
 	if err != nil {
 		return "", err
 	}
 
-	u := c.url.ResolveReference(target)
+	u := *c.url
+	u.Path = cleanBasePath(c.url.Path) + "/" + strings.TrimPrefix(target.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = target.RawQuery
+	u.Fragment = ""
 
 	return u.String(), nil
 }
 
+// Removes the base path of the server from a path in a response, so it's relative
+// to the serve root like the paths given to the client
+func (c *Client) trimBasePath(p string) string {
+	return strings.TrimPrefix(p, cleanBasePath(c.url.Path))
+}
+
+func (c *Client) trimDirectoryBasePath(stats *DirectoryStats) {
+	stats.Path = c.trimBasePath(stats.Path)
+	for i := range stats.Entries {
+		stats.Entries[i].Path = c.trimBasePath(stats.Entries[i].Path)
+	}
+}
+
+// Gets a copy of the client that sends its requests with the given context, so they
+// are cancelled with it, and are part of the trace in it.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	client := *c
+	client.ctx = ctx
+	return &client
+}
+
+func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+	return req, nil
+}
+
 func (c *Client) setHeaders(req *http.Request) {
 	req.Header.Set("gfs-token", c.token)
 	req.Header.Set("accept", FormatJson)
@@ -63,7 +107,7 @@ func (c *Client) Login(username, password string) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", sUrl, &buf)
+	req, err := c.newRequest("POST", sUrl, &buf)
 	if err != nil {
 		return err
 	}
@@ -100,7 +144,7 @@ func (c *Client) getContent(p string, out interface{}) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("GET", sUrl, nil)
+	req, err := c.newRequest("GET", sUrl, nil)
 	if err != nil {
 		return err
 	}
@@ -125,6 +169,16 @@ func (c *Client) getContent(p string, out interface{}) error {
 func (c *Client) GetDirectoryContent(p string) (*DirectoryStats, error) {
 	var stats DirectoryStats
 	err := c.getContent(p, &stats)
+	c.trimDirectoryBasePath(&stats)
+	return &stats, err
+}
+
+// Gets a single page of the content of the given directory. Use the NextCursor of
+// the returned stats as the cursor of the options to get the next page.
+func (c *Client) ListDirectory(p string, options ListingOptions) (*DirectoryStats, error) {
+	var stats DirectoryStats
+	err := c.getContent(p+"?"+options.Query().Encode(), &stats)
+	c.trimDirectoryBasePath(&stats)
 	return &stats, err
 }
 
@@ -132,9 +186,227 @@ func (c *Client) GetDirectoryContent(p string) (*DirectoryStats, error) {
 func (c *Client) GetFileData(p string) (*FileStats, error) {
 	var stats FileStats
 	err := c.getContent(p, &stats)
+	stats.Path = c.trimBasePath(stats.Path)
 	return &stats, err
 }
 
+// Gets the sha256 checksums of all files in the given directory, and
+// all sub directories. The keys are the paths relative to the directory.
+func (c *Client) GetChecksums(p string) (map[string]string, error) {
+	sUrl, err := c.getUrl(p)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest("GET", sUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setHeaders(req)
+
+	q := req.URL.Query()
+	q.Set("checksums", ChecksumSha256)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var response invalidRequest
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		if err != nil {
+			return nil, err
+		}
+		if response.Error == "" {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, errors.New(response.Error)
+	}
+
+	return parseChecksumManifest(resp.Body)
+}
+
+// Compares the local directory against the given directory on the server.
+// Reports files that are missing locally, extra files that only exist locally,
+// and files where the content doesn't match.
+func (c *Client) VerifyTree(localDir, remotePath string) (*TreeVerification, error) {
+	remote, err := c.GetChecksums(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyTree(localDir, remote)
+}
+
+// Searches recursively for files and directories matching the options
+func (c *Client) Search(options SearchOptions) ([]DirectoryEntry, error) {
+	sUrl, err := c.getUrl("/search")
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest("GET", sUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setHeaders(req)
+	req.Header.Set("accept", FormatNdjson)
+	req.URL.RawQuery = options.Query().Encode()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var response invalidRequest
+		err = decoder.Decode(&response)
+		if err != nil {
+			return nil, err
+		}
+		if response.Error == "" {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, errors.New(response.Error)
+	}
+
+	var results []DirectoryEntry
+	for {
+		var entry DirectoryEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		entry.Path = c.trimBasePath(entry.Path)
+		results = append(results, entry)
+	}
+}
+
+// Watches for changes below the given path. The returned channel gets the change
+// events until the context is cancelled, after which it's closed. If the connection
+// is lost, the client reconnects and resumes from the last event it got.
+func (c *Client) Watch(ctx context.Context, p string) (<-chan ChangeEvent, error) {
+	resp, err := c.openEventStream(ctx, p, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan ChangeEvent)
+	go func() {
+		defer close(events)
+
+		var lastID uint64
+		retry := time.Duration(eventsRetryInterval) * time.Millisecond
+		for {
+			lastID, retry = readEventStream(ctx, resp.Body, events, lastID, retry)
+			resp.Body.Close()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retry):
+				}
+
+				resp, err = c.openEventStream(ctx, p, lastID)
+				if err == nil {
+					break
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func (c *Client) openEventStream(ctx context.Context, p string, lastID uint64) (*http.Response, error) {
+	sUrl, err := c.getUrl("/events")
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest("GET", sUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	c.setHeaders(req)
+	req.Header.Set("accept", FormatEventStream)
+	if lastID != 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+	}
+	q := req.URL.Query()
+	q.Set("path", p)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var response invalidRequest
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		if err != nil || response.Error == "" {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, errors.New(response.Error)
+	}
+
+	return resp, nil
+}
+
+// Reads server sent events until the stream ends, and sends them to the channel.
+// Returns the id of the last event, and how long to wait before reconnecting.
+func readEventStream(ctx context.Context, body io.Reader, events chan<- ChangeEvent, lastID uint64, retry time.Duration) (uint64, time.Duration) {
+	var data bytes.Buffer
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i != -1 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "":
+			// Comments and the end of events
+			if line != "" || data.Len() == 0 {
+				continue
+			}
+			var event ChangeEvent
+			err := json.Unmarshal(data.Bytes(), &event)
+			data.Reset()
+			if err != nil {
+				continue
+			}
+			select {
+			case events <- event:
+				lastID = event.ID
+			case <-ctx.Done():
+				return lastID, retry
+			}
+		case "data":
+			data.WriteString(value)
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+
+	return lastID, retry
+}
+
 // Requirements for uploading a file to GFS
 type UploadFile struct {
 	// The name of the file to upload
@@ -186,7 +458,7 @@ func (c *Client) UploadFile(file UploadFile) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", sUrl, file.Reader)
+	req, err := c.newRequest("POST", sUrl, file.Reader)
 	if err != nil {
 		return err
 	}
@@ -231,6 +503,8 @@ func NewClient(host, username, password string) (*Client, error) {
 
 	client := Client{
 		url: u,
+		// Lets the server continue the traces of the requests
+		client: http.Client{Transport: &tracingTransport{}},
 	}
 
 	err = client.Login(username, password)
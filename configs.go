@@ -3,7 +3,7 @@ package gfs
 import (
 	"encoding/json"
 	"github.com/satori/go.uuid"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 )
@@ -16,12 +16,97 @@ type Config struct {
 	Password string `json:"password"`
 	// The path that should be served
 	Serve string `json:"serve"`
-	// The port to serve on
+	// The port to serve on every interface, if no listen addresses are configured
 	Port string `json:"port"`
 	// The secret used to verify authorized requests
 	Secret string `json:"secret"`
 	// Indicates if login is required to be allowed to read the contents
 	LoginRequiredForRead bool `json:"loginRequiredForRead"`
+	// The path where gfs keeps its own data, e.g. who uploaded which files
+	Data string `json:"data"`
+	// Limits for how much can be uploaded
+	Quotas QuotaConfig `json:"quotas"`
+	// Limits for what can be uploaded
+	Uploads UploadLimits `json:"uploads"`
+	// Limits for how fast files can be uploaded and downloaded
+	Bandwidth BandwidthLimits `json:"bandwidth"`
+	// Settings for searching the content of text files
+	ContentIndex ContentIndexConfig `json:"contentIndex"`
+	// Urls that are notified about changes
+	Webhooks []WebhookConfig `json:"webhooks"`
+	// Commands that run when files are uploaded
+	Hooks HooksConfig `json:"hooks"`
+	// Settings for scanning uploads for malware
+	Scanner ScannerConfig `json:"scanner"`
+	// Rules for automatically deleting old files
+	Retention RetentionConfig `json:"retention"`
+	// Settings for the Prometheus metrics endpoint
+	Metrics MetricsConfig `json:"metrics"`
+	// Settings for what is logged, and how
+	Logging LoggingConfig `json:"logging"`
+	// Settings for the audit log
+	Audit AuditConfig `json:"audit"`
+	// The users allowed to administer gfs, besides the configured user
+	Admins []string `json:"admins"`
+	// Settings for the readiness check
+	Health HealthConfig `json:"health"`
+	// Settings for OpenTelemetry tracing
+	Tracing TracingConfig `json:"tracing"`
+	// The addresses to listen on. Defaults to the port on every interface
+	Listen []ListenConfig `json:"listen"`
+	// The path prefix gfs is served under, e.g. "/files". Empty to serve at the root
+	BasePath string `json:"basePath"`
+	// The addresses or cidr ranges of reverse proxies, which are trusted to tell
+	// who the client is with the X-Forwarded-* headers
+	TrustedProxies []string `json:"trustedProxies"`
+	// Settings for trusting the user authenticated by a proxy in front of gfs
+	ForwardAuth ForwardAuthConfig `json:"forwardAuth"`
+	// Settings for logging in through an OpenID Connect provider
+	Oidc OidcConfig `json:"oidc"`
+	// Settings for logging in with the users of an LDAP directory
+	Ldap LdapConfig `json:"ldap"`
+}
+
+// Limits for how much can be stored. A zero value means unlimited.
+type Quota struct {
+	// The max number of bytes that can be stored
+	MaxBytes int64 `json:"maxBytes"`
+	// The max number of files that can be stored
+	MaxFiles int64 `json:"maxFiles"`
+}
+
+// The storage quotas that apply to uploads
+type QuotaConfig struct {
+	// Applies to everything in the serve path
+	Global Quota `json:"global"`
+	// Applies to the files uploaded by the given user
+	Users map[string]Quota `json:"users"`
+	// Applies to everything below the given path prefix
+	Paths map[string]Quota `json:"paths"`
+}
+
+// Gets the path where gfs keeps its own data
+func (c *Config) getDataPath() string {
+	if c.Data == "" {
+		return DefaultDataPath
+	}
+	return c.Data
+}
+
+// Checks if the user is allowed to administer gfs
+func (c *Config) isAdmin(user string) bool {
+	if user == "" {
+		return false
+	}
+	if user == c.Username {
+		return true
+	}
+	for _, admin := range c.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
 }
 
 // Reads the specified config file
@@ -44,7 +129,7 @@ func GetConfigs(path string) (config *Config, err error) {
 	config, err = readConfigFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Println("Config file didn't exist, defaulting")
+			slog.Info("Config file didn't exist, defaulting", "path", path)
 
 			password, err := CreatePassword("password")
 			if err != nil {
@@ -55,6 +140,7 @@ func GetConfigs(path string) (config *Config, err error) {
 				Username: "username",
 				Password: password,
 				Serve:    DefaultServePath,
+				Data:     DefaultDataPath,
 				Port:     "8080",
 				Secret:   uuid.NewV4().String(),
 			}
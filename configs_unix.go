@@ -5,4 +5,5 @@ package gfs
 const (
 	DefaultConfigPath string = "/etc/gfs/gfs.json"
 	DefaultServePath  string = "/var/gfs/storage/"
+	DefaultDataPath   string = "/var/gfs/data/"
 )
@@ -3,4 +3,5 @@ package gfs
 const (
 	DefaultConfigPath string = `C:\ProgramData\gfs\gfs.json`
 	DefaultServePath  string = `C:\ProgramData\gfs\storage`
+	DefaultDataPath   string = `C:\ProgramData\gfs\data`
 )
@@ -0,0 +1,571 @@
+package gfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// The name of the file in the data path the content index is saved to
+	contentIndexFilename string = "content-index.gob"
+	// How often the serve path is scanned for changes not done through gfs
+	contentIndexSyncInterval time.Duration = 10 * time.Minute
+	// How often the index is saved, if it has changed
+	contentIndexSaveInterval time.Duration = time.Minute
+	// Files larger than this are not indexed, unless configured otherwise
+	defaultContentIndexMaxFileSize int64 = 10 << 20
+	// The max length of the snippets returned from searches
+	maxSnippetLength int = 200
+)
+
+// Settings for the full text content index
+type ContentIndexConfig struct {
+	// Enables indexing of the content of text files
+	Enabled bool `json:"enabled"`
+	// Files larger than this many bytes are not indexed. Defaults to 10MB
+	MaxFileSize int64 `json:"maxFileSize"`
+}
+
+// A file in the content index
+type indexedFile struct {
+	Size    int64
+	ModTime time.Time
+	// The distinct words in the file
+	Words []string
+}
+
+// A line matching a content search
+type ContentSearchResult struct {
+	// The path to the file. Relative to the serve root
+	Path string `json:"path" xml:"path"`
+	// The line number, starting from 1
+	Line int `json:"line" xml:"line"`
+	// The content of the line
+	Snippet string `json:"snippet" xml:"snippet"`
+}
+
+// An inverted index of the words in the text files in the serve path
+type ContentIndex struct {
+	config *Config
+	// Files that expire are kept out of the index, as searching them would get
+	// around their max downloads. Can be nil
+	expiry *ExpiryTracker
+	lock   sync.RWMutex
+	// The indexed files, keyed by their path relative to the serve root
+	files map[string]indexedFile
+	// The files each word can be found in
+	postings map[string]map[string]bool
+	// True if the index has changed since it was last saved
+	dirty bool
+	// Only one sync can run at a time
+	syncLock sync.Mutex
+	// True while the index is being built
+	syncing bool
+	// True from when a rebuild is started until it has finished
+	rebuilding bool
+}
+
+// Creates a new content index, and loads the index from the data path
+// if it has been saved before
+func NewContentIndex(config *Config, expiry *ExpiryTracker) (*ContentIndex, error) {
+	index := &ContentIndex{
+		config:   config,
+		expiry:   expiry,
+		files:    make(map[string]indexedFile),
+		postings: make(map[string]map[string]bool),
+	}
+
+	file, err := os.Open(index.getIndexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var files map[string]indexedFile
+	err = gob.NewDecoder(file).Decode(&files)
+	if err != nil {
+		// The index can always be rebuilt, so a broken index is not fatal
+		slog.Warn("Unable to read content index, rebuilding it", "error", err)
+		return index, nil
+	}
+
+	for p, f := range files {
+		index.add(p, f)
+	}
+
+	return index, nil
+}
+
+func (index *ContentIndex) getIndexPath() string {
+	return path.Join(index.config.getDataPath(), contentIndexFilename)
+}
+
+func (index *ContentIndex) getMaxFileSize() int64 {
+	if index.config.ContentIndex.MaxFileSize > 0 {
+		return index.config.ContentIndex.MaxFileSize
+	}
+	return defaultContentIndexMaxFileSize
+}
+
+// Keeps the index up to date in the background
+func (index *ContentIndex) run() {
+	index.syncAndLog()
+
+	syncTick := time.Tick(contentIndexSyncInterval)
+	saveTick := time.Tick(contentIndexSaveInterval)
+	for {
+		select {
+		case <-syncTick:
+			index.syncAndLog()
+		case <-saveTick:
+			err := index.save()
+			if err != nil {
+				slog.Error("Unable to save content index", "error", err)
+			}
+		}
+	}
+}
+
+func (index *ContentIndex) syncAndLog() {
+	index.logSync(index.Sync)
+}
+
+// Runs the given sync, and logs how it went
+func (index *ContentIndex) logSync(syncFunc func() error) {
+	start := time.Now()
+	err := syncFunc()
+	if err != nil {
+		slog.Error("Error when indexing content", "error", err)
+		return
+	}
+	slog.Info("Content index synced", "duration", time.Since(start))
+}
+
+// Returns true while the index is being built
+func (index *ContentIndex) IsSyncing() bool {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	return index.syncing
+}
+
+// Throws away the index, and indexes everything again
+func (index *ContentIndex) Rebuild() error {
+	index.syncLock.Lock()
+	index.lock.Lock()
+	index.files = make(map[string]indexedFile)
+	index.postings = make(map[string]map[string]bool)
+	index.dirty = true
+	index.lock.Unlock()
+	index.syncLock.Unlock()
+
+	return index.Sync()
+}
+
+// Rebuilds the index in the background. Only one rebuild can be queued or running at a time
+func (index *ContentIndex) startRebuild() error {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if index.rebuilding {
+		return ErrContentIndexRebuilding
+	}
+	index.rebuilding = true
+
+	go func() {
+		slog.Info("Rebuilding content index")
+		index.logSync(index.Rebuild)
+
+		index.lock.Lock()
+		index.rebuilding = false
+		index.lock.Unlock()
+	}()
+	return nil
+}
+
+// Scans the serve path, and indexes files that has changed since they
+// were last indexed. Files that no longer exists, or can no longer be read,
+// are removed from the index.
+func (index *ContentIndex) Sync() error {
+	index.syncLock.Lock()
+	defer index.syncLock.Unlock()
+
+	index.lock.Lock()
+	index.syncing = true
+	index.lock.Unlock()
+	defer func() {
+		index.lock.Lock()
+		index.syncing = false
+		index.lock.Unlock()
+	}()
+
+	seen := make(map[string]bool)
+	err := filepath.Walk(index.config.Serve, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if fullpath == index.config.Serve {
+				return err
+			}
+			slog.Warn("Unable to index directory entry", "path", fullpath, "error", err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || isStagingFile(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(index.config.Serve, fullpath)
+		if err != nil {
+			return err
+		}
+		p := path.Join("/", filepath.ToSlash(rel))
+		// Not marked as seen, so it's removed from the index if it was indexed before it got an expiry
+		if index.isExpiring(p) {
+			return nil
+		}
+		seen[p] = true
+
+		index.lock.RLock()
+		existing, ok := index.files[p]
+		index.lock.RUnlock()
+		if ok && existing.Size == info.Size() && existing.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+
+		err = index.indexFile(p, fullpath, info)
+		if err != nil {
+			slog.Warn("Unable to index file", "path", p, "error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	index.lock.Lock()
+	for p := range index.files {
+		if !seen[p] {
+			index.remove(p)
+		}
+	}
+	index.lock.Unlock()
+
+	return index.save()
+}
+
+// Updates the index of a single file. Call this when a file has changed.
+func (index *ContentIndex) Update(p string) {
+	if index.isExpiring(p) {
+		index.Forget(p)
+		return
+	}
+
+	fullpath := path.Join(index.config.Serve, p)
+	info, err := os.Stat(fullpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			index.Forget(p)
+			return
+		}
+		slog.Warn("Unable to index file", "path", p, "error", err)
+		return
+	}
+
+	err = index.indexFile(p, fullpath, info)
+	if err != nil {
+		slog.Warn("Unable to index file", "path", p, "error", err)
+	}
+}
+
+// Removes the file from the index. Call this when a file has been deleted.
+func (index *ContentIndex) Forget(p string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	index.remove(p)
+}
+
+func (index *ContentIndex) isExpiring(p string) bool {
+	return index.expiry != nil && index.expiry.has(p)
+}
+
+// Reads and indexes the given file. Files that are too big, or are not
+// text files, are indexed without any words.
+func (index *ContentIndex) indexFile(p, fullpath string, info os.FileInfo) error {
+	var words []string
+	if info.Size() <= index.getMaxFileSize() {
+		file, err := os.Open(fullpath)
+		if err != nil {
+			return err
+		}
+		words, err = readWords(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	// Files without words are kept too, so they are not read again until they change
+	index.remove(p)
+	index.add(p, indexedFile{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Words:   words,
+	})
+	index.dirty = true
+	return nil
+}
+
+// Adds the file to the index. Should only be called while holding the lock.
+func (index *ContentIndex) add(p string, file indexedFile) {
+	index.files[p] = file
+	for _, word := range file.Words {
+		files, ok := index.postings[word]
+		if !ok {
+			files = make(map[string]bool)
+			index.postings[word] = files
+		}
+		files[p] = true
+	}
+}
+
+// Removes the file from the index. Should only be called while holding the lock.
+func (index *ContentIndex) remove(p string) {
+	file, ok := index.files[p]
+	if !ok {
+		return
+	}
+
+	for _, word := range file.Words {
+		delete(index.postings[word], p)
+		if len(index.postings[word]) == 0 {
+			delete(index.postings, word)
+		}
+	}
+	delete(index.files, p)
+	index.dirty = true
+}
+
+// Saves the index to the data path, if it has changed
+func (index *ContentIndex) save() error {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if !index.dirty {
+		return nil
+	}
+
+	err := os.MkdirAll(index.config.getDataPath(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a crash never leaves a half written index
+	tmp := index.getIndexPath() + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(index.files)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, index.getIndexPath())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	index.dirty = false
+	return nil
+}
+
+// Searches for lines containing all the words in the query, in files below the
+// given path. Returns true if there are more results than the limit.
+func (index *ContentIndex) Search(query, prefix string, limit int) ([]ContentSearchResult, bool, error) {
+	words := splitWords(query)
+	if len(words) == 0 {
+		return nil, false, nil
+	}
+
+	// Only files containing all the words can contain matching lines
+	index.lock.RLock()
+	var candidates []string
+	for p := range index.postings[words[0]] {
+		if !hasPathPrefix(p, prefix) {
+			continue
+		}
+		containsAll := true
+		for _, word := range words[1:] {
+			if !index.postings[word][p] {
+				containsAll = false
+				break
+			}
+		}
+		if containsAll {
+			candidates = append(candidates, p)
+		}
+	}
+	index.lock.RUnlock()
+	sort.Strings(candidates)
+
+	var results []ContentSearchResult
+	for _, p := range candidates {
+		// The file might have been given an expiry since it was indexed
+		if index.isExpiring(p) {
+			continue
+		}
+		lines, err := findLines(path.Join(index.config.Serve, p), words)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, false, err
+		}
+
+		for _, line := range lines {
+			if limit > 0 && len(results) >= limit {
+				return results, true, nil
+			}
+			line.Path = p
+			results = append(results, line)
+		}
+	}
+
+	return results, false, nil
+}
+
+// Splits text into lower case words. Words shorter than 2 characters are ignored.
+func splitWords(text string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(word)) < 2 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	return words
+}
+
+// Returns true if the content looks like text
+func isText(head []byte) bool {
+	if bytes.IndexByte(head, 0) != -1 {
+		return false
+	}
+	return strings.HasPrefix(http.DetectContentType(head), "text/")
+}
+
+// Reads the distinct words of a text file. Returns nil if it's not a text file.
+func readWords(reader io.Reader) ([]string, error) {
+	buffered := bufio.NewReader(reader)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(head) == 0 || !isText(head) {
+		return nil, nil
+	}
+
+	words := make([]string, 0)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		for _, word := range splitWords(scanner.Text()) {
+			if !seen[word] {
+				seen[word] = true
+				words = append(words, word)
+			}
+		}
+	}
+
+	return words, scanner.Err()
+}
+
+// Finds the lines in the file that contains all the given words
+func findLines(fullpath string, words []string) ([]ContentSearchResult, error) {
+	file, err := os.Open(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var results []ContentSearchResult
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		lineWords := make(map[string]bool)
+		for _, word := range splitWords(scanner.Text()) {
+			lineWords[word] = true
+		}
+
+		containsAll := true
+		for _, word := range words {
+			if !lineWords[word] {
+				containsAll = false
+				break
+			}
+		}
+		if containsAll {
+			results = append(results, ContentSearchResult{
+				Line:    line,
+				Snippet: getSnippet(scanner.Text(), words[0]),
+			})
+		}
+	}
+
+	return results, scanner.Err()
+}
+
+// Cuts long lines down to the part around the first occurrence of the word
+func getSnippet(line, word string) string {
+	line = strings.TrimSpace(line)
+	runes := []rune(line)
+	if len(runes) <= maxSnippetLength {
+		return line
+	}
+
+	start := 0
+	if i := strings.Index(strings.ToLower(line), word); i != -1 && i <= len(line) {
+		start = len([]rune(line[:i])) - maxSnippetLength/4
+		if start < 0 {
+			start = 0
+		}
+	}
+	end := start + maxSnippetLength
+	if end > len(runes) {
+		end = len(runes)
+		start = end - maxSnippetLength
+	}
+
+	return string(runes[start:end])
+}
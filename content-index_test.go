@@ -0,0 +1,180 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentIndex(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-content-index")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	serve := filepath.Join(dir, "serve")
+	a.NoError(os.MkdirAll(filepath.Join(serve, "docs"), os.ModePerm))
+	a.NoError(ioutil.WriteFile(filepath.Join(serve, "docs", "readme.txt"), []byte("Hello world\nnothing here\nThe world says hello back\n"), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(serve, "notes.txt"), []byte("hello there\n"), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(serve, "binary.bin"), []byte{0, 1, 2, 'h', 'e', 'l', 'l', 'o'}, 0644))
+
+	config := &Config{Serve: serve, Data: filepath.Join(dir, "data")}
+	index, err := NewContentIndex(config, nil)
+	if !a.NoError(err) {
+		return
+	}
+	if !a.NoError(index.Sync()) {
+		return
+	}
+
+	results, limitReached, err := index.Search("WORLD hello", "/", 0)
+	if a.NoError(err) && a.Len(results, 2) {
+		a.False(limitReached)
+		a.Equal(ContentSearchResult{Path: "/docs/readme.txt", Line: 1, Snippet: "Hello world"}, results[0])
+		a.Equal(3, results[1].Line)
+	}
+
+	results, _, err = index.Search("hello", "/docs", 0)
+	if a.NoError(err) {
+		a.Len(results, 2)
+	}
+
+	results, limitReached, err = index.Search("hello", "/", 1)
+	if a.NoError(err) {
+		a.Len(results, 1)
+		a.True(limitReached)
+	}
+
+	// Changes are picked up when the file is updated
+	a.NoError(ioutil.WriteFile(filepath.Join(serve, "notes.txt"), []byte("goodbye there\n"), 0644))
+	index.Update("/notes.txt")
+	results, _, err = index.Search("goodbye", "/", 0)
+	if a.NoError(err) && a.Len(results, 1) {
+		a.Equal("/notes.txt", results[0].Path)
+	}
+
+	// The saved index is loaded again
+	a.NoError(index.save())
+	loaded, err := NewContentIndex(config, nil)
+	if a.NoError(err) {
+		results, _, err = loaded.Search("goodbye", "/", 0)
+		a.NoError(err)
+		a.Len(results, 1)
+	}
+
+	// Removed files are removed from the index on the next sync, even if some
+	// directories can't be read
+	a.NoError(os.Remove(filepath.Join(serve, "notes.txt")))
+	if os.Geteuid() != 0 {
+		private := filepath.Join(serve, "private")
+		a.NoError(os.MkdirAll(private, os.ModePerm))
+		a.NoError(os.Chmod(private, 0000))
+		defer os.Chmod(private, os.ModePerm)
+	}
+	a.NoError(index.Sync())
+	results, _, err = index.Search("there", "/", 0)
+	if a.NoError(err) {
+		a.Empty(results)
+	}
+}
+
+func TestContentIndex_Expiring(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-content-index")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Serve: filepath.Join(dir, "serve"), Data: filepath.Join(dir, "data")}
+	a.NoError(os.MkdirAll(config.Serve, os.ModePerm))
+	a.NoError(ioutil.WriteFile(filepath.Join(config.Serve, "once.txt"), []byte("secret password\n"), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(config.Serve, "later.txt"), []byte("secret plans\n"), 0644))
+
+	expiry, err := NewExpiryTracker(config, nil)
+	if !a.NoError(err) {
+		return
+	}
+	index, err := NewContentIndex(config, expiry)
+	if !a.NoError(err) {
+		return
+	}
+	expiry.setIndex(index)
+	if !a.NoError(index.Sync()) {
+		return
+	}
+
+	// Given an expiry after being indexed, so it's only kept out of the results
+	expiry.Set("/later.txt", UploadExpiry{TTL: time.Nanosecond})
+	results, _, err := index.Search("secret", "/", 0)
+	if a.NoError(err) && a.Len(results, 1) {
+		a.Equal("/once.txt", results[0].Path)
+	}
+
+	// Drop box files are never indexed
+	expiry.Set("/once.txt", UploadExpiry{MaxDownloads: 1})
+	index.Update("/once.txt")
+	results, _, err = index.Search("secret", "/", 0)
+	a.NoError(err)
+	a.Empty(results, "Searching expiring files would get around the max downloads")
+	index.lock.RLock()
+	a.NotContains(index.files, "/once.txt")
+	a.Contains(index.files, "/later.txt")
+	index.lock.RUnlock()
+
+	// Expired files are removed from the index
+	expiry.Sweep()
+	index.lock.RLock()
+	a.NotContains(index.files, "/later.txt")
+	index.lock.RUnlock()
+}
+
+func TestContentIndex_Rebuild(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-content-index")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Serve: filepath.Join(dir, "serve"), Data: filepath.Join(dir, "data")}
+	index, err := NewContentIndex(config, nil)
+	if !a.NoError(err) {
+		return
+	}
+	isRebuilding := func() bool {
+		index.lock.RLock()
+		defer index.lock.RUnlock()
+		return index.rebuilding
+	}
+
+	// Keeps the rebuild waiting, like if a sync was running
+	index.syncLock.Lock()
+	a.NoError(index.startRebuild())
+	a.Equal(ErrContentIndexRebuilding, index.startRebuild(), "Rebuilds should not queue up")
+	index.syncLock.Unlock()
+
+	a.Eventually(func() bool { return !isRebuilding() }, 5*time.Second, 10*time.Millisecond)
+	a.NoError(index.startRebuild(), "It should be possible to rebuild again once done")
+	a.Eventually(func() bool { return !isRebuilding() }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestContentIndex_GetSnippet(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("short line", getSnippet("  short line  ", "line"))
+
+	line := strings.Repeat("a ", 200) + "needle" + strings.Repeat(" b", 200)
+	snippet := getSnippet(line, "needle")
+	a.Len(snippet, maxSnippetLength)
+	a.Contains(snippet, "needle")
+}
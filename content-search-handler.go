@@ -0,0 +1,160 @@
+package gfs
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+const (
+	//language=html
+	ContentSearchResponseHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>Content search in {{.Path}}</title>
+</head>
+<body>
+<h1>Content search in <a href="{{.BasePath}}{{.Path}}">{{.Path}}</a></h1>
+<form action="{{.BasePath}}/search/content" method="get">
+    <input type="hidden" name="path" value="{{.Path}}" />
+    <label for="queryInput">Search for</label>
+    <input name="q" id="queryInput" type="search" value="{{.Query}}" />
+    <button type="submit">Search</button>
+</form>
+{{if .Indexing}}
+<p>The content index is currently being built, so some results might be missing.</p>
+{{end}}
+<hr />
+<table>
+    <thead>
+        <tr>
+            <th>File</th>
+            <th>Line</th>
+            <th>Content</th>
+        </tr>
+    </thead>
+    <tbody>
+		{{range .Results}}
+		<tr>
+			<td><a href="{{.Path}}">{{.Path}}</a></td>
+			<td>{{.Line}}</td>
+			<td><code>{{.Snippet}}</code></td>
+		</tr>
+		{{else}}
+		<tr>
+			<td colspan="3">Nothing found</td>
+		</tr>
+		{{end}}
+    </tbody>
+</table>
+{{if .LimitReached}}
+<p>Only the first {{len .Results}} results are shown.</p>
+{{end}}
+</body>
+</html>`
+
+	// The max number of results returned if no limit is given
+	defaultContentSearchLimit int = 1000
+)
+
+var (
+	ErrContentIndexDisabled   = errors.New("Content search is not enabled on this server")
+	ErrNoSearchQuery          = errors.New("No search query provided")
+	ErrContentIndexRebuilding = errors.New("The content index is already being rebuilt")
+)
+
+// The results of a content search
+type ContentSearchResponse struct {
+	// What was searched for
+	Query string `json:"query" xml:"query"`
+	// The directory that was searched in
+	Path string `json:"path" xml:"path"`
+	// The matching lines
+	Results []ContentSearchResult `json:"results" xml:"results"`
+	// True if there are more results than returned
+	LimitReached bool `json:"limit_reached" xml:"limit_reached"`
+	// True if the index is currently being built, so results might be missing
+	Indexing bool `json:"indexing" xml:"indexing"`
+	// The path prefix of every link to gfs
+	BasePath string `json:"-" xml:"-"`
+}
+
+type ContentSearchHandler struct {
+	responseHandler
+	index        *ContentIndex
+	htmlTemplate *template.Template
+}
+
+func GetContentSearchHandler(index *ContentIndex) (h *ContentSearchHandler, err error) {
+	t := template.New("Content Search Response Html Template")
+	t, err = t.Parse(ContentSearchResponseHtml)
+	if err != nil {
+		return nil, err
+	}
+	h = &ContentSearchHandler{
+		index:        index,
+		htmlTemplate: t,
+	}
+
+	return h, nil
+}
+
+// Searches the content of the indexed files. Returns an error if the request is invalid.
+func (h *ContentSearchHandler) Handle(writer http.ResponseWriter, request *http.Request, format string) error {
+	if h.index == nil {
+		return ErrContentIndexDisabled
+	}
+
+	query := request.URL.Query()
+	response := ContentSearchResponse{
+		Query:    query.Get("q"),
+		Path:     path.Join("/", query.Get("path")),
+		Indexing: h.index.IsSyncing(),
+		BasePath: getBasePath(request),
+	}
+	if response.Query == "" {
+		return ErrNoSearchQuery
+	}
+
+	limit := defaultContentSearchLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return ErrInvalidLimit
+		}
+	}
+
+	var err error
+	response.Results, response.LimitReached, err = h.index.Search(response.Query, response.Path, limit)
+	if err != nil {
+		return err
+	}
+	for i := range response.Results {
+		response.Results[i].Path = response.BasePath + response.Results[i].Path
+	}
+
+	err = h.responseHandler.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, response)
+	if err != nil {
+		slog.Error("Something went wrong when responding", "error", err)
+	}
+	return nil
+}
+
+// Starts a rebuild of the index in the background
+func (h *ContentSearchHandler) Rebuild(writer http.ResponseWriter) error {
+	if h.index == nil {
+		return ErrContentIndexDisabled
+	}
+
+	err := h.index.startRebuild()
+	if err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusAccepted)
+	return nil
+}
@@ -0,0 +1,264 @@
+package gfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The keys directory listings can be sorted by
+const (
+	SortByName  string = "name"
+	SortBySize  string = "size"
+	SortByMtime string = "mtime"
+	SortByType  string = "type"
+)
+
+// Ways directory listings can be limited to only some kinds of entries
+const (
+	OnlyFiles       string = "files"
+	OnlyDirectories string = "dirs"
+)
+
+var (
+	ErrInvalidSortKey   = errors.New("Invalid sort key. Valid keys are: 'name', 'size', 'mtime' and 'type'")
+	ErrInvalidSortOrder = errors.New("Invalid sort order. Valid orders are: 'asc' and 'desc'")
+	ErrInvalidOnly      = errors.New("Invalid value for only. Valid values are: 'files' and 'dirs'")
+	ErrInvalidLimit     = errors.New("Invalid limit. The limit has to be a positive number")
+	ErrInvalidCursor    = errors.New("Invalid cursor")
+	ErrInvalidFilter    = errors.New("Invalid filter pattern")
+)
+
+// Options for how a directory should be listed
+type ListingOptions struct {
+	// What to sort by. Defaults to name
+	Sort string
+	// Sort in descending order instead of ascending
+	Descending bool
+	// Only include entries where the name matches this glob pattern, or contains this
+	// text if it's not a pattern
+	Filter string
+	// Only include files or directories
+	Only string
+	// The max number of entries to return. 0 means all entries
+	Limit int
+	// Only include entries after this cursor. Gotten from DirectoryStats.NextCursor
+	Cursor string
+}
+
+// Reads the listing options from the query parameters of a request
+func parseListingOptions(query url.Values) (options ListingOptions, err error) {
+	options.Sort = query.Get("sort")
+	switch options.Sort {
+	case "":
+		options.Sort = SortByName
+	case SortByName, SortBySize, SortByMtime, SortByType:
+	default:
+		return options, ErrInvalidSortKey
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		options.Descending = true
+	default:
+		return options, ErrInvalidSortOrder
+	}
+
+	options.Only = query.Get("only")
+	switch options.Only {
+	case "", OnlyFiles, OnlyDirectories:
+	default:
+		return options, ErrInvalidOnly
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		options.Limit, err = strconv.Atoi(limit)
+		if err != nil || options.Limit < 0 {
+			return options, ErrInvalidLimit
+		}
+	}
+
+	options.Filter = query.Get("filter")
+	// An invalid pattern would otherwise silently match nothing
+	if options.isPattern() {
+		if _, err := path.Match(options.Filter, ""); err != nil {
+			return options, ErrInvalidFilter
+		}
+	}
+	options.Cursor = query.Get("cursor")
+
+	return options, nil
+}
+
+// Converts the options to query parameters
+func (o ListingOptions) Query() url.Values {
+	query := url.Values{}
+	if o.Sort != "" && o.Sort != SortByName {
+		query.Set("sort", o.Sort)
+	}
+	if o.Descending {
+		query.Set("order", "desc")
+	}
+	if o.Filter != "" {
+		query.Set("filter", o.Filter)
+	}
+	if o.Only != "" {
+		query.Set("only", o.Only)
+	}
+	if o.Limit != 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		query.Set("cursor", o.Cursor)
+	}
+	return query
+}
+
+// Gets a link for sorting by the given key. Sorting by the current key
+// reverses the order. Always links to the first page.
+func (o ListingOptions) SortLink(key string) string {
+	o.Descending = o.Sort == key && !o.Descending
+	o.Sort = key
+	o.Cursor = ""
+	return "?" + o.Query().Encode()
+}
+
+// Gets a link to the page starting at the given cursor
+func (o ListingOptions) PageLink(cursor string) string {
+	o.Cursor = cursor
+	return "?" + o.Query().Encode()
+}
+
+// Checks if the filter is a glob pattern, instead of text the names should contain
+func (o ListingOptions) isPattern() bool {
+	return strings.ContainsAny(o.Filter, "*?[")
+}
+
+// Checks if the entry should be included in the listing
+func (o ListingOptions) matches(entry DirectoryEntry) bool {
+	if o.Only == OnlyFiles && entry.IsDirectory {
+		return false
+	}
+	if o.Only == OnlyDirectories && !entry.IsDirectory {
+		return false
+	}
+
+	if o.Filter == "" {
+		return true
+	}
+	if o.isPattern() {
+		matched, err := path.Match(o.Filter, entry.Name)
+		return err == nil && matched
+	}
+	return strings.Contains(strings.ToLower(entry.Name), strings.ToLower(o.Filter))
+}
+
+// Returns true if a should be listed before b. Names are used to break ties,
+// so no two entries in a directory are ever equal.
+func (o ListingOptions) less(a, b DirectoryEntry) bool {
+	if o.Descending {
+		a, b = b, a
+	}
+
+	switch o.Sort {
+	case SortBySize:
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case SortByMtime:
+		if !a.LastModificationTime.Equal(b.LastModificationTime) {
+			return a.LastModificationTime.Before(b.LastModificationTime)
+		}
+	case SortByType:
+		if a.Type() != b.Type() {
+			// Directories are always listed first
+			if a.IsDirectory != b.IsDirectory {
+				return a.IsDirectory
+			}
+			return a.Type() < b.Type()
+		}
+	}
+	return a.Name < b.Name
+}
+
+// The information needed to know where a page ended
+type listingCursor struct {
+	Name                 string    `json:"n"`
+	Size                 int64     `json:"s"`
+	IsDirectory          bool      `json:"d"`
+	LastModificationTime time.Time `json:"m"`
+}
+
+func encodeCursor(entry DirectoryEntry) string {
+	data, _ := json.Marshal(listingCursor{
+		Name:                 entry.Name,
+		Size:                 entry.Size,
+		IsDirectory:          entry.IsDirectory,
+		LastModificationTime: entry.LastModificationTime,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (DirectoryEntry, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return DirectoryEntry{}, ErrInvalidCursor
+	}
+
+	var c listingCursor
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return DirectoryEntry{}, ErrInvalidCursor
+	}
+
+	return DirectoryEntry{
+		Name:                 c.Name,
+		Size:                 c.Size,
+		IsDirectory:          c.IsDirectory,
+		LastModificationTime: c.LastModificationTime,
+	}, nil
+}
+
+// Filters, sorts and paginates the entries according to the options.
+// Returns the entries of the page, the number of entries on all pages,
+// and the cursor to the next page, if there are more entries.
+func (o ListingOptions) apply(entries []DirectoryEntry) (page []DirectoryEntry, total int, next string, err error) {
+	page = make([]DirectoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if o.matches(entry) {
+			page = append(page, entry)
+		}
+	}
+	total = len(page)
+
+	sort.Slice(page, func(i, j int) bool {
+		return o.less(page[i], page[j])
+	})
+
+	// The cursor is the last entry of the previous page, so continue right after it.
+	// That way entries being added or removed doesn't cause entries to be skipped.
+	if o.Cursor != "" {
+		last, err := decodeCursor(o.Cursor)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		start := sort.Search(len(page), func(i int) bool {
+			return o.less(last, page[i])
+		})
+		page = page[start:]
+	}
+
+	if o.Limit > 0 && len(page) > o.Limit {
+		page = page[:o.Limit]
+		next = encodeCursor(page[len(page)-1])
+	}
+
+	return page, total, next, nil
+}
@@ -0,0 +1,94 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestListingOptions(t *testing.T) {
+	now := time.Now()
+	entries := []DirectoryEntry{
+		{Name: "b.zip", Size: 30, LastModificationTime: now},
+		{Name: "a.txt", Size: 20, LastModificationTime: now.Add(-time.Hour)},
+		{Name: "docs", IsDirectory: true, LastModificationTime: now.Add(-2 * time.Hour)},
+		{Name: "c.zip", Size: 10, LastModificationTime: now.Add(-3 * time.Hour)},
+	}
+
+	names := func(entries []DirectoryEntry) (names []string) {
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+
+	list := func(t *testing.T, query string) ([]string, string) {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options, err := parseListingOptions(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, _, next, err := options.apply(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names(page), next
+	}
+
+	t.Run("Sorting", func(t *testing.T) {
+		a := assert.New(t)
+
+		page, _ := list(t, "")
+		a.Equal([]string{"a.txt", "b.zip", "c.zip", "docs"}, page)
+
+		page, _ = list(t, "sort=size&order=desc")
+		a.Equal([]string{"b.zip", "a.txt", "c.zip", "docs"}, page)
+
+		page, _ = list(t, "sort=mtime")
+		a.Equal([]string{"c.zip", "docs", "a.txt", "b.zip"}, page)
+
+		page, _ = list(t, "sort=type")
+		a.Equal([]string{"docs", "a.txt", "b.zip", "c.zip"}, page)
+	})
+
+	t.Run("Filtering", func(t *testing.T) {
+		a := assert.New(t)
+
+		page, _ := list(t, "filter=*.zip")
+		a.Equal([]string{"b.zip", "c.zip"}, page)
+
+		page, _ = list(t, "filter=DOC")
+		a.Equal([]string{"docs"}, page)
+
+		page, _ = list(t, "only=files&sort=size")
+		a.Equal([]string{"c.zip", "a.txt", "b.zip"}, page)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		a := assert.New(t)
+
+		page, next := list(t, "limit=3")
+		a.Equal([]string{"a.txt", "b.zip", "c.zip"}, page)
+
+		page, next = list(t, "limit=3&cursor="+next)
+		a.Equal([]string{"docs"}, page)
+		a.Empty(next)
+	})
+
+	t.Run("Invalid options", func(t *testing.T) {
+		a := assert.New(t)
+
+		_, err := parseListingOptions(url.Values{"sort": {"color"}})
+		a.Equal(ErrInvalidSortKey, err)
+
+		_, err = parseListingOptions(url.Values{"filter": {"[a-"}})
+		a.Equal(ErrInvalidFilter, err, "A broken pattern should not silently match nothing")
+
+		_, _, _, err = ListingOptions{Cursor: "nope"}.apply(entries)
+		a.Equal(ErrInvalidCursor, err)
+	})
+}
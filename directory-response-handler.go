@@ -2,8 +2,10 @@ package gfs
 
 import (
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -11,19 +13,21 @@ const (
 	//language=html
 	LoginHtml = `
 <h2>Login</h2>
-<form action="/login" method="post">
+<form action="{{.BasePath}}/login" method="post">
     <label for="usernameInput">Username</label>
     <input name="username" id="usernameInput" type="text" required />
     <label for="passwordInput">Password</label>
     <input name="password" id="passwordInput" type="password" required />
     <input type="hidden" name="redirectTo" value="{{.Path}}" />
     <button type="submit">Login</button>
-</form>`
+</form>
+{{if .OidcLogin}}<p><a href="{{.BasePath}}/oidc/login?redirectTo={{.Path}}">Login with single sign-on</a></p>{{end}}`
 
 	//language=html
-	UploadHtml string = `<form enctype="multipart/form-data" name="uploadFilesForm" id="uploadFilesForm" action="/upload" method="post">
+	UploadHtml string = `<form enctype="multipart/form-data" name="uploadFilesForm" id="uploadFilesForm" action="{{.BasePath}}/upload" method="post">
+    <input type="hidden" name="path" value="{{.RequestPath}}"/>
+    <label><input type="checkbox" name="extract"/> Extract archives</label>
     <input type="file" multiple="multiple" name="uploadfiles"/>
-    <input type="hidden" name="path" value="{{.Path}}"/>
     <button type="submit" form="uploadFilesForm">Upload</button>
 </form>
 	`
@@ -36,18 +40,39 @@ const (
 <body>
 <h1><a href="{{.Path}}">{{.Name}}</a> <small>last modified: {{.LastModificationTime}}</small></h1>
 <hr />
+<form action="{{.BasePath}}/search" method="get">
+    <input type="hidden" name="path" value="{{.RequestPath}}" />
+    <label for="searchInput">Search</label>
+    <input name="name" id="searchInput" type="search" placeholder="*.zip" />
+    <button type="submit">Search</button>
+</form>
+<form method="get">
+    <label for="filterInput">Filter</label>
+    <input name="filter" id="filterInput" type="search" value="{{.Options.Filter}}" placeholder="*.zip" />
+    <select name="only">
+        <option value="" {{if eq .Options.Only ""}}selected{{end}}>Everything</option>
+        <option value="files" {{if eq .Options.Only "files"}}selected{{end}}>Files</option>
+        <option value="dirs" {{if eq .Options.Only "dirs"}}selected{{end}}>Directories</option>
+    </select>
+    <input type="hidden" name="sort" value="{{.Options.Sort}}" />
+    {{if .Options.Descending}}<input type="hidden" name="order" value="desc" />{{end}}
+    {{if .Options.Limit}}<input type="hidden" name="limit" value="{{.Options.Limit}}" />{{end}}
+    <button type="submit">Filter</button>
+</form>
 <table>
     <thead>
         <tr>
-            <th>Name</th>
-            <th>Size</th>
-            <th>Last modified</th>
+            <th><a href="{{.Options.SortLink "name"}}">Name</a></th>
+            <th><a href="{{.Options.SortLink "type"}}">Type</a></th>
+            <th><a href="{{.Options.SortLink "size"}}">Size</a></th>
+            <th><a href="{{.Options.SortLink "mtime"}}">Last modified</a></th>
         </tr>
     </thead>
     <tbody>
 		{{range .Entries}}
 		<tr>
 			<td><a href="{{.Path}}">{{.Name}}</a></td>
+			<td>{{.Type}}</td>
 			<td>
 			{{if .IsDirectory}}
 				&lt;Dir&gt;
@@ -57,15 +82,21 @@ const (
 			</td>
 			<td>
 			{{.LastModificationTime}}
+			{{if .ExpiresAt}}<small>expires: {{.ExpiresAt}}</small>{{end}}
 			</td>
 		</tr>
 		{{else}}
 		<tr>
-			<td colspan="3">No entries</td>
+			<td colspan="4">No entries</td>
 		</tr>
 		{{end}}
     </tbody>
 </table>
+<p>
+	{{.TotalEntries}} entries
+	{{if .Options.Cursor}}<a href="{{.Options.PageLink ""}}">First page</a>{{end}}
+	{{if .NextCursor}}<a href="{{.Options.PageLink .NextCursor}}">Next page</a>{{end}}
+</p>
 <hr />
 {{if .Authorized}}
 	{{template "upload" .}}
@@ -82,7 +113,7 @@ const (
 type DirectoryEntry struct {
 	// The name of the file
 	Name string `json:"name" xml:"name"`
-	// The path to the file. Relative to the serve root
+	// The path to the file. Relative to the serve root, but starts with the base path gfs is served under, if any
 	Path string `json:"path" xml:"path"`
 	// The size of the file. 0 if a directory
 	Size int64 `json:"size,omitempty" xml:"size,omitempty"`
@@ -90,24 +121,62 @@ type DirectoryEntry struct {
 	IsDirectory bool `json:"is_directory" xml:"is_directory"`
 	// The last time this file was modified
 	LastModificationTime time.Time `json:"last_modification_time" xml:"last_modification_time"`
+	// The time the entry will be deleted by a retention rule, if any
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+}
+
+// Gets the type of the entry. Either "directory", or the extension of the file
+func (e DirectoryEntry) Type() string {
+	if e.IsDirectory {
+		return "directory"
+	}
+	return strings.ToLower(strings.TrimPrefix(path.Ext(e.Name), "."))
 }
 
 // Simple stats about a directory
 type DirectoryStats struct {
 	// The name of the directory
 	Name string `json:"name" xml:"name"`
-	// The path to the directory. Relative to the serve root
+	// The path to the directory. Relative to the serve root, but starts with the base path gfs is served under, if any
 	Path string `json:"path" xml:"path"`
 	// The last time this file was modified
 	LastModificationTime time.Time `json:"last_modification_time" xml:"last_modification_time"`
 	// The content directory available in this directory
 	Entries []DirectoryEntry `json:"entries" xml:"entries"`
+	// The number of entries on all pages combined
+	TotalEntries int `json:"total_entries" xml:"total_entries"`
+	// The cursor to use to get the next page. Empty if there are no more pages
+	NextCursor string `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+	// The options the entries was listed with
+	Options ListingOptions `json:"-" xml:"-"`
 	// Indicates if the request is authorized
 	Authorized bool `json:"authorized" xml:"authorized"`
 	// Indicates if a new update is available for GFS
 	HasUpdate bool `json:"has_update" xml:"has_update"`
 	// Indicates the url the update can be downloaded at, if HasUpdate is true
 	UpdateUrl string `json:"update_url" xml:"update_url"`
+	// The path prefix of every link to gfs. Empty if gfs is served at the root
+	BasePath string `json:"-" xml:"-"`
+	// True if users can log in through the OpenID Connect provider
+	OidcLogin bool `json:"-" xml:"-"`
+}
+
+// Gets a copy of the stats, with the base path added to the paths
+func (s *DirectoryStats) withBasePath(basePath string) *DirectoryStats {
+	stats := *s
+	stats.BasePath = basePath
+	stats.Path = basePath + s.Path
+	stats.Entries = make([]DirectoryEntry, len(s.Entries))
+	for i, entry := range s.Entries {
+		entry.Path = basePath + entry.Path
+		stats.Entries[i] = entry
+	}
+	return &stats
+}
+
+// Gets the path of the directory without the base path, as it's given in requests
+func (s DirectoryStats) RequestPath() string {
+	return strings.TrimPrefix(s.Path, s.BasePath)
 }
 
 type DirectoryResponseHandler struct {
@@ -146,13 +215,13 @@ func GetDirectoryResponseHandler() (h *DirectoryResponseHandler, err error) {
 
 // Write a not found message to the response.
 func (h *DirectoryResponseHandler) Handle(writer http.ResponseWriter, stats *DirectoryStats, format string) {
-	if hasUpdate != "" {
+	if update := getUpdateStatus(); update.Available {
 		stats.HasUpdate = true
-		stats.UpdateUrl = hasUpdate
+		stats.UpdateUrl = update.Url
 	}
 
 	err := h.responseHandler.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, stats)
 	if err != nil {
-		log.Println("Something went wrong when responding", err.Error())
+		slog.Error("Something went wrong when responding", "error", err)
 	}
 }
@@ -0,0 +1,8 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!windows
+
+package gfs
+
+// Gets the number of bytes available to gfs on the disk the path is on
+func getFreeSpace(p string) (uint64, error) {
+	return 0, ErrFreeSpaceUnknown
+}
@@ -0,0 +1,15 @@
+// +build darwin dragonfly freebsd linux
+
+package gfs
+
+import "syscall"
+
+// Gets the number of bytes available to gfs on the disk the path is on
+func getFreeSpace(p string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(p, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
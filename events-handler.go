@@ -0,0 +1,183 @@
+package gfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	// How often something is sent to idle clients, so proxies don't close the connection
+	eventsKeepAliveInterval time.Duration = 30 * time.Second
+	// How long clients should wait before reconnecting, in milliseconds
+	eventsRetryInterval int = 2000
+)
+
+var (
+	ErrInvalidEventID = errors.New("Invalid last event id. The id has to be a positive number")
+)
+
+// Streams change events to clients using either server sent events or websockets
+type EventsHandler struct {
+	events *EventBus
+}
+
+func GetEventsHandler(events *EventBus) (*EventsHandler, error) {
+	return &EventsHandler{
+		events: events,
+	}, nil
+}
+
+// Gets the id of the last event the client received, if it is resuming
+func getLastEventID(request *http.Request) (uint64, error) {
+	value := request.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = request.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidEventID
+	}
+	return id, nil
+}
+
+// Subscribes to the changes below the path in the request, and streams them
+// to the client until it disconnects. Websocket requests are upgraded, everything
+// else gets server sent events.
+func (h *EventsHandler) Handle(writer http.ResponseWriter, request *http.Request) error {
+	lastID, err := getLastEventID(request)
+	if err != nil {
+		return err
+	}
+	p := path.Join("/", request.URL.Query().Get("path"))
+
+	// Subscribe before responding, so clients don't miss events published right after connecting
+	missed, subscription := h.events.Subscribe(p, lastID)
+	defer subscription.Close()
+
+	if isWebSocketRequest(request) {
+		conn, err := upgradeWebSocket(writer, request)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		h.streamWebSocket(conn, missed, subscription)
+		return nil
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		return errors.New("Streaming is not supported by the connection")
+	}
+
+	h.streamServerSentEvents(writer, flusher, request, missed, subscription)
+	return nil
+}
+
+func (h *EventsHandler) streamServerSentEvents(writer http.ResponseWriter, flusher http.Flusher, request *http.Request, missed []ChangeEvent, subscription *Subscription) {
+	writer.Header().Set("Content-Type", FormatEventStream)
+	writer.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the events
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	_, err := fmt.Fprintf(writer, "retry: %d\n\n", eventsRetryInterval)
+	if err != nil {
+		return
+	}
+
+	write := func(event ChangeEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(writer, "id: %d\ndata: %s\n\n", event.ID, data)
+		return err
+	}
+
+	for _, event := range missed {
+		if write(event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				// The client fell behind, and has to reconnect and resume
+				return
+			}
+			err = write(event)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(writer, ": keep-alive\n\n")
+		case <-request.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *EventsHandler) streamWebSocket(conn *webSocketConn, missed []ChangeEvent, subscription *Subscription) {
+	closed := make(chan struct{})
+	go func() {
+		err := conn.readUntilClosed()
+		if err != nil {
+			slog.Debug("Websocket closed", "error", err)
+		}
+		close(closed)
+	}()
+
+	write := func(event ChangeEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteText(data)
+	}
+
+	for _, event := range missed {
+		if write(event) != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				conn.writeFrame(webSocketClose, nil)
+				return
+			}
+			err = write(event)
+		case <-keepAlive.C:
+			err = conn.writeFrame(webSocketPing, nil)
+		case <-closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
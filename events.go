@@ -0,0 +1,144 @@
+package gfs
+
+import (
+	"sync"
+	"time"
+)
+
+// The kinds of changes events are published for
+const (
+	EventCreated  string = "created"
+	EventModified string = "modified"
+	EventDeleted  string = "deleted"
+	EventRenamed  string = "renamed"
+)
+
+const (
+	// The number of events kept around, so clients can resume after reconnecting
+	maxEventHistory int = 1000
+	// The number of events that can be waiting for a subscriber. Subscribers that
+	// fall further behind are disconnected, and have to resume.
+	subscriptionBufferSize int = 256
+)
+
+// A change to a file or directory in the serve path
+type ChangeEvent struct {
+	// Increases with every event. Used to resume after reconnecting
+	ID uint64 `json:"id" xml:"id"`
+	// One of created, modified, deleted or renamed
+	Type string `json:"type" xml:"type"`
+	// The path of the changed entry. Relative to the serve root
+	Path string `json:"path" xml:"path"`
+	// The previous path of renamed entries
+	OldPath     string `json:"old_path,omitempty" xml:"old_path,omitempty"`
+	IsDirectory bool   `json:"is_directory" xml:"is_directory"`
+	// The user who made the change. Unknown for changes not done through gfs
+	User string    `json:"user,omitempty" xml:"user,omitempty"`
+	Time time.Time `json:"time" xml:"time"`
+}
+
+// Checks if the event affects anything below the given path
+func (e ChangeEvent) isBelow(prefix string) bool {
+	return hasPathPrefix(e.Path, prefix) || (e.OldPath != "" && hasPathPrefix(e.OldPath, prefix))
+}
+
+// Distributes change events to everybody subscribed to them
+type EventBus struct {
+	lock        sync.Mutex
+	nextID      uint64
+	history     []ChangeEvent
+	subscribers map[*Subscription]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		// IDs start at the current time in microseconds, so IDs from before a restart
+		// are always older than the new ones. Clients resuming after a restart then
+		// get every event the server knows about.
+		nextID:      uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		subscribers: make(map[*Subscription]bool),
+	}
+}
+
+// Sends the event to all subscribers. The ID and time of the event are set by the bus.
+func (b *EventBus) Publish(event ChangeEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.nextID++
+	event.ID = b.nextID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > maxEventHistory {
+		b.history = b.history[len(b.history)-maxEventHistory:]
+	}
+
+	for s := range b.subscribers {
+		if !event.isBelow(s.prefix) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			// The subscriber can resume from the last event it got when it reconnects
+			b.unsubscribe(s)
+		}
+	}
+}
+
+// Subscribes to events for everything below the given path. If lastID isn't 0,
+// the events after it that are still known are returned as well, so no events
+// are missed between them and the ones from the subscription.
+func (b *EventBus) Subscribe(prefix string, lastID uint64) ([]ChangeEvent, *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var missed []ChangeEvent
+	if lastID != 0 {
+		for _, event := range b.history {
+			if event.ID > lastID && event.isBelow(prefix) {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	s := &Subscription{
+		bus:    b,
+		prefix: prefix,
+		events: make(chan ChangeEvent, subscriptionBufferSize),
+	}
+	b.subscribers[s] = true
+
+	return missed, s
+}
+
+// Should only be called while holding the lock
+func (b *EventBus) unsubscribe(s *Subscription) {
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+// A subscription to the events below a path
+type Subscription struct {
+	bus    *EventBus
+	prefix string
+	events chan ChangeEvent
+}
+
+// Gets the events of the subscription. The channel is closed if the
+// subscription is closed, or can't keep up with the events.
+func (s *Subscription) Events() <-chan ChangeEvent {
+	return s.events
+}
+
+// Stops the subscription
+func (s *Subscription) Close() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	s.bus.unsubscribe(s)
+}
@@ -0,0 +1,172 @@
+package gfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	a := assert.New(t)
+
+	bus := NewEventBus()
+	bus.Publish(ChangeEvent{Type: EventCreated, Path: "/builds/a.zip"})
+	_, all := bus.Subscribe("/", 0)
+	missed, builds := bus.Subscribe("/builds", 0)
+	a.Empty(missed)
+
+	bus.Publish(ChangeEvent{Type: EventCreated, Path: "/other/b.zip"})
+	bus.Publish(ChangeEvent{Type: EventRenamed, Path: "/other/c.zip", OldPath: "/builds/c.zip"})
+
+	first := <-all.Events()
+	second := <-all.Events()
+	a.Equal("/other/b.zip", first.Path)
+	a.True(second.ID > first.ID)
+	a.False(first.Time.IsZero())
+
+	// Renames out of the path are included too
+	event := <-builds.Events()
+	a.Equal(EventRenamed, event.Type)
+	a.Equal("/builds/c.zip", event.OldPath)
+
+	// Resuming returns the events after the given id
+	missed, resumed := bus.Subscribe("/", first.ID)
+	if a.Len(missed, 1) {
+		a.Equal(second.ID, missed[0].ID)
+	}
+	resumed.Close()
+	_, ok := <-resumed.Events()
+	a.False(ok)
+
+	// Subscribers that can't keep up are disconnected
+	for i := 0; i < subscriptionBufferSize+1; i++ {
+		bus.Publish(ChangeEvent{Type: EventCreated, Path: "/builds/d.zip"})
+	}
+	count := 0
+	for range builds.Events() {
+		count++
+	}
+	a.Equal(subscriptionBufferSize, count)
+}
+
+func TestEventsHandler(t *testing.T) {
+	a := assert.New(t)
+
+	bus := NewEventBus()
+	h, err := GetEventsHandler(bus)
+	if !a.NoError(err) {
+		return
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		a.NoError(h.Handle(writer, request))
+	}))
+	defer server.Close()
+
+	t.Run("Watch", func(t *testing.T) {
+		a := assert.New(t)
+
+		u, _ := url.Parse(server.URL)
+		client := &Client{url: u}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events, err := client.Watch(ctx, "/builds")
+		if !a.NoError(err) {
+			return
+		}
+
+		bus.Publish(ChangeEvent{Type: EventCreated, Path: "/other/a.zip"})
+		bus.Publish(ChangeEvent{Type: EventCreated, Path: "/builds/a.zip"})
+
+		select {
+		case event := <-events:
+			a.Equal("/builds/a.zip", event.Path)
+			a.Equal(EventCreated, event.Type)
+		case <-time.After(5 * time.Second):
+			a.Fail("No event received")
+		}
+
+		cancel()
+		for range events {
+		}
+	})
+
+	t.Run("WebSocket", func(t *testing.T) {
+		a := assert.New(t)
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if !a.NoError(err) {
+			return
+		}
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET /?path=/builds HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+			"Sec-WebSocket-Version: 13\r\n\r\n"))
+		if !a.NoError(err) {
+			return
+		}
+
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		if !a.NoError(err) {
+			return
+		}
+		a.Equal(http.StatusSwitchingProtocols, response.StatusCode)
+		a.Equal("s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", response.Header.Get("Sec-WebSocket-Accept"))
+
+		bus.Publish(ChangeEvent{Type: EventDeleted, Path: "/builds/a.zip"})
+
+		header := make([]byte, 2)
+		_, err = reader.Read(header)
+		if !a.NoError(err) {
+			return
+		}
+		a.Equal(byte(0x80|webSocketText), header[0])
+		payload := make([]byte, header[1])
+		_, err = reader.Read(payload)
+		if !a.NoError(err) {
+			return
+		}
+
+		var event ChangeEvent
+		if a.NoError(json.Unmarshal(payload, &event)) {
+			a.Equal(EventDeleted, event.Type)
+			a.Equal("/builds/a.zip", event.Path)
+		}
+	})
+
+	t.Run("WebSocket from another site", func(t *testing.T) {
+		a := assert.New(t)
+
+		upgrade := func(origin string) {
+			request := httptest.NewRequest("GET", "http://gfs.example.com/events?path=/builds", nil)
+			request.Header.Set("Upgrade", "websocket")
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			request.Header.Set("Sec-WebSocket-Version", "13")
+			request.Header.Set("Origin", origin)
+			a.Equal(ErrWebSocketCrossOrigin, h.Handle(httptest.NewRecorder(), request))
+		}
+
+		upgrade("https://evil.example.com")
+		upgrade("null")
+		upgrade("https://gfs.example.com.evil.example.com")
+
+		request := httptest.NewRequest("GET", "http://gfs.example.com/events", nil)
+		request.Header.Set("Origin", "https://gfs.example.com")
+		a.True(isSameOriginWebSocket(request))
+		request.Header.Del("Origin")
+		a.True(isSameOriginWebSocket(request), "Clients that aren't browsers don't send an origin")
+	})
+}
@@ -0,0 +1,298 @@
+package gfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// The name of the file in the data path that keeps track of uploads that expire
+	expiringFilename string = "expiring.json"
+	// How often expired uploads are deleted
+	expirySweepInterval time.Duration = time.Minute
+)
+
+var (
+	ErrInvalidTTL          = errors.New("Invalid ttl. Use a number of seconds, or a duration like '24h'")
+	ErrInvalidMaxDownloads = errors.New("Invalid maxDownloads. It has to be a positive number")
+	ErrFileExpired         = errors.New("The file has expired")
+)
+
+// How long an uploaded file is kept. A zero value means forever.
+type UploadExpiry struct {
+	// The file is deleted this long after it was uploaded
+	TTL time.Duration
+	// The file is deleted after being downloaded this many times
+	MaxDownloads int
+}
+
+func (e UploadExpiry) isZero() bool {
+	return e.TTL == 0 && e.MaxDownloads == 0
+}
+
+// Parses the ttl parameter of an upload. Either a number of seconds, or a duration like "24h".
+func parseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0, ErrInvalidTTL
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, ErrInvalidTTL
+	}
+	return ttl, nil
+}
+
+// Parses the maxDownloads parameter of an upload
+func parseMaxDownloads(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	maxDownloads, err := strconv.Atoi(value)
+	if err != nil || maxDownloads <= 0 {
+		return 0, ErrInvalidMaxDownloads
+	}
+	return maxDownloads, nil
+}
+
+// An uploaded file that is deleted after a while
+type expiringFile struct {
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	// The number of downloads in progress
+	active int
+}
+
+func (f *expiringFile) isExpired(now time.Time) bool {
+	return (f.ExpiresAt != nil && !now.Before(*f.ExpiresAt)) ||
+		(f.MaxDownloads > 0 && f.Downloads >= f.MaxDownloads)
+}
+
+// Keeps track of uploads with a ttl or a max number of downloads, and deletes them when they expire
+type ExpiryTracker struct {
+	config *Config
+	quotas *QuotaTracker
+	lock   sync.Mutex
+	// The expiring files, keyed by their path relative to the serve root
+	files map[string]*expiringFile
+	// The content index deleted files are removed from, if enabled
+	index *ContentIndex
+}
+
+func NewExpiryTracker(config *Config, quotas *QuotaTracker) (*ExpiryTracker, error) {
+	t := &ExpiryTracker{
+		config: config,
+		quotas: quotas,
+		files:  make(map[string]*expiringFile),
+	}
+
+	file, err := os.Open(path.Join(config.getDataPath(), expiringFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&t.files)
+	if err != nil {
+		// Losing track of the expiring files is better than not starting at all
+		slog.Warn("Unable to read the expiring files, they won't expire", "error", err)
+		t.files = make(map[string]*expiringFile)
+	}
+	return t, nil
+}
+
+// Saves the expiring files. Should only be called while holding the lock.
+func (t *ExpiryTracker) save() error {
+	err := os.MkdirAll(t.config.getDataPath(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(path.Join(t.config.getDataPath(), expiringFilename), func(writer io.Writer) error {
+		return json.NewEncoder(writer).Encode(t.files)
+	})
+}
+
+// Sets when the file just uploaded to the given path expires. Files uploaded
+// without an expiry replace expiring files, so they don't expire anymore.
+func (t *ExpiryTracker) Set(p string, expiry UploadExpiry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if expiry.isZero() {
+		if _, ok := t.files[p]; !ok {
+			return
+		}
+		delete(t.files, p)
+	} else {
+		file := &expiringFile{MaxDownloads: expiry.MaxDownloads}
+		if expiry.TTL > 0 {
+			expiresAt := time.Now().Add(expiry.TTL)
+			file.ExpiresAt = &expiresAt
+		}
+		t.files[p] = file
+	}
+
+	err := t.save()
+	if err != nil {
+		slog.Error("Unable to save expiring files", "error", err)
+	}
+}
+
+// Removes deleted files from the content index as well
+func (t *ExpiryTracker) setIndex(index *ContentIndex) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.index = index
+}
+
+// Checks if the file at the given path expires, whether or not it has already
+func (t *ExpiryTracker) has(p string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.files[p]
+	return ok
+}
+
+// Gets how the file at the given path expires. Returns nil if it doesn't, and
+// ErrFileExpired if it has expired, but not been deleted yet.
+func (t *ExpiryTracker) Get(p string) (*expiringFile, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	file, ok := t.files[p]
+	if !ok {
+		return nil, nil
+	}
+	if file.isExpired(time.Now()) {
+		return nil, ErrFileExpired
+	}
+	result := *file
+	return &result, nil
+}
+
+// Gets the time the file or directory at the given path will be deleted, either
+// because of its ttl or because of a retention rule. Returns nil if it won't be.
+func (t *ExpiryTracker) getExpiryTime(p string, modTime time.Time) *time.Time {
+	expiresAt := t.config.getExpiryTime(p, modTime)
+
+	file, _ := t.Get(p)
+	if file != nil && file.ExpiresAt != nil && (expiresAt == nil || file.ExpiresAt.Before(*expiresAt)) {
+		expiresAt = file.ExpiresAt
+	}
+	return expiresAt
+}
+
+// Reserves a download of the file at the given path. Returns ErrFileExpired if the
+// file can't be downloaded anymore. The download has to be finished with FinishDownload.
+func (t *ExpiryTracker) StartDownload(p string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	file, ok := t.files[p]
+	if !ok {
+		return nil
+	}
+	if file.isExpired(time.Now()) {
+		return ErrFileExpired
+	}
+	if file.MaxDownloads == 0 {
+		return nil
+	}
+
+	file.Downloads++
+	file.active++
+	err := t.save()
+	if err != nil {
+		slog.Error("Unable to save expiring files", "error", err)
+	}
+	return nil
+}
+
+// Finishes a download started with StartDownload. Failed downloads don't count
+// against the limit. The file is deleted if it was the last allowed download.
+func (t *ExpiryTracker) FinishDownload(p string, succeeded bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	file, ok := t.files[p]
+	if !ok || file.MaxDownloads == 0 {
+		return
+	}
+
+	file.active--
+	if !succeeded {
+		file.Downloads--
+		err := t.save()
+		if err != nil {
+			slog.Error("Unable to save expiring files", "error", err)
+		}
+		return
+	}
+
+	if file.Downloads >= file.MaxDownloads && file.active == 0 {
+		slog.Info("Deleting file after its last download", "path", p, "downloads", file.Downloads)
+		t.remove(p)
+	}
+}
+
+// Deletes the file. Should only be called while holding the lock.
+func (t *ExpiryTracker) remove(p string) {
+	err := os.Remove(filepath.Join(t.config.Serve, filepath.FromSlash(p)))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Unable to delete expired file", "path", p, "error", err)
+		return
+	}
+
+	delete(t.files, p)
+	if t.quotas != nil {
+		t.quotas.Forget(p)
+	}
+	if t.index != nil {
+		t.index.Forget(p)
+	}
+	err = t.save()
+	if err != nil {
+		slog.Error("Unable to save expiring files", "error", err)
+	}
+}
+
+// Deletes the files that have expired
+func (t *ExpiryTracker) Sweep() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for p, file := range t.files {
+		// Files still being downloaded are deleted when the downloads finish
+		if !file.isExpired(now) || file.active > 0 {
+			continue
+		}
+		slog.Info("Deleting expired file", "path", p)
+		t.remove(p)
+	}
+}
+
+// Deletes expired files periodically until the program stops
+func (t *ExpiryTracker) run() {
+	for range time.Tick(expirySweepInterval) {
+		t.Sweep()
+	}
+}
@@ -0,0 +1,143 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	a := assert.New(t)
+
+	ttl, err := parseTTL("3600")
+	a.NoError(err)
+	a.Equal(time.Hour, ttl)
+
+	ttl, err = parseTTL("24h")
+	a.NoError(err)
+	a.Equal(24*time.Hour, ttl)
+
+	ttl, err = parseTTL("")
+	a.NoError(err)
+	a.Equal(time.Duration(0), ttl)
+
+	for _, value := range []string{"0", "-5", "-1h", "tomorrow"} {
+		_, err = parseTTL(value)
+		a.Equal(ErrInvalidTTL, err, value)
+	}
+
+	_, err = parseMaxDownloads("0")
+	a.Equal(ErrInvalidMaxDownloads, err)
+}
+
+func TestExpiryTracker(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-expiry")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Serve: filepath.Join(dir, "serve"),
+		Data:  filepath.Join(dir, "data"),
+	}
+	a.NoError(os.MkdirAll(config.Serve, os.ModePerm))
+	for _, name := range []string{"once.txt", "expired.txt", "forever.txt"} {
+		a.NoError(ioutil.WriteFile(filepath.Join(config.Serve, name), []byte(name), 0644))
+	}
+
+	expiry, err := NewExpiryTracker(config, nil)
+	if !a.NoError(err) {
+		return
+	}
+	expiry.Set("/once.txt", UploadExpiry{MaxDownloads: 1})
+	expiry.Set("/expired.txt", UploadExpiry{TTL: time.Nanosecond})
+	expiry.Set("/forever.txt", UploadExpiry{})
+	_, err = expiry.Get("/expired.txt")
+	a.Equal(ErrFileExpired, err)
+
+	t.Run("Downloads are limited", func(t *testing.T) {
+		a := assert.New(t)
+
+		a.NoError(expiry.StartDownload("/once.txt"))
+		a.Equal(ErrFileExpired, expiry.StartDownload("/once.txt"), "Only one download should be allowed at a time")
+		expiry.FinishDownload("/once.txt", false)
+
+		a.NoError(expiry.StartDownload("/once.txt"), "Failed downloads shouldn't count")
+		expiry.Sweep()
+		a.FileExists(filepath.Join(config.Serve, "once.txt"), "Files being downloaded should not be deleted")
+		expiry.FinishDownload("/once.txt", true)
+
+		_, err := os.Stat(filepath.Join(config.Serve, "once.txt"))
+		a.True(os.IsNotExist(err))
+		a.NoError(expiry.StartDownload("/forever.txt"))
+		expiry.FinishDownload("/forever.txt", true)
+	})
+
+	t.Run("Expired files are swept", func(t *testing.T) {
+		a := assert.New(t)
+
+		expiry.Sweep()
+		_, err := os.Stat(filepath.Join(config.Serve, "expired.txt"))
+		a.True(os.IsNotExist(err))
+		a.FileExists(filepath.Join(config.Serve, "forever.txt"))
+	})
+
+	t.Run("Expiry is persisted", func(t *testing.T) {
+		a := assert.New(t)
+
+		expiry.Set("/later.txt", UploadExpiry{TTL: time.Hour, MaxDownloads: 3})
+		reloaded, err := NewExpiryTracker(config, nil)
+		if !a.NoError(err) {
+			return
+		}
+		file, err := reloaded.Get("/later.txt")
+		if a.NoError(err) && a.NotNil(file) {
+			a.Equal(3, file.MaxDownloads)
+			a.NotNil(file.ExpiresAt)
+		}
+	})
+
+	t.Run("Corrupt expiring files", func(t *testing.T) {
+		a := assert.New(t)
+
+		a.NoError(ioutil.WriteFile(filepath.Join(config.Data, expiringFilename), []byte(`{"/later.txt": {"max`), 0644))
+		reloaded, err := NewExpiryTracker(config, nil)
+		if a.NoError(err, "A half written file shouldn't keep gfs from starting") {
+			file, err := reloaded.Get("/later.txt")
+			a.NoError(err)
+			a.Nil(file)
+		}
+	})
+}
+
+func TestUploadHandler_Expiry(t *testing.T) {
+	a := assert.New(t)
+	h, cleanup := getTestUploadHandler(t)
+	defer cleanup()
+
+	request := httptest.NewRequest("POST", "/upload?filename=/handoff.txt&ttl=1h&maxDownloads=2", strings.NewReader("secret"))
+	request.Header.Set("Content-Type", FormatOctetStream)
+	recorder := httptest.NewRecorder()
+	a.NoError(h.Handle(recorder, request, FormatJson, "test"))
+	a.Equal(http.StatusAccepted, recorder.Code)
+	a.Contains(recorder.Body.String(), `"max_downloads":2`)
+	a.Contains(recorder.Body.String(), `"expires_at"`)
+
+	file, err := h.expiry.Get("/handoff.txt")
+	if a.NoError(err) && a.NotNil(file) {
+		a.Equal(2, file.MaxDownloads)
+	}
+
+	request = httptest.NewRequest("POST", "/upload?filename=/handoff.txt&ttl=never", strings.NewReader("secret"))
+	request.Header.Set("Content-Type", FormatOctetStream)
+	a.Equal(ErrInvalidTTL, h.Handle(httptest.NewRecorder(), request, FormatJson, "test"))
+}
@@ -0,0 +1,342 @@
+package gfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// The supported archive formats
+const (
+	ArchiveZip    string = "zip"
+	ArchiveTar    string = "tar"
+	ArchiveTarGz  string = "tar.gz"
+	ArchiveTarZst string = "tar.zst"
+)
+
+const (
+	// The max number of bytes extracted from a single archive, unless configured otherwise
+	defaultMaxExtractedSize int64 = 1 << 30
+	// The max number of files extracted from a single archive, unless configured otherwise
+	defaultMaxExtractedFiles int = 10000
+)
+
+var (
+	ErrZstdNotInstalled = errors.New("zstd has to be installed on the server to extract tar.zst archives")
+)
+
+// An archive that couldn't be extracted because it's broken
+type ArchiveError struct {
+	Message string
+}
+
+func (e *ArchiveError) Error() string {
+	return e.Message
+}
+
+func newArchiveError(err error) *ArchiveError {
+	return &ArchiveError{Message: fmt.Sprintf("Unable to read archive: %s", err)}
+}
+
+func isArchiveError(err error) bool {
+	_, ok := err.(*ArchiveError)
+	return ok
+}
+
+// Gets the format of the archive from its name. Returns an empty string
+// if it isn't a supported archive.
+func getArchiveFormat(filename string) string {
+	name := strings.ToLower(path.Base(filename))
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return ArchiveTarZst
+	}
+	return ""
+}
+
+// Gets the path of an archive entry relative to the directory the archive is
+// extracted to. Entries that would end up outside of the directory are rejected.
+func getEntryPath(name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	clean := path.Clean(name)
+	if path.IsAbs(name) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", newUploadLimitError("Unsafe path in archive: '%s'", name)
+	}
+	return clean, nil
+}
+
+// Extracts an uploaded archive into the directory it was uploaded to
+type archiveExtractor struct {
+	handler *UploadHandler
+	user    string
+	// The directory the archive is extracted to, relative to the serve root
+	dir string
+	// The number of bytes that can still be extracted
+	remaining int64
+	files     int
+	// The entries that have been received, but not moved into place yet
+	pending []pendingFile
+}
+
+// Extracts the archive uploaded as the given filename. The entries are staged in the
+// closest existing directory of their targets, and only moved into place once the whole archive has been read
+// and every entry has passed the quotas, the malware scan and the hooks, so a broken
+// or rejected archive doesn't leave half of it behind.
+func (h *UploadHandler) extractArchive(ctx context.Context, user, filename string, archive io.Reader, expiry UploadExpiry) (files []UploadedFile, err error) {
+	ctx, span := startSpan(ctx, "upload.extract", attribute.String("file.path", path.Join("/", filename)))
+	defer func() {
+		span.SetAttributes(attribute.Int("archive.files", len(files)))
+		endSpan(span, err)
+	}()
+
+	e := &archiveExtractor{
+		handler:   h,
+		user:      user,
+		dir:       path.Dir(path.Join("/", filename)),
+		remaining: h.config.Uploads.getMaxExtractedSize(),
+	}
+	defer func() {
+		for _, file := range e.pending {
+			os.Remove(file.stagingPath)
+		}
+	}()
+
+	switch getArchiveFormat(filename) {
+	case ArchiveZip:
+		err = e.extractZip(archive)
+	case ArchiveTar:
+		err = e.extractTar(archive)
+	case ArchiveTarGz:
+		err = e.extractTarGz(archive)
+	case ArchiveTarZst:
+		err = e.extractTarZst(ctx, archive)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files, err = h.commitFiles(ctx, user, e.pending, expiry)
+	e.pending = nil
+	if err != nil {
+		return files, err
+	}
+
+	slog.Info("Extracted archive", "path", filename, "files", len(files))
+	return files, nil
+}
+
+// Extracts an archive that was received before it was known where it should be
+// extracted to. The staging file is removed afterwards.
+func (h *UploadHandler) extractStagingFile(ctx context.Context, user, filename, stagingPath string, expiry UploadExpiry) ([]UploadedFile, error) {
+	defer os.Remove(stagingPath)
+
+	file, err := os.Open(stagingPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return h.extractArchive(ctx, user, filename, file, expiry)
+}
+
+// Receives a single file from the archive
+func (e *archiveExtractor) add(name string, entry io.Reader, size int64) error {
+	rel, err := getEntryPath(name)
+	if err != nil {
+		return err
+	}
+
+	e.files++
+	if max := e.handler.config.Uploads.getMaxExtractedFiles(); e.files > max {
+		return newUploadLimitError("The archive contains too many files. Max is %d files", max)
+	}
+
+	tooLarge := newUploadSizeError("The archive is too large. Max extracted size is %d bytes", e.handler.config.Uploads.getMaxExtractedSize())
+	if size > e.remaining {
+		return tooLarge
+	}
+
+	filename := path.Join(e.dir, rel)
+	outputPath, err := e.handler.getOutputPath(filename)
+	if err != nil {
+		return err
+	}
+	remaining, err := e.handler.quotas.Remaining(e.user, filename)
+	if err != nil {
+		return err
+	}
+	if remaining >= 0 && size > remaining {
+		return ErrQuotaExceeded
+	}
+
+	// The size in the archive can't be trusted, so the actual size is limited too
+	entry = newLimitedReader(entry, e.remaining, tooLarge)
+	stagingPath, written, err := e.handler.writeStagingFile(path.Dir(outputPath), filename, entry, size, remaining)
+	if err != nil {
+		return err
+	}
+
+	e.remaining -= written
+	file := pendingFile{
+		filename:    filename,
+		stagingPath: stagingPath,
+		size:        written,
+	}
+	// Like when extracting by hand, a later entry with the same path replaces the earlier one
+	for i, pending := range e.pending {
+		if pending.filename == filename {
+			os.Remove(pending.stagingPath)
+			e.pending[i] = file
+			return nil
+		}
+	}
+	e.pending = append(e.pending, file)
+	return nil
+}
+
+func (e *archiveExtractor) extractZip(archive io.Reader) error {
+	file, ok := archive.(*os.File)
+	if !ok {
+		// The list of entries is at the end of zip archives, so they have to be received in full first
+		err := os.MkdirAll(e.handler.config.Serve, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		tmp := path.Join(e.handler.config.Serve, stagingFilePrefix+uuid.NewV4().String())
+		file, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+		defer file.Close()
+
+		_, err = io.Copy(file, archive)
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reader, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return newArchiveError(err)
+	}
+
+	for _, f := range reader.File {
+		// Directories are created when the files in them are, and links are never extracted
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		size := int64(f.UncompressedSize64)
+		if size < 0 {
+			size = -1
+		}
+		entry, err := f.Open()
+		if err != nil {
+			return newArchiveError(err)
+		}
+		err = e.add(f.Name, entry, size)
+		entry.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *archiveExtractor) extractTar(archive io.Reader) error {
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newArchiveError(err)
+		}
+
+		// Directories are created when the files in them are, and links and devices are never extracted
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		err = e.add(header.Name, reader, header.Size)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *archiveExtractor) extractTarGz(archive io.Reader) error {
+	reader, err := gzip.NewReader(archive)
+	if err != nil {
+		return newArchiveError(err)
+	}
+	defer reader.Close()
+
+	return e.extractTar(reader)
+}
+
+// Decompresses the archive with the zstd command, since go has no built in support for it
+func (e *archiveExtractor) extractTarZst(ctx context.Context, archive io.Reader) error {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		return ErrZstdNotInstalled
+	}
+
+	// Stops decompressing if the upload is cancelled
+	cmd := exec.CommandContext(ctx, zstd, "--decompress", "--stdout", "--quiet")
+	cmd.Stdin = archive
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	err = e.extractTar(stdout)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if stderr.Len() > 0 {
+			return newArchiveError(errors.New(strings.TrimSpace(stderr.String())))
+		}
+		return err
+	}
+
+	// Anything after the end of the tar archive has to be read for zstd to finish
+	io.Copy(ioutil.Discard, stdout)
+	err = cmd.Wait()
+	if err != nil {
+		return newArchiveError(fmt.Errorf("%s %s", err, strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package gfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// The files in the test archives, in the order they are added
+var archiveFiles = []struct {
+	name    string
+	content string
+}{
+	{"index.html", "<html></html>"},
+	{"css/site.css", "body {}"},
+}
+
+func createZip(t *testing.T, extra map[string]string) []byte {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, file := range archiveFiles {
+		w, _ := writer.Create(file.name)
+		w.Write([]byte(file.content))
+	}
+	for name, content := range extra {
+		w, _ := writer.Create(name)
+		w.Write([]byte(content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func createTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	writer.WriteHeader(&tar.Header{Name: "css/", Typeflag: tar.TypeDir, Mode: 0755})
+	writer.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	for _, file := range archiveFiles {
+		writer.WriteHeader(&tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.content))})
+		writer.Write([]byte(file.content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	tarball := createTar(t)
+	var gz bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	gzWriter.Write(tarball)
+	gzWriter.Close()
+
+	archives := map[string][]byte{
+		"site.zip":    createZip(t, nil),
+		"site.tar":    tarball,
+		"site.tar.gz": gz.Bytes(),
+	}
+	if zstd, err := exec.LookPath("zstd"); err == nil {
+		cmd := exec.Command(zstd, "--stdout", "--quiet")
+		cmd.Stdin = bytes.NewReader(tarball)
+		compressed, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives["site.tar.zst"] = compressed
+	}
+
+	for name, archive := range archives {
+		t.Run(name, func(t *testing.T) {
+			a := assert.New(t)
+			h, cleanup := getTestUploadHandler(t)
+			defer cleanup()
+
+			request := httptest.NewRequest("POST", "/upload?extract=true&filename=/docs/"+name, bytes.NewReader(archive))
+			request.Header.Set("Content-Type", FormatOctetStream)
+			recorder := httptest.NewRecorder()
+			if !a.NoError(h.Handle(recorder, request, FormatJson, "test")) {
+				return
+			}
+
+			var response UploadResponse
+			if a.NoError(json.NewDecoder(recorder.Body).Decode(&response)) && a.Len(response.Files, 2) {
+				a.Equal("/docs", response.Path)
+				a.Equal("/docs/index.html", response.Files[0].Path)
+				a.Equal("/docs/css/site.css", response.Files[1].Path)
+			}
+
+			for _, file := range archiveFiles {
+				content, err := ioutil.ReadFile(filepath.Join(h.config.Serve, "docs", filepath.FromSlash(file.name)))
+				if a.NoError(err) {
+					a.Equal(file.content, string(content))
+				}
+			}
+			_, err := os.Lstat(filepath.Join(h.config.Serve, "docs", "link"))
+			a.True(os.IsNotExist(err), "Links should not be extracted")
+			_, err = os.Stat(filepath.Join(h.config.Serve, "docs", name))
+			a.True(os.IsNotExist(err), "The archive itself should not be kept")
+		})
+	}
+}
+
+func TestExtractArchive_Multipart(t *testing.T) {
+	a := assert.New(t)
+	h, cleanup := getTestUploadHandler(t)
+	defer cleanup()
+
+	// The path is sent after the archive, so the archive has to be staged first
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("extract", "on")
+	part, _ := writer.CreateFormFile("uploadfiles", "site.zip")
+	part.Write(createZip(t, nil))
+	part, _ = writer.CreateFormFile("uploadfiles", "notes.txt")
+	part.Write([]byte("not an archive"))
+	writer.WriteField("path", "/docs")
+	writer.Close()
+
+	request := httptest.NewRequest("POST", "/upload", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	if !a.NoError(h.Handle(recorder, request, FormatJson, "test")) {
+		return
+	}
+
+	var response UploadResponse
+	if a.NoError(json.NewDecoder(recorder.Body).Decode(&response)) {
+		var paths []string
+		for _, file := range response.Files {
+			paths = append(paths, file.Path)
+		}
+		sort.Strings(paths)
+		a.Equal([]string{"/docs/css/site.css", "/docs/index.html", "/docs/notes.txt"}, paths)
+	}
+
+	entries, err := ioutil.ReadDir(h.config.Serve)
+	if a.NoError(err) {
+		a.Len(entries, 1, "No staging files should be left behind")
+	}
+}
+
+func TestExtractArchive_Limits(t *testing.T) {
+	t.Run("Entries outside the target are rejected", func(t *testing.T) {
+		a := assert.New(t)
+		h, cleanup := getTestUploadHandler(t)
+		defer cleanup()
+
+		_, err := h.extractArchive(context.Background(), "test", "/docs/evil.zip", bytes.NewReader(createZip(t, map[string]string{"../../evil.txt": "evil"})), UploadExpiry{})
+		a.True(isUploadLimitError(err))
+
+		// Nothing is extracted if any of the entries are rejected
+		_, err = os.Stat(filepath.Join(h.config.Serve, "docs", "index.html"))
+		a.True(os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(h.config.Serve, "..", "evil.txt"))
+		a.True(os.IsNotExist(err))
+	})
+
+	t.Run("Extracted size", func(t *testing.T) {
+		a := assert.New(t)
+		h, cleanup := getTestUploadHandler(t)
+		defer cleanup()
+
+		h.config.Uploads.MaxExtractedSize = 1024
+		_, err := h.extractArchive(context.Background(), "test", "/bomb.zip", bytes.NewReader(createZip(t, map[string]string{"zeros": string(make([]byte, 1<<20))})), UploadExpiry{})
+		a.True(isUploadLimitError(err))
+	})
+
+	t.Run("Number of files", func(t *testing.T) {
+		a := assert.New(t)
+		h, cleanup := getTestUploadHandler(t)
+		defer cleanup()
+
+		h.config.Uploads.MaxExtractedFiles = 1
+		_, err := h.extractArchive(context.Background(), "test", "/site.tar", bytes.NewReader(createTar(t)), UploadExpiry{})
+		a.True(isUploadLimitError(err))
+	})
+
+	t.Run("Quota", func(t *testing.T) {
+		a := assert.New(t)
+		h, cleanup := getTestUploadHandler(t)
+		defer cleanup()
+
+		h.config.Quotas.Global.MaxFiles = 1
+		_, err := h.extractArchive(context.Background(), "test", "/docs/site.zip", bytes.NewReader(createZip(t, nil)), UploadExpiry{})
+		a.Equal(ErrFileQuotaExceeded, err)
+
+		// The archive doesn't fit as a whole, so none of it should be extracted
+		_, err = os.Stat(filepath.Join(h.config.Serve, "docs"))
+		a.True(os.IsNotExist(err), "The directories should not be created either")
+	})
+
+	t.Run("Rejected by a hook", func(t *testing.T) {
+		a := assert.New(t)
+		h, cleanup := getTestUploadHandler(t)
+		defer cleanup()
+
+		hooks, err := NewUploadHooks(HooksConfig{
+			Upload: []UploadHookConfig{{Path: "/docs/css/*.css", Command: []string{"false"}, Reject: true}},
+		})
+		if !a.NoError(err) {
+			return
+		}
+		h.hooks = hooks
+
+		_, err = h.extractArchive(context.Background(), "test", "/docs/site.zip", bytes.NewReader(createZip(t, nil)), UploadExpiry{})
+		a.True(isUploadHookError(err))
+
+		// The entries before the rejected one should not have been moved into place either
+		_, err = os.Stat(filepath.Join(h.config.Serve, "docs"))
+		a.True(os.IsNotExist(err), "No empty directories should be left behind")
+		entries, err := ioutil.ReadDir(h.config.Serve)
+		if a.NoError(err) {
+			a.Empty(entries, "No staging files should be left behind")
+		}
+	})
+
+	t.Run("Broken archives", func(t *testing.T) {
+		a := assert.New(t)
+		h, cleanup := getTestUploadHandler(t)
+		defer cleanup()
+
+		_, err := h.extractArchive(context.Background(), "test", "/site.tar.gz", bytes.NewReader([]byte("not gzip")), UploadExpiry{})
+		a.True(isArchiveError(err))
+	})
+}
+
+func TestGetEntryPath(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := getEntryPath("./css/../index.html")
+	a.NoError(err)
+	a.Equal("index.html", p)
+
+	for _, name := range []string{"/etc/passwd", "../index.html", "css/../../index.html", "..\\index.html", "."} {
+		_, err = getEntryPath(name)
+		a.Error(err, name)
+	}
+}
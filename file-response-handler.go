@@ -1,9 +1,10 @@
 package gfs
 
 import (
+	"context"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
@@ -32,6 +33,18 @@ const (
         <th>Last modification:</th>
         <td>{{.LastModificationTime}}</td>
     </tr>
+    {{with .ExpiresAt}}
+    <tr>
+        <th>Expires:</th>
+        <td>{{.}}</td>
+    </tr>
+    {{end}}
+    {{with .DownloadsRemaining}}
+    <tr>
+        <th>Downloads remaining:</th>
+        <td>{{.}}</td>
+    </tr>
+    {{end}}
     </tbody>
 </table>
 <hr/>
@@ -42,20 +55,27 @@ const (
 type FileStats struct {
 	// The name of the file
 	Name string `json:"name" xml:"name"`
-	// The path to the file. Relative to the serve root
+	// The path to the file. Relative to the serve root, but starts with the base path gfs is served under, if any
 	Path string `json:"path" xml:"path"`
 	// The size of the file. 0 if a directory
 	Size int64 `json:"size,omitempty" xml:"size,omitempty"`
 	// The last time this file was modified
 	LastModificationTime time.Time `json:"last_modification_time" xml:"last_modification_time"`
+	// The time the file will be deleted, if any
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+	// The number of times the file can be downloaded before it's deleted, if limited
+	DownloadsRemaining int `json:"downloads_remaining,omitempty" xml:"downloads_remaining,omitempty"`
 }
 
 type FileResponseHandler struct {
 	responseHandler
 	htmlTemplate *template.Template
+	throttler    *Throttler
+	expiry       *ExpiryTracker
+	metrics      *Metrics
 }
 
-func GetFileResponseHandler() (h *FileResponseHandler, err error) {
+func GetFileResponseHandler(throttler *Throttler, expiry *ExpiryTracker, metrics *Metrics) (h *FileResponseHandler, err error) {
 	t := template.New("File Response Html Template")
 	t, err = t.Parse(FileResponseHtml)
 	if err != nil {
@@ -63,20 +83,25 @@ func GetFileResponseHandler() (h *FileResponseHandler, err error) {
 	}
 	h = &FileResponseHandler{
 		htmlTemplate: t,
+		throttler:    throttler,
+		expiry:       expiry,
+		metrics:      metrics,
 	}
 
 	return h, nil
 }
 
-// Write a not found message to the response.
-func (h *FileResponseHandler) Handle(writer http.ResponseWriter, fullpath, p string, format string) error {
+// Writes the file, or the stats about the file, to the response.
+// user is the user downloading the file, if any, and basePath is added to the path in
+// the stats. Returns ErrFileExpired without writing anything if the file has expired.
+func (h *FileResponseHandler) Handle(ctx context.Context, writer http.ResponseWriter, fullpath, p, basePath, format, user string) error {
 	if format == "" {
-		file, err := os.Open(fullpath)
+		err := h.expiry.StartDownload(p)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		_, err = io.Copy(writer, file)
+		err = h.download(ctx, writer, fullpath, user)
+		h.expiry.FinishDownload(p, err == nil)
 		return err
 	}
 
@@ -84,14 +109,36 @@ func (h *FileResponseHandler) Handle(writer http.ResponseWriter, fullpath, p str
 	if err != nil {
 		return err
 	}
+	file, err := h.expiry.Get(p)
+	if err != nil {
+		return err
+	}
+	stats.ExpiresAt = h.expiry.getExpiryTime(p, stats.LastModificationTime)
+	if file != nil && file.MaxDownloads > 0 {
+		stats.DownloadsRemaining = file.MaxDownloads - file.Downloads
+	}
+	stats.Path = basePath + p
 
 	err = h.responseHandler.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, stats)
 	if err != nil {
-		log.Println("Something went wrong when responding", err.Error())
+		slog.Error("Something went wrong when responding", "error", err)
 	}
 	return nil
 }
 
+func (h *FileResponseHandler) download(ctx context.Context, writer http.ResponseWriter, fullpath, user string) error {
+	file, err := os.Open(fullpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counted, done := h.metrics.startDownload(writer)
+	defer done()
+	_, err = io.Copy(h.throttler.Writer(ctx, counted, user), file)
+	return err
+}
+
 // Gets the stats about a specific file
 func GetFileStats(fullpath, p string) (*FileStats, error) {
 	stats, err := os.Stat(fullpath)
@@ -7,4 +7,6 @@ const (
 	FormatXml             string = "application/xml"
 	FormatXFormUrlEncoded string = "application/x-www-form-urlencoded"
 	FormatOctetStream     string = "application/octet-stream"
+	FormatNdjson          string = "application/x-ndjson"
+	FormatEventStream     string = "text/event-stream"
 )
@@ -0,0 +1,84 @@
+package gfs
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// The header the user is read from, unless configured otherwise
+const defaultForwardAuthHeader string = "X-Remote-User"
+
+// Settings for trusting the user authenticated by a proxy in front of gfs, like a
+// single sign-on gateway. Token authentication keeps working for API clients.
+type ForwardAuthConfig struct {
+	// Enables trusting the user header from the proxies
+	Enabled bool `json:"enabled"`
+	// The header the proxy puts the name of the authenticated user in. Defaults to X-Remote-User
+	Header string `json:"header"`
+	// The addresses or cidr ranges of the proxies allowed to set the header. Defaults to the trusted proxies
+	Proxies []string `json:"proxies"`
+	// The users that are allowed in. Empty to allow every user the proxy authenticated
+	Users []string `json:"users"`
+}
+
+func (c ForwardAuthConfig) getHeader() string {
+	if c.Header != "" {
+		return c.Header
+	}
+	return defaultForwardAuthHeader
+}
+
+// Reads the user authenticated by a trusted proxy from requests
+type forwardAuth struct {
+	header  string
+	proxies trustedProxies
+	users   map[string]bool
+}
+
+// Creates the forward auth from the config. Returns nil if forward auth is disabled.
+func newForwardAuth(config *Config) (*forwardAuth, error) {
+	if !config.ForwardAuth.Enabled {
+		return nil, nil
+	}
+
+	proxies := config.ForwardAuth.Proxies
+	if len(proxies) == 0 {
+		proxies = config.TrustedProxies
+	}
+	trusted, err := parseTrustedProxies(proxies)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &forwardAuth{
+		header:  config.ForwardAuth.getHeader(),
+		proxies: trusted,
+	}
+	if len(config.ForwardAuth.Users) > 0 {
+		a.users = make(map[string]bool)
+		for _, user := range config.ForwardAuth.Users {
+			a.users[user] = true
+		}
+	}
+	return a, nil
+}
+
+// Gets the user the proxy authenticated. Returns false if the request didn't come
+// through a trusted proxy, or the proxy didn't authenticate anyone.
+func (a *forwardAuth) getUser(request *http.Request) (string, bool) {
+	user := strings.TrimSpace(request.Header.Get(a.header))
+	if user == "" {
+		return "", false
+	}
+	// Anyone could send the header, so it only means something coming from the proxy
+	if !a.proxies.trusts(request) {
+		slog.Debug("Ignoring user header from untrusted address", "header", a.header, "address", getPeerHost(request))
+		return "", false
+	}
+	if a.users != nil && !a.users[user] {
+		slog.Debug("Ignoring user header for user that isn't allowed in", "header", a.header, "user", user)
+		return "", false
+	}
+	return user, true
+}
@@ -0,0 +1,105 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardAuth(t *testing.T) {
+	config := &Config{
+		Username:       "admin",
+		Secret:         "secret",
+		TrustedProxies: []string{"10.0.0.1"},
+		ForwardAuth: ForwardAuthConfig{
+			Enabled: true,
+			Proxies: []string{"10.0.1.0/24"},
+			Users:   []string{"alice", "bob"},
+		},
+	}
+	authorization, err := GetAuthorizationHandler(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var user string
+	var authErr error
+	handler, err := getProxyHandler(config, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		user, authErr = authorization.GetAuthenticatedUser(request)
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	authenticate := func(remoteAddr string, headers map[string]string) {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		user, authErr = "", nil
+		handler(httptest.NewRecorder(), request)
+	}
+
+	t.Run("Trusted proxy", func(t *testing.T) {
+		a := assert.New(t)
+
+		authenticate("10.0.1.5:1234", map[string]string{"X-Remote-User": "alice"})
+		a.NoError(authErr)
+		a.Equal("alice", user)
+	})
+
+	t.Run("Untrusted address", func(t *testing.T) {
+		a := assert.New(t)
+
+		authenticate("10.0.2.5:1234", map[string]string{"X-Remote-User": "alice"})
+		a.Error(authErr)
+
+		// The forwarded address of the client must not be mistaken for the proxy
+		authenticate("10.0.0.1:1234", map[string]string{"X-Remote-User": "alice", "X-Forwarded-For": "10.0.1.5"})
+		a.Error(authErr)
+	})
+
+	t.Run("User not allowed", func(t *testing.T) {
+		authenticate("10.0.1.5:1234", map[string]string{"X-Remote-User": "mallory"})
+		assert.Error(t, authErr)
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		a := assert.New(t)
+
+		token, _, err := newToken([]byte(config.Secret), TokenData{Username: "admin"})
+		if !a.NoError(err) {
+			return
+		}
+		authenticate("10.0.2.5:1234", map[string]string{"gfs-token": token})
+		a.NoError(authErr)
+		a.Equal("admin", user)
+	})
+
+	t.Run("Custom header", func(t *testing.T) {
+		a := assert.New(t)
+
+		config := &Config{ForwardAuth: ForwardAuthConfig{Enabled: true, Header: "X-Forwarded-User", Proxies: []string{"10.0.1.5"}}}
+		authorization, err := GetAuthorizationHandler(config)
+		if !a.NoError(err) {
+			return
+		}
+
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = "10.0.1.5:1234"
+		request.Header.Set("X-Remote-User", "alice")
+		_, err = authorization.GetAuthenticatedUser(request)
+		a.Error(err)
+
+		request.Header.Set("X-Forwarded-User", "carol")
+		user, err := authorization.GetAuthenticatedUser(request)
+		a.NoError(err)
+		a.Equal("carol", user)
+	})
+
+	t.Run("Invalid proxy", func(t *testing.T) {
+		_, err := GetAuthorizationHandler(&Config{ForwardAuth: ForwardAuthConfig{Enabled: true, Proxies: []string{"proxy"}}})
+		assert.Error(t, err)
+	})
+}
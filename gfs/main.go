@@ -4,6 +4,7 @@ import (
 	"flag"
 	"github.com/zlepper/gfs"
 	"log"
+	"log/slog"
 	"os"
 )
 
@@ -13,8 +14,13 @@ func main() {
 	username := flag.String("username", "", "The username of the user. Overrules whatever is in the config file.")
 	password := flag.String("password", "", "The password of the user. Overrules whatever is in the config file.")
 	port := flag.String("port", "", "The port to serve on. Overrules whatever is in the config file.")
+	listen := flag.String("listen", "", "The addresses to listen on, separated by commas, e.g. '127.0.0.1:8080,unix:/run/gfs/gfs.sock'. Overrules whatever is in the config file.")
+	basePath := flag.String("basePath", "", "The path prefix gfs is served under, e.g. '/files'. Overrules whatever is in the config file.")
 	loginRequiredForRead := flag.Bool("loginRequiredForRead", false, "Enable to require login for being able to get directory listings, and downloading files.")
 	serve := flag.String("serve", gfs.DefaultServePath, "The path that should be served by gfs.")
+	data := flag.String("data", gfs.DefaultDataPath, "The path where gfs keeps its own data.")
+	logLevel := flag.String("logLevel", "", "The minimum level of the messages that are logged. One of debug, info, warn or error. Overrules whatever is in the config file.")
+	logFormat := flag.String("logFormat", "", "The format of the log. Either text or json. Overrules whatever is in the config file.")
 
 	flag.Parse()
 
@@ -44,10 +50,30 @@ func main() {
 		configs.Port = *port
 	}
 
+	if *listen != "" {
+		configs.Listen = gfs.ParseListenAddresses(*listen)
+	}
+
+	if *basePath != "" {
+		configs.BasePath = *basePath
+	}
+
 	if *serve != gfs.DefaultServePath {
 		configs.Serve = *serve
 	}
 
+	if *data != gfs.DefaultDataPath {
+		configs.Data = *data
+	}
+
+	if *logLevel != "" {
+		configs.Logging.Level = *logLevel
+	}
+
+	if *logFormat != "" {
+		configs.Logging.Format = *logFormat
+	}
+
 	if *persist {
 		err := gfs.SaveConfigs(*configPath, configs)
 		if err != nil {
@@ -57,7 +83,11 @@ func main() {
 		return
 	}
 
-	log.Println(*configs)
+	err = gfs.SetupLogging(configs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	slog.Info("Starting gfs", "version", gfs.GFSVersion, "config", configs)
 
 	os.MkdirAll(configs.Serve, os.ModePerm)
 
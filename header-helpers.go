@@ -1,7 +1,7 @@
 package gfs
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 )
@@ -26,10 +26,12 @@ func getResponseFormat(request *http.Request) string {
 			fallthrough
 		case FormatXml:
 			return FormatXml
+		case FormatNdjson:
+			return FormatNdjson
 		}
 	}
 
-	log.Println("Could not find known format in accepts. Hoping for the best. Request accept header:", accepts)
+	slog.Debug("Could not find known format in accepts. Hoping for the best", "accept", accepts)
 
 	return ""
 }
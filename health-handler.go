@@ -0,0 +1,177 @@
+package gfs
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+const (
+	// The free space required on the disk of the serve path, unless configured otherwise
+	defaultMinFreeSpace int64 = 100 << 20
+
+	//language=html
+	HealthHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>{{if .Ready}}Ready{{else}}Not ready{{end}}</title>
+</head>
+<body>
+<h1>{{if .Ready}}Ready{{else}}Not ready{{end}}</h1>
+{{if .Checks}}
+<hr />
+<table>
+    <thead>
+        <tr>
+            <th>Check</th>
+            <th>Result</th>
+        </tr>
+    </thead>
+    <tbody>
+		{{range .Checks}}
+		<tr>
+			<td>{{.Name}}</td>
+			<td>{{if .Ok}}Ok{{else}}Failed{{end}}</td>
+		</tr>
+		{{end}}
+    </tbody>
+</table>
+{{end}}
+</body>
+</html>`
+)
+
+var (
+	ErrFreeSpaceUnknown = errors.New("The free space can't be found on this platform")
+)
+
+// Settings for the health and readiness checks
+type HealthConfig struct {
+	// The number of bytes that have to be free on the disk of the serve path for gfs to
+	// be ready. Defaults to 100MB. Set to a negative number to skip the check
+	MinFreeSpace int64 `json:"minFreeSpace"`
+}
+
+func (c HealthConfig) getMinFreeSpace() int64 {
+	if c.MinFreeSpace != 0 {
+		return c.MinFreeSpace
+	}
+	return defaultMinFreeSpace
+}
+
+// The result of a single readiness check. Why a check failed is only logged, as the
+// endpoint doesn't require login and the reason can include paths on the server.
+type HealthCheck struct {
+	Name string `json:"name" xml:"name"`
+	Ok   bool   `json:"ok" xml:"ok"`
+}
+
+// Tells if gfs is able to serve requests
+type HealthResponse struct {
+	Ready bool `json:"ready" xml:"ready"`
+	// The checks done to find out, if any
+	Checks []HealthCheck `json:"checks,omitempty" xml:"checks,omitempty"`
+}
+
+type HealthHandler struct {
+	responseHandler
+	config       *Config
+	htmlTemplate *template.Template
+}
+
+func GetHealthHandler(config *Config) (*HealthHandler, error) {
+	t, err := template.New("Health Html Template").Parse(HealthHtml)
+	if err != nil {
+		return nil, err
+	}
+	return &HealthHandler{
+		config:       config,
+		htmlTemplate: t,
+	}, nil
+}
+
+// Responds that the process is alive. Nothing is checked, as being able to respond is enough.
+func (h *HealthHandler) HandleLiveness(writer http.ResponseWriter, format string) {
+	err := h.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, HealthResponse{Ready: true})
+	if err != nil {
+		slog.Error("Something went wrong when responding", "error", err)
+	}
+}
+
+// Checks that files can be served and uploaded. Responds with 503 Service Unavailable if they can't.
+func (h *HealthHandler) HandleReadiness(writer http.ResponseWriter, format string) {
+	response := h.checkReadiness()
+
+	status := http.StatusOK
+	if !response.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	err := h.WriteResponse(writer, status, h.htmlTemplate, format, response)
+	if err != nil {
+		slog.Error("Something went wrong when responding", "error", err)
+	}
+}
+
+func (h *HealthHandler) checkReadiness() HealthResponse {
+	checks := []HealthCheck{
+		newHealthCheck("serve_path", h.checkServePath()),
+		newHealthCheck("writable", h.checkWritable()),
+	}
+	if h.config.Health.getMinFreeSpace() > 0 {
+		checks = append(checks, newHealthCheck("free_space", h.checkFreeSpace()))
+	}
+
+	response := HealthResponse{Ready: true, Checks: checks}
+	for _, check := range checks {
+		if !check.Ok {
+			response.Ready = false
+		}
+	}
+	return response
+}
+
+func newHealthCheck(name string, err error) HealthCheck {
+	if err != nil {
+		slog.Warn("Readiness check failed", "check", name, "error", err)
+	}
+	return HealthCheck{Name: name, Ok: err == nil}
+}
+
+func (h *HealthHandler) checkServePath() error {
+	directory, err := isDirectory(h.config.Serve)
+	if err != nil {
+		return err
+	}
+	if !directory {
+		return fmt.Errorf("The serve path '%s' is not a directory", h.config.Serve)
+	}
+	return nil
+}
+
+// Writes a staging file to the serve path, so it's ignored by everything watching it
+func (h *HealthHandler) checkWritable() error {
+	file, err := ioutil.TempFile(h.config.Serve, stagingFilePrefix+"readyz-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func (h *HealthHandler) checkFreeSpace() error {
+	free, err := getFreeSpace(h.config.Serve)
+	if err == ErrFreeSpaceUnknown {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if min := h.config.Health.getMinFreeSpace(); free < uint64(min) {
+		return fmt.Errorf("Only %d bytes are free, at least %d bytes are required", free, min)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package gfs
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-health")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Serve: dir, Health: HealthConfig{MinFreeSpace: 1}}
+	f, err := getHealthHandlerFunc(config)
+	if !a.NoError(err) {
+		return
+	}
+	get := func(p string) (*httptest.ResponseRecorder, HealthResponse) {
+		request := httptest.NewRequest("GET", p, nil)
+		request.Header.Set("accept", FormatJson)
+		recorder := httptest.NewRecorder()
+		f(recorder, request)
+
+		var response HealthResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder, response
+	}
+
+	t.Run("Ready", func(t *testing.T) {
+		a := assert.New(t)
+
+		recorder, response := get("/readyz")
+		a.Equal(http.StatusOK, recorder.Code)
+		a.True(response.Ready)
+		a.Len(response.Checks, 3)
+
+		infos, err := ioutil.ReadDir(dir)
+		a.NoError(err)
+		a.Empty(infos, "The writable check should clean up after itself")
+	})
+
+	t.Run("Not ready", func(t *testing.T) {
+		a := assert.New(t)
+
+		config.Health.MinFreeSpace = 1 << 62
+		defer func() { config.Health.MinFreeSpace = 1 }()
+
+		recorder, response := get("/readyz")
+		a.Equal(http.StatusServiceUnavailable, recorder.Code)
+		a.False(response.Ready)
+	})
+
+	t.Run("Missing serve path", func(t *testing.T) {
+		a := assert.New(t)
+
+		config.Serve = filepath.Join(dir, "missing")
+		defer func() { config.Serve = dir }()
+
+		recorder, response := get("/readyz")
+		a.Equal(http.StatusServiceUnavailable, recorder.Code)
+		a.NotContains(recorder.Body.String(), config.Serve, "The reason is only logged")
+		if a.NotEmpty(response.Checks) {
+			a.Equal("serve_path", response.Checks[0].Name)
+			a.False(response.Checks[0].Ok)
+		}
+
+		recorder, _ = get("/healthz")
+		a.Equal(http.StatusOK, recorder.Code, "The process is still alive")
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		a := assert.New(t)
+
+		request := httptest.NewRequest("GET", "/version", nil)
+		request.Header.Set("accept", FormatJson)
+		recorder := httptest.NewRecorder()
+		f(recorder, request)
+
+		var version VersionResponse
+		a.NoError(json.Unmarshal(recorder.Body.Bytes(), &version))
+		a.Equal(GFSVersion, version.Version)
+		a.NotEmpty(version.GoVersion)
+	})
+}
@@ -2,7 +2,7 @@ package gfs
 
 import (
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
@@ -50,6 +50,6 @@ func (h *InternalServerErrorHandler) Handle(writer http.ResponseWriter, err erro
 
 	err = h.responseHandler.WriteResponse(writer, http.StatusInternalServerError, h.htmlTemplate, format, response)
 	if err != nil {
-		log.Println("Something went wrong when responding", err.Error())
+		slog.Error("Something went wrong when responding", "error", err)
 	}
 }
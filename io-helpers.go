@@ -2,11 +2,34 @@ package gfs
 
 import (
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 )
 
+// Writes the file at the given path with the write function. The content is written to
+// a temporary file first, so a crash never leaves a half written file behind.
+func writeFileAtomically(p string, write func(writer io.Writer) error) error {
+	tmp := p + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
 func isDirectory(p string) (bool, error) {
 	stat, err := os.Stat(p)
 	if err != nil {
@@ -16,8 +39,9 @@ func isDirectory(p string) (bool, error) {
 
 }
 
-// Gets the statistics for the given directory.
-func GetDirectoryStats(fullPath, p string) (*DirectoryStats, error) {
+// Gets the statistics for the given directory. The entries are sorted, filtered
+// and paginated according to the options.
+func GetDirectoryStats(fullPath, p string, options ListingOptions) (*DirectoryStats, error) {
 	stats, err := os.Stat(fullPath)
 	if err != nil {
 		return nil, err
@@ -47,9 +71,14 @@ func GetDirectoryStats(fullPath, p string) (*DirectoryStats, error) {
 		return nil, err
 	}
 
-	dirStats.Entries = make([]DirectoryEntry, len(entries))
+	dirStats.Entries = make([]DirectoryEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		// Files still being uploaded are not ready to be seen
+		if isStagingFile(entry.Name()) {
+			continue
+		}
 
-	for index, entry := range entries {
 		dirEntry := DirectoryEntry{
 			Path:                 path.Join(p, entry.Name()),
 			Name:                 entry.Name(),
@@ -61,8 +90,89 @@ func GetDirectoryStats(fullPath, p string) (*DirectoryStats, error) {
 			dirEntry.Size = entry.Size()
 		}
 
-		dirStats.Entries[index] = dirEntry
+		dirStats.Entries = append(dirStats.Entries, dirEntry)
 	}
 
+	dirStats.Entries, dirStats.TotalEntries, dirStats.NextCursor, err = options.apply(dirStats.Entries)
+	if err != nil {
+		return nil, err
+	}
+	dirStats.Options = options
+
 	return dirStats, nil
 }
+
+// A reader that fails with the given error once more than the limit has been read
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+	unlimited bool
+	err       error
+	// True if more than the limit was read
+	exceeded bool
+}
+
+// Creates a new limited reader. A negative limit means unlimited.
+func newLimitedReader(reader io.Reader, limit int64, err error) *limitedReader {
+	return &limitedReader{
+		reader:    reader,
+		remaining: limit,
+		unlimited: limit < 0,
+		err:       err,
+	}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Nothing more is read once the limit has been exceeded
+	if r.exceeded {
+		return 0, r.err
+	}
+
+	n, err := r.reader.Read(p)
+	if r.unlimited {
+		return n, err
+	}
+
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		r.exceeded = true
+		return n, r.err
+	}
+	return n, err
+}
+
+// Combines a reader with a closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Moves the file, copying it if it has to be moved to another file system
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
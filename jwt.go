@@ -12,6 +12,7 @@ import (
 var (
 	ErrNoAuthHeader      error = errors.New("No authorization header")
 	ErrInvalidAuthHeader error = errors.New("Invalid authorization header")
+	ErrTokenNoUser       error = errors.New("Invalid token. It wasn't given to a user")
 )
 
 func getValidationKeyGetter(secret []byte) jwt.Keyfunc {
@@ -46,6 +47,31 @@ func GetTokenData(tokenString string, secret []byte, output interface{}) error {
 	}
 }
 
+// The data stored in the subject of the tokens gfs hands out
+type TokenData struct {
+	// The name of the user the token was given to
+	Username string `json:"username"`
+	// The groups the user is in at the OpenID Connect provider or LDAP directory, if logged in through it
+	Groups []string `json:"groups,omitempty"`
+	// Set to oidc if the user logged in through the OpenID Connect provider
+	Provider string `json:"provider,omitempty"`
+}
+
+// Gets the id of the token, if it's valid
+func GetTokenID(tokenString string, secret []byte) (string, error) {
+	token, err := jwt.Parse(tokenString, getValidationKeyGetter(secret))
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", errors.New("Invalid token")
+	}
+	id, _ := claims["jti"].(string)
+	return id, nil
+}
+
 func GetToken(secret []byte) (string, error) {
 	exp := time.Now().Add(31 * 24 * time.Hour)
 	claim := &jwt.StandardClaims{
@@ -59,3 +85,26 @@ func GetToken(secret []byte) (string, error) {
 
 	return token.SignedString(secret)
 }
+
+// Creates a new signed token for the user. Returns the token and its id.
+func newToken(secret []byte, data TokenData) (token, id string, err error) {
+	return signData(secret, data, 31*24*time.Hour)
+}
+
+// Signs the data as the subject of a token, which expires after the lifetime
+func signData(secret []byte, data interface{}, lifetime time.Duration) (token, id string, err error) {
+	sub, err := json.Marshal(data)
+	if err != nil {
+		return "", "", err
+	}
+
+	claim := &jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(lifetime).Unix(),
+		IssuedAt:  time.Now().Unix(),
+		Id:        uuid.NewV4().String(),
+		Subject:   string(sub),
+	}
+
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claim).SignedString(secret)
+	return token, claim.Id, err
+}
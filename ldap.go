@@ -0,0 +1,335 @@
+package gfs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The filter users are found with, unless configured otherwise
+	defaultLdapUserFilter string = "(uid={username})"
+	// The attribute with the name of a user, unless configured otherwise
+	defaultLdapUsernameAttribute string = "uid"
+	// The filter the groups of a user are found with, unless configured otherwise
+	defaultLdapGroupFilter string = "(member={dn})"
+	// The attribute with the name of a group, unless configured otherwise
+	defaultLdapGroupAttribute string = "cn"
+	// The number of seconds logins are remembered, unless configured otherwise
+	defaultLdapCacheTime int = 60
+	// The number of seconds the directory has to answer in, unless configured otherwise
+	defaultLdapTimeout int = 10
+)
+
+var (
+	ErrLdapNotAllowed = errors.New("You are not in any of the groups allowed to use gfs")
+)
+
+// Settings for logging in with the users of an LDAP directory
+type LdapConfig struct {
+	// Enables logging in with the users of the directory
+	Enabled bool `json:"enabled"`
+	// The url of the directory, either ldap://host:389 or ldaps://host:636
+	Url string `json:"url"`
+	// Upgrades ldap:// connections to tls with StartTLS
+	StartTls bool `json:"startTls"`
+	// A pem file with the certificates the certificate of the directory is trusted from.
+	// Defaults to the certificates of the system
+	CaFile string `json:"caFile"`
+	// Accepts any certificate from the directory. Only meant for testing
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// The dn of the user to look up users and groups as. Empty to look them up anonymously
+	BindDn string `json:"bindDn"`
+	// The password of the bind dn
+	BindPassword string `json:"bindPassword"`
+	// Where to look for users, e.g. ou=people,dc=example,dc=com
+	BaseDn string `json:"baseDn"`
+	// The filter finding a user, where {username} is replaced by the username. Defaults to (uid={username})
+	UserFilter string `json:"userFilter"`
+	// The attribute the name of the user is taken from, as the directory might match the
+	// username typed in case insensitively. Defaults to uid
+	UsernameAttribute string `json:"usernameAttribute"`
+	// Where to look for groups. Defaults to the base dn
+	GroupBaseDn string `json:"groupBaseDn"`
+	// The filter finding the groups of a user, where {dn} is replaced by the dn of the user
+	// and {username} by the username. Defaults to (member={dn})
+	GroupFilter string `json:"groupFilter"`
+	// The attribute with the name of a group. Defaults to cn
+	GroupAttribute string `json:"groupAttribute"`
+	// Only users in one of these groups are allowed in. Empty to allow every user
+	AllowedGroups []string `json:"allowedGroups"`
+	// Users in one of these groups are admins
+	AdminGroups []string `json:"adminGroups"`
+	// The number of seconds a login is remembered, so the directory isn't asked every
+	// time. Defaults to 60. Negative to always ask the directory
+	CacheTime int `json:"cacheTime"`
+	// The max number of seconds the directory can take to answer. Defaults to 10
+	Timeout int `json:"timeout"`
+}
+
+func (c LdapConfig) getUserFilter() string {
+	if c.UserFilter != "" {
+		return c.UserFilter
+	}
+	return defaultLdapUserFilter
+}
+
+func (c LdapConfig) getUsernameAttribute() string {
+	if c.UsernameAttribute != "" {
+		return c.UsernameAttribute
+	}
+	return defaultLdapUsernameAttribute
+}
+
+func (c LdapConfig) getGroupBaseDn() string {
+	if c.GroupBaseDn != "" {
+		return c.GroupBaseDn
+	}
+	return c.BaseDn
+}
+
+func (c LdapConfig) getGroupFilter() string {
+	if c.GroupFilter != "" {
+		return c.GroupFilter
+	}
+	return defaultLdapGroupFilter
+}
+
+func (c LdapConfig) getGroupAttribute() string {
+	if c.GroupAttribute != "" {
+		return c.GroupAttribute
+	}
+	return defaultLdapGroupAttribute
+}
+
+func (c LdapConfig) getCacheTime() time.Duration {
+	if c.CacheTime == 0 {
+		return time.Duration(defaultLdapCacheTime) * time.Second
+	}
+	return time.Duration(c.CacheTime) * time.Second
+}
+
+func (c LdapConfig) getTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return time.Duration(defaultLdapTimeout) * time.Second
+}
+
+// Checks if any of the groups is an admin group
+func (c LdapConfig) isAdmin(groups []string) bool {
+	return containsAny(c.AdminGroups, groups)
+}
+
+// A login that was accepted by the directory
+type cachedLdapLogin struct {
+	data    TokenData
+	expires time.Time
+}
+
+// Logs users in by binding as them in the LDAP directory
+type ldapClient struct {
+	config LdapConfig
+
+	lock sync.Mutex
+	// The recent logins, by the hash of the username and password
+	logins map[[sha256.Size]byte]cachedLdapLogin
+}
+
+var (
+	ldapClientsLock sync.Mutex
+	// Shared by every handler, so a login is remembered no matter where it happened
+	ldapClients = make(map[string]*ldapClient)
+)
+
+func getLdapClient(config LdapConfig) *ldapClient {
+	ldapClientsLock.Lock()
+	defer ldapClientsLock.Unlock()
+
+	// Handlers with different settings must not share the logins
+	key := fmt.Sprintf("%#v", config)
+	client, ok := ldapClients[key]
+	if !ok {
+		client = &ldapClient{
+			config: config,
+			logins: make(map[[sha256.Size]byte]cachedLdapLogin),
+		}
+		ldapClients[key] = client
+	}
+	return client
+}
+
+// Checks the username and password against the directory. Returns ErrInvalidCredentials
+// if they don't match, or the user isn't in the directory.
+func (c *ldapClient) authenticate(username, password string) (TokenData, error) {
+	// Most directories accept a bind without a password as an anonymous bind
+	if username == "" || password == "" {
+		return TokenData{}, ErrInvalidCredentials
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+	c.lock.Lock()
+	cached, ok := c.logins[key]
+	c.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.data, nil
+	}
+
+	data, err := c.login(username, password)
+	if err != nil {
+		return TokenData{}, err
+	}
+
+	if cacheTime := c.config.getCacheTime(); cacheTime > 0 {
+		c.lock.Lock()
+		for k, login := range c.logins {
+			if now.After(login.expires) {
+				delete(c.logins, k)
+			}
+		}
+		c.logins[key] = cachedLdapLogin{data: data, expires: now.Add(cacheTime)}
+		c.lock.Unlock()
+	}
+	return data, nil
+}
+
+func (c *ldapClient) login(username, password string) (TokenData, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return TokenData{}, err
+	}
+	defer conn.Close()
+
+	err = c.bindService(conn)
+	if err != nil {
+		return TokenData{}, err
+	}
+
+	filter := strings.Replace(c.config.getUserFilter(), "{username}", ldap.EscapeFilter(username), -1)
+	attribute := c.config.getUsernameAttribute()
+	result, err := conn.Search(ldap.NewSearchRequest(c.config.BaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false, filter, []string{attribute}, nil))
+	if err != nil {
+		return TokenData{}, fmt.Errorf("Unable to look up the user in the directory: %s", err)
+	}
+	// Logging in as someone else must not be possible, so ambiguous users can't log in
+	if len(result.Entries) != 1 {
+		return TokenData{}, ErrInvalidCredentials
+	}
+	dn := result.Entries[0].DN
+	// The name as the directory has it, so different spellings of it are the same user in gfs
+	username = result.Entries[0].GetAttributeValue(attribute)
+	if username == "" {
+		return TokenData{}, fmt.Errorf("The directory didn't give the '%s' attribute of the user", attribute)
+	}
+
+	err = conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return TokenData{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return TokenData{}, fmt.Errorf("Unable to log in to the directory: %s", err)
+	}
+
+	// The user might not be allowed to look up groups
+	err = c.bindService(conn)
+	if err != nil {
+		return TokenData{}, err
+	}
+	groups, err := c.getGroups(conn, username, dn)
+	if err != nil {
+		return TokenData{}, err
+	}
+
+	if len(c.config.AllowedGroups) > 0 && !containsAny(c.config.AllowedGroups, groups) {
+		return TokenData{}, ErrLdapNotAllowed
+	}
+	return TokenData{Username: username, Groups: groups}, nil
+}
+
+// Gets the names of the groups the user is in
+func (c *ldapClient) getGroups(conn *ldap.Conn, username, dn string) ([]string, error) {
+	filter := strings.NewReplacer("{username}", ldap.EscapeFilter(username), "{dn}", ldap.EscapeFilter(dn)).Replace(c.config.getGroupFilter())
+	attribute := c.config.getGroupAttribute()
+	result, err := conn.Search(ldap.NewSearchRequest(c.config.getGroupBaseDn(), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, []string{attribute}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look up the groups of the user in the directory: %s", err)
+	}
+
+	var groups []string
+	for _, entry := range result.Entries {
+		if name := entry.GetAttributeValue(attribute); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// Binds as the configured user, if any, so users and groups can be looked up
+func (c *ldapClient) bindService(conn *ldap.Conn) error {
+	var err error
+	if c.config.BindDn == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(c.config.BindDn, c.config.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to bind to the directory: %s", err)
+	}
+	return nil
+}
+
+func (c *ldapClient) connect() (*ldap.Conn, error) {
+	tlsConfig, err := c.getTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.config.getTimeout()
+	conn, err := ldap.DialURL(c.config.Url, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the directory: %s", err)
+	}
+	conn.SetTimeout(timeout)
+
+	if c.config.StartTls {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to start tls with the directory: %s", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *ldapClient) getTlsConfig() (*tls.Config, error) {
+	u, err := url.Parse(c.config.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ldap url '%s': %s", c.config.Url, err)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: c.config.InsecureSkipVerify,
+	}
+	if c.config.CaFile != "" {
+		certificates, err := ioutil.ReadFile(c.config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(certificates) {
+			return nil, fmt.Errorf("No certificates found in '%s'", c.config.CaFile)
+		}
+	}
+	return tlsConfig, nil
+}
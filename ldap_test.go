@@ -0,0 +1,369 @@
+package gfs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testLdapServiceDn       string = "cn=gfs,dc=example,dc=com"
+	testLdapServicePassword string = "service-password"
+)
+
+// A minimal LDAP directory, which only supports simple binds, StartTLS and searches
+// with the exact filters it knows about
+type mockLdapServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	// The passwords of the users, by their dn
+	passwords map[string]string
+	// The entries found by the filters
+	entries map[string][]*ldap.Entry
+
+	lock  sync.Mutex
+	binds int
+}
+
+func newMockLdapServer(t *testing.T, tlsConfig *tls.Config, ldaps bool) *mockLdapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldaps {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	alice := "uid=alice,ou=people,dc=example,dc=com"
+	bob := "uid=bob,ou=people,dc=example,dc=com"
+	carol := "uid=carol,ou=people,dc=example,dc=com"
+	admin := "uid=admin,ou=people,dc=example,dc=com"
+	staff := ldap.NewEntry("cn=staff,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"staff"}})
+	admins := ldap.NewEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})
+
+	s := &mockLdapServer{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		passwords: map[string]string{
+			testLdapServiceDn: testLdapServicePassword,
+			alice:             "alice-password",
+			bob:               "bob-password",
+			carol:             "carol-password",
+			admin:             "directory-admin-password",
+		},
+		entries: map[string][]*ldap.Entry{
+			"(uid=alice)": {ldap.NewEntry(alice, map[string][]string{"uid": {"alice"}})},
+			// Like most directories, names are matched case insensitively
+			"(uid=Alice)":            {ldap.NewEntry(alice, map[string][]string{"uid": {"alice"}})},
+			"(uid=bob)":              {ldap.NewEntry(bob, map[string][]string{"uid": {"bob"}})},
+			"(uid=carol)":            {ldap.NewEntry(carol, map[string][]string{"uid": {"carol"}})},
+			"(uid=Admin)":            {ldap.NewEntry(admin, map[string][]string{"uid": {"admin"}})},
+			"(member=" + alice + ")": {staff, admins},
+			"(member=" + admin + ")": {staff},
+			"(member=" + bob + ")":   {staff},
+		},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *mockLdapServer) url(scheme string) string {
+	return scheme + "://" + s.listener.Addr().String()
+}
+
+func (s *mockLdapServer) getBinds() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.binds
+}
+
+func (s *mockLdapServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.lock.Lock()
+			s.binds++
+			s.lock.Unlock()
+
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if expected, ok := s.passwords[dn]; (ok && expected == password) || (dn == "" && password == "") {
+				code = ldap.LDAPResultSuccess
+				bound = dn
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationExtendedRequest:
+			conn.Write(ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			conn = tls.Server(conn, s.tlsConfig)
+		case ldap.ApplicationSearchRequest:
+			// Only the service is allowed to look things up
+			if bound != testLdapServiceDn {
+				conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights).Bytes())
+				continue
+			}
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, entry := range s.entries[filter] {
+				conn.Write(ldapEntry(id, entry).Bytes())
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func ldapEnvelope(id int64, op *ber.Packet) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	envelope.AppendChild(op)
+	return envelope
+}
+
+func ldapResult(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapEnvelope(id, op)
+}
+
+func ldapEntry(id int64, entry *ldap.Entry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, ""))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, attribute := range entry.Attributes {
+		a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range attribute.Values {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		a.AppendChild(values)
+		attributes.AppendChild(a)
+	}
+	op.AppendChild(attributes)
+	return ldapEnvelope(id, op)
+}
+
+// Creates a self signed certificate for 127.0.0.1, and writes it to a pem file in the directory
+func newTestCertificate(t *testing.T, dir string) (*tls.Config, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, caFile
+}
+
+func TestLdapLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gfs-ldap")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	tlsConfig, caFile := newTestCertificate(t, dir)
+
+	server := newMockLdapServer(t, tlsConfig, false)
+	defer server.listener.Close()
+
+	ldapConfig := LdapConfig{
+		Enabled:       true,
+		Url:           server.url("ldap"),
+		BindDn:        testLdapServiceDn,
+		BindPassword:  testLdapServicePassword,
+		BaseDn:        "ou=people,dc=example,dc=com",
+		GroupBaseDn:   "ou=groups,dc=example,dc=com",
+		AllowedGroups: []string{"staff"},
+		AdminGroups:   []string{"admins"},
+	}
+	password, err := CreatePassword("admin-password")
+	if !assert.NoError(t, err) {
+		return
+	}
+	config := &Config{Username: "admin", Password: password, Secret: "secret", Ldap: ldapConfig}
+	authorization, err := GetAuthorizationHandler(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Run("Login", func(t *testing.T) {
+		a := assert.New(t)
+
+		body, _ := json.Marshal(LoginRequest{Username: "alice", Password: "alice-password"})
+		request := httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+		request.Header.Set("content-type", FormatJson)
+		recorder := httptest.NewRecorder()
+		user, _, err := authorization.Login(recorder, request, FormatJson)
+		a.NoError(err)
+		a.Equal("alice", user)
+		a.Equal(http.StatusOK, recorder.Code)
+
+		var response AuthorizationSuccessResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		request = httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("gfs-token", response.Token)
+		user, err = authorization.GetAuthenticatedUser(request)
+		a.NoError(err)
+		a.Equal("alice", user)
+		a.True(authorization.IsAdmin(request), "Members of the admin groups should be admins")
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		a := assert.New(t)
+
+		data, err := authorization.ldap.authenticate("bob", "bob-password")
+		a.NoError(err)
+		a.Equal(TokenData{Username: "bob", Groups: []string{"staff"}}, data)
+		a.False(ldapConfig.isAdmin(data.Groups))
+
+		_, err = authorization.ldap.authenticate("carol", "carol-password")
+		a.Equal(ErrLdapNotAllowed, err)
+	})
+
+	t.Run("Invalid credentials", func(t *testing.T) {
+		a := assert.New(t)
+
+		_, err := authorization.ldap.authenticate("alice", "wrong")
+		a.Equal(ErrInvalidCredentials, err)
+		_, err = authorization.ldap.authenticate("mallory", "password")
+		a.Equal(ErrInvalidCredentials, err)
+		_, err = authorization.ldap.authenticate("*", "password")
+		a.Equal(ErrInvalidCredentials, err, "The username should be escaped in the filter")
+
+		binds := server.getBinds()
+		_, err = authorization.ldap.authenticate("alice", "")
+		a.Equal(ErrInvalidCredentials, err)
+		a.Equal(binds, server.getBinds(), "Empty passwords must never reach the directory")
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		a := assert.New(t)
+
+		_, err := authorization.ldap.authenticate("bob", "bob-password")
+		a.NoError(err)
+		binds := server.getBinds()
+		_, err = authorization.ldap.authenticate("bob", "bob-password")
+		a.NoError(err)
+		a.Equal(binds, server.getBinds(), "The login should have been cached")
+
+		_, err = authorization.ldap.authenticate("bob", "wrong")
+		a.Equal(ErrInvalidCredentials, err, "Only the exact password should be cached")
+	})
+
+	t.Run("Canonical username", func(t *testing.T) {
+		a := assert.New(t)
+
+		body, _ := json.Marshal(LoginRequest{Username: "Alice", Password: "alice-password"})
+		request := httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+		request.Header.Set("content-type", FormatJson)
+		recorder := httptest.NewRecorder()
+		user, _, err := authorization.Login(recorder, request, FormatJson)
+		a.NoError(err)
+		a.Equal("alice", user, "The user should get the name the directory has")
+
+		var response AuthorizationSuccessResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		request = httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("gfs-token", response.Token)
+		user, err = authorization.GetAuthenticatedUser(request)
+		a.NoError(err)
+		a.Equal("alice", user)
+	})
+
+	t.Run("Local user", func(t *testing.T) {
+		a := assert.New(t)
+
+		_, err := authorization.checkCredentials("admin", "alice-password")
+		a.Equal(ErrInvalidCredentials, err, "The configured user shouldn't be looked up in the directory")
+		_, err = authorization.checkCredentials("Admin", "directory-admin-password")
+		a.Equal(ErrInvalidCredentials, err, "Directory users mustn't log in as the configured user")
+	})
+
+	t.Run("StartTLS", func(t *testing.T) {
+		a := assert.New(t)
+
+		config := ldapConfig
+		config.StartTls = true
+		config.CaFile = caFile
+		data, err := getLdapClient(config).authenticate("alice", "alice-password")
+		a.NoError(err)
+		a.Equal("alice", data.Username)
+
+		config.CaFile = ""
+		_, err = getLdapClient(config).authenticate("alice", "alice-password")
+		a.Error(err, "The certificate isn't trusted by the system")
+	})
+
+	t.Run("LDAPS", func(t *testing.T) {
+		a := assert.New(t)
+
+		ldaps := newMockLdapServer(t, tlsConfig, true)
+		defer ldaps.listener.Close()
+
+		config := ldapConfig
+		config.Url = ldaps.url("ldaps")
+		config.CaFile = caFile
+		data, err := getLdapClient(config).authenticate("alice", "alice-password")
+		a.NoError(err)
+		a.Equal("alice", data.Username)
+	})
+}
@@ -0,0 +1,210 @@
+package gfs
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Addresses starting with this are unix domain sockets
+	unixSocketPrefix string = "unix:"
+	// The first file descriptor passed by systemd socket activation
+	listenFdsStart int = 3
+)
+
+// An address gfs listens on
+type ListenConfig struct {
+	// Either host:port, e.g. "127.0.0.1:8080" or "[::1]:8080", just a port to listen on
+	// every interface, or "unix:" followed by the path of a unix domain socket
+	Address string `json:"address"`
+	// The permissions of the unix domain socket in octal, e.g. "0660"
+	Mode string `json:"mode"`
+	// The owner of the unix domain socket, either "user" or "user:group"
+	Owner string `json:"owner"`
+}
+
+func (c ListenConfig) isUnixSocket() bool {
+	return strings.HasPrefix(c.Address, unixSocketPrefix)
+}
+
+// Gets the network and address to pass to net.Listen
+func (c ListenConfig) getNetworkAddress() (network, address string) {
+	if c.isUnixSocket() {
+		return "unix", strings.TrimPrefix(c.Address, unixSocketPrefix)
+	}
+	if !strings.Contains(c.Address, ":") {
+		return "tcp", ":" + c.Address
+	}
+	return "tcp", c.Address
+}
+
+// Parses a comma separated list of addresses
+func ParseListenAddresses(addresses string) []ListenConfig {
+	var listen []ListenConfig
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			listen = append(listen, ListenConfig{Address: address})
+		}
+	}
+	return listen
+}
+
+// Gets the addresses gfs should listen on. Defaults to the port on every interface.
+func (c *Config) getListen() []ListenConfig {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+	return []ListenConfig{{Address: ":" + c.Port}}
+}
+
+// Opens the listeners gfs should serve on. The sockets passed by systemd are used
+// if gfs was socket activated, otherwise the configured addresses are listened on.
+func getListeners(config *Config) ([]net.Listener, error) {
+	listeners, err := getActivatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		slog.Info("Using sockets passed by systemd", "count", len(listeners))
+		return listeners, nil
+	}
+
+	for _, listen := range config.getListen() {
+		listener, err := listen.open()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		slog.Info("Listening", "address", listener.Addr().String())
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func (c ListenConfig) open() (net.Listener, error) {
+	network, address := c.getNetworkAddress()
+	if network != "unix" {
+		if c.Mode != "" || c.Owner != "" {
+			return nil, fmt.Errorf("Invalid listen address '%s'. Only unix domain sockets can have a mode and owner", c.Address)
+		}
+		return net.Listen(network, address)
+	}
+
+	// A socket left behind by a previous run would make listening fail
+	if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.setPermissions(address)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Sets the mode and owner of the unix domain socket
+func (c ListenConfig) setPermissions(socket string) error {
+	if c.Mode != "" {
+		mode, err := strconv.ParseUint(c.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid mode '%s' for '%s'. It has to be in octal, e.g. '0660'", c.Mode, c.Address)
+		}
+		err = os.Chmod(socket, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Owner != "" {
+		uid, gid, err := lookupOwner(c.Owner)
+		if err != nil {
+			return err
+		}
+		return os.Chown(socket, uid, gid)
+	}
+	return nil
+}
+
+// Gets the ids of "user" or "user:group". The group is left unchanged if not given.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+
+	uid, err = strconv.Atoi(parts[0])
+	if err != nil {
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	gid = -1
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, err = strconv.Atoi(g.Gid)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// Gets the sockets passed by systemd socket activation, if any. The environment
+// variables are removed, so they aren't passed on to child processes like hooks.
+func getActivatedListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	count := getActivatedCount(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		// The listener has its own copy of the descriptor
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("Unable to use socket %d passed by systemd: %s", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Gets the number of sockets passed by systemd. They are only meant for this
+// process if the pid matches.
+func getActivatedCount(listenPid, listenFds string, pid int) int {
+	if listenPid != strconv.Itoa(pid) {
+		return 0
+	}
+	count, err := strconv.Atoi(listenFds)
+	if err != nil || count < 0 {
+		return 0
+	}
+	return count
+}
@@ -0,0 +1,129 @@
+// +build !windows
+
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenConfig_GetNetworkAddress(t *testing.T) {
+	a := assert.New(t)
+
+	for address, expected := range map[string][2]string{
+		"8080":                   {"tcp", ":8080"},
+		":8080":                  {"tcp", ":8080"},
+		"127.0.0.1:8080":         {"tcp", "127.0.0.1:8080"},
+		"[::1]:8080":             {"tcp", "[::1]:8080"},
+		"unix:/run/gfs/gfs.sock": {"unix", "/run/gfs/gfs.sock"},
+	} {
+		network, addr := ListenConfig{Address: address}.getNetworkAddress()
+		a.Equal(expected[0], network, address)
+		a.Equal(expected[1], addr, address)
+	}
+
+	a.Equal([]ListenConfig{{Address: "127.0.0.1:80"}, {Address: "unix:/tmp/gfs.sock"}}, ParseListenAddresses("127.0.0.1:80, unix:/tmp/gfs.sock,"))
+	a.Equal([]ListenConfig{{Address: ":8080"}}, (&Config{Port: "8080"}).getListen())
+}
+
+func TestGetListeners(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-listen")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "gfs.sock")
+
+	// Left behind by a previous run
+	stale, err := net.Listen("unix", socket)
+	if !a.NoError(err) {
+		return
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := &Config{Listen: []ListenConfig{
+		{Address: "127.0.0.1:0"},
+		{Address: "unix:" + socket, Mode: "0600"},
+	}}
+	listeners, err := getListeners(config)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	a.Len(listeners, 2)
+
+	info, err := os.Stat(socket)
+	if a.NoError(err) {
+		a.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+
+	for _, listener := range listeners {
+		conn, err := net.DialTimeout(listener.Addr().Network(), listener.Addr().String(), time.Second)
+		if a.NoError(err, listener.Addr().String()) {
+			conn.Close()
+		}
+	}
+
+	_, err = getListeners(&Config{Listen: []ListenConfig{{Address: "127.0.0.1:0", Mode: "0600"}}})
+	a.Error(err, "Only unix sockets should have a mode")
+}
+
+func TestGetActivatedCount(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(2, getActivatedCount("42", "2", 42))
+	a.Equal(0, getActivatedCount("41", "2", 42), "The sockets are meant for another process")
+	a.Equal(0, getActivatedCount("", "", 42))
+	a.Equal(0, getActivatedCount("42", "many", 42))
+}
+
+func TestSystemdNotifier(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-notify")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if !a.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	notifier := NewSystemdNotifier()
+	a.Equal(2*time.Second, notifier.watchdog)
+
+	notifier.Ready()
+	notifier.Stopping()
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{"READY=1", "STOPPING=1"} {
+		n, err := conn.Read(buf)
+		if a.NoError(err) {
+			a.Equal(expected, string(buf[:n]))
+		}
+	}
+
+	a.NoError((&SystemdNotifier{}).Notify("READY=1"), "Nothing should be sent without systemd")
+}
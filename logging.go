@@ -0,0 +1,148 @@
+package gfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// The supported log formats
+const (
+	LogFormatText     string = "text"
+	LogFormatJson     string = "json"
+	LogFormatCombined string = "combined"
+)
+
+const (
+	// Replaces secrets in the logs
+	redacted string = "[REDACTED]"
+)
+
+// Settings for what is logged, and how
+type LoggingConfig struct {
+	// One of debug, info, warn or error. Defaults to info
+	Level string `json:"level"`
+	// Either text or json. Defaults to text
+	Format string `json:"format"`
+	// The file requests are logged to, or "-" to log them to stdout. Requests are not logged if empty
+	AccessLog string `json:"accessLog"`
+	// Either combined (the Apache combined log format) or json. Defaults to combined
+	AccessLogFormat string `json:"accessLogFormat"`
+}
+
+func (c LoggingConfig) getLevel() (slog.Level, error) {
+	switch strings.ToLower(c.Level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("Invalid log level '%s'. Valid levels are: 'debug', 'info', 'warn' and 'error'", c.Level)
+}
+
+// Creates the logger described by the config, writing to the given writer
+func NewLogger(config LoggingConfig, writer io.Writer) (*slog.Logger, error) {
+	level, err := config.getLevel()
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}
+
+	switch config.Format {
+	case "", LogFormatText:
+		return slog.New(slog.NewTextHandler(writer, options)), nil
+	case LogFormatJson:
+		return slog.New(slog.NewJSONHandler(writer, options)), nil
+	}
+	return nil, fmt.Errorf("Invalid log format '%s'. Valid formats are: '%s' and '%s'", config.Format, LogFormatText, LogFormatJson)
+}
+
+// Sets up the default logger according to the config. Everything logged through
+// the log package goes through it as well.
+func SetupLogging(config *Config) error {
+	logger, err := NewLogger(config.Logging, os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Checks if values with the given key are secrets
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") ||
+		strings.Contains(key, "secret") ||
+		strings.Contains(key, "token") ||
+		key == "authorization"
+}
+
+// Keeps secrets out of the logs, even if they are logged by accident
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isSecretKey(a.Key) && a.Value.Kind() == slog.KindString && a.Value.String() != "" {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// A config with the secrets removed. Has no methods, so it's printed as it is.
+type redactedConfig Config
+
+// Gets a copy of the config without any secrets in it
+func (c Config) redacted() redactedConfig {
+	if c.Password != "" {
+		c.Password = redacted
+	}
+	if c.Secret != "" {
+		c.Secret = redacted
+	}
+	if c.Metrics.Token != "" {
+		c.Metrics.Token = redacted
+	}
+	if c.Oidc.ClientSecret != "" {
+		c.Oidc.ClientSecret = redacted
+	}
+	if c.Ldap.BindPassword != "" {
+		c.Ldap.BindPassword = redacted
+	}
+	if len(c.Tracing.Headers) > 0 {
+		headers := make(map[string]string, len(c.Tracing.Headers))
+		for name := range c.Tracing.Headers {
+			headers[name] = redacted
+		}
+		c.Tracing.Headers = headers
+	}
+	webhooks := make([]WebhookConfig, len(c.Webhooks))
+	for i, hook := range c.Webhooks {
+		if hook.Secret != "" {
+			hook.Secret = redacted
+		}
+		webhooks[i] = hook
+	}
+	c.Webhooks = webhooks
+	return redactedConfig(c)
+}
+
+// Logs the config without its secrets
+func (c Config) LogValue() slog.Value {
+	return slog.AnyValue(c.redacted())
+}
+
+// Prints the config without its secrets
+func (c Config) String() string {
+	text, err := json.Marshal(c.redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(text)
+}
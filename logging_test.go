@@ -0,0 +1,110 @@
+package gfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	a := assert.New(t)
+
+	var output bytes.Buffer
+	logger, err := NewLogger(LoggingConfig{Level: "warn", Format: LogFormatJson}, &output)
+	if !a.NoError(err) {
+		return
+	}
+	logger.Info("Not logged")
+	logger.Warn("Logged", "path", "/a.txt", "password", "hunter2")
+
+	var line map[string]interface{}
+	a.NoError(json.Unmarshal(output.Bytes(), &line))
+	a.Equal("Logged", line["msg"])
+	a.Equal("/a.txt", line["path"])
+	a.Equal(redacted, line["password"])
+
+	_, err = NewLogger(LoggingConfig{Level: "loud"}, &output)
+	a.Error(err)
+	_, err = NewLogger(LoggingConfig{Format: "xml"}, &output)
+	a.Error(err)
+}
+
+func TestConfigRedaction(t *testing.T) {
+	a := assert.New(t)
+	config := &Config{
+		Username: "admin",
+		Password: "$2a$10$hash",
+		Secret:   "jwt-secret",
+		Webhooks: []WebhookConfig{{URL: "http://example.com", Secret: "hook-secret"}},
+		Metrics:  MetricsConfig{Token: "scrape-token"},
+		Oidc:     OidcConfig{ClientId: "gfs", ClientSecret: "client-secret"},
+		Ldap:     LdapConfig{BindDn: "cn=gfs", BindPassword: "bind-password"},
+	}
+
+	var output bytes.Buffer
+	logger, err := NewLogger(LoggingConfig{}, &output)
+	if !a.NoError(err) {
+		return
+	}
+	logger.Info("Starting", "config", config)
+
+	for _, printed := range []string{output.String(), fmt.Sprint(*config), fmt.Sprint(config)} {
+		a.Contains(printed, "admin")
+		a.NotContains(printed, "$2a$10$hash")
+		a.NotContains(printed, "jwt-secret")
+		a.NotContains(printed, "hook-secret")
+		a.NotContains(printed, "scrape-token")
+		a.NotContains(printed, "client-secret")
+		a.NotContains(printed, "bind-password")
+	}
+	a.Equal("hook-secret", config.Webhooks[0].Secret, "The config itself should not be changed")
+}
+
+func TestAccessLogger(t *testing.T) {
+	a := assert.New(t)
+
+	config := &Config{Secret: "secret"}
+	authorization, err := GetAuthorizationHandler(config)
+	if !a.NoError(err) {
+		return
+	}
+	var output bytes.Buffer
+	logger := &AccessLogger{format: LogFormatCombined, authorization: authorization, writer: &output}
+
+	token, _, err := newToken([]byte(config.Secret), TokenData{Username: "alice"})
+	if !a.NoError(err) {
+		return
+	}
+	request := httptest.NewRequest("GET", "/docs/a.txt?token=abc&x=1", nil)
+	request.RemoteAddr = "10.0.0.1:51234"
+	request.Header.Set("gfs-token", token)
+	request.Header.Set("User-Agent", "curl/8.0")
+	logger.wrap(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write([]byte("hello"))
+	})(httptest.NewRecorder(), request)
+
+	line := output.String()
+	a.True(strings.HasPrefix(line, "10.0.0.1 - alice ["), line)
+	a.Contains(line, `"GET /docs/a.txt?token=%5BREDACTED%5D&x=1 HTTP/1.1" 201 5 "-" "curl/8.0"`)
+	a.NotContains(line, "abc")
+
+	t.Run("Json", func(t *testing.T) {
+		a := assert.New(t)
+		output.Reset()
+		logger.format = LogFormatJson
+		logger.write(accessLogEntry{Time: time.Now(), Path: "/b.txt", Status: 404, Duration: 1.5})
+
+		var entry accessLogEntry
+		a.NoError(json.Unmarshal(output.Bytes(), &entry))
+		a.Equal("/b.txt", entry.Path)
+		a.Equal(404, entry.Status)
+		a.Equal(1.5, entry.Duration)
+	})
+}
@@ -0,0 +1,297 @@
+package gfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The content type of the Prometheus text exposition format
+	FormatPrometheus string = "text/plain; version=0.0.4"
+)
+
+var (
+	ErrInvalidMetricsToken = errors.New("Invalid metrics token")
+	// The upper bounds of the request latency buckets, in seconds
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// Settings for the Prometheus metrics endpoint
+type MetricsConfig struct {
+	// Enables the /metrics endpoint
+	Enabled bool `json:"enabled"`
+	// Serve the metrics on this address instead of the normal port, e.g. "127.0.0.1:9100"
+	Address string `json:"address"`
+	// If set, scrapes have to send this token in an "Authorization: Bearer <token>" header
+	Token string `json:"token"`
+}
+
+// Checks if the request is allowed to read the metrics
+func (c MetricsConfig) checkToken(request *http.Request) error {
+	if c.Token == "" {
+		return nil
+	}
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+		return ErrInvalidMetricsToken
+	}
+	return nil
+}
+
+// The labels requests are counted by
+type requestLabels struct {
+	handler string
+	status  string
+}
+
+// The count and latency of requests with the same labels
+type requestMetrics struct {
+	count uint64
+	// The total latency in seconds
+	sum float64
+	// The number of requests in each latency bucket. Not cumulative.
+	buckets []uint64
+}
+
+// Keeps track of what is going on in gfs, for Prometheus to scrape
+type Metrics struct {
+	// Only used atomically. Kept first, so they are aligned on 32 bit platforms.
+	uploadedBytes   int64
+	downloadedBytes int64
+	activeUploads   int64
+	activeDownloads int64
+
+	quotas *QuotaTracker
+	lock   sync.Mutex
+	// Only used while holding the lock
+	requests      map[requestLabels]*requestMetrics
+	loginSuccess  uint64
+	loginFailures uint64
+}
+
+func NewMetrics(quotas *QuotaTracker) *Metrics {
+	return &Metrics{
+		quotas:   quotas,
+		requests: make(map[requestLabels]*requestMetrics),
+	}
+}
+
+// Records a finished request
+func (m *Metrics) observeRequest(handler string, status int, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	labels := requestLabels{handler: handler, status: strconv.Itoa(status)}
+	r, ok := m.requests[labels]
+	if !ok {
+		r = &requestMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		m.requests[labels] = r
+	}
+
+	seconds := duration.Seconds()
+	r.count++
+	r.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			r.buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *Metrics) observeLogin(succeeded bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if succeeded {
+		m.loginSuccess++
+	} else {
+		m.loginFailures++
+	}
+}
+
+// Wraps the writer of a download, so the downloaded bytes are counted. The
+// returned function has to be called when the download is done.
+func (m *Metrics) startDownload(writer io.Writer) (io.Writer, func()) {
+	atomic.AddInt64(&m.activeDownloads, 1)
+	return &countingWriter{writer: writer, count: &m.downloadedBytes}, func() {
+		atomic.AddInt64(&m.activeDownloads, -1)
+	}
+}
+
+// Wraps the handler, so requests to it are counted and timed. Requests to
+// the handler can be counted as another handler with setMetricsHandler.
+func (m *Metrics) instrument(handler string, f http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		w := &metricsWriter{ResponseWriter: writer, handler: handler}
+
+		if handler == "upload" && request.Method == "POST" {
+			atomic.AddInt64(&m.activeUploads, 1)
+			defer atomic.AddInt64(&m.activeUploads, -1)
+			request.Body = readCloser{
+				Reader: &countingReader{reader: request.Body, count: &m.uploadedBytes},
+				Closer: request.Body,
+			}
+		}
+
+		f(w, request)
+
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		m.observeRequest(w.handler, w.status, time.Since(start))
+		if handler == "login" && request.Method == "POST" {
+			m.observeLogin(w.status < 400)
+		}
+	}
+}
+
+// Counts the request as a request to another handler, e.g. "file" instead of "directory"
+func setMetricsHandler(writer http.ResponseWriter, handler string) {
+	if w, ok := writer.(*metricsWriter); ok {
+		w.handler = handler
+	}
+}
+
+// Remembers the status of the response
+type metricsWriter struct {
+	http.ResponseWriter
+	handler string
+	status  int
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Search results and event streams have to be flushed
+func (w *metricsWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Websockets take over the connection
+func (w *metricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The connection can't be taken over")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Adds the number of bytes written to the count
+type countingWriter struct {
+	writer io.Writer
+	count  *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
+
+// Adds the number of bytes read to the count
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// Writes all the metrics in the Prometheus text exposition format
+func (m *Metrics) write(writer io.Writer) error {
+	var b bytes.Buffer
+
+	m.lock.Lock()
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].handler != labels[j].handler {
+			return labels[i].handler < labels[j].handler
+		}
+		return labels[i].status < labels[j].status
+	})
+
+	writeMetricHeader(&b, "gfs_http_requests_total", "counter", "The number of handled requests")
+	for _, l := range labels {
+		fmt.Fprintf(&b, "gfs_http_requests_total{handler=%q,status=%q} %d\n", l.handler, l.status, m.requests[l].count)
+	}
+
+	writeMetricHeader(&b, "gfs_http_request_duration_seconds", "histogram", "How long requests took to handle")
+	for _, l := range labels {
+		r := m.requests[l]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += r.buckets[i]
+			fmt.Fprintf(&b, "gfs_http_request_duration_seconds_bucket{handler=%q,status=%q,le=%q} %d\n", l.handler, l.status, formatMetricValue(bound), cumulative)
+		}
+		fmt.Fprintf(&b, "gfs_http_request_duration_seconds_bucket{handler=%q,status=%q,le=\"+Inf\"} %d\n", l.handler, l.status, r.count)
+		fmt.Fprintf(&b, "gfs_http_request_duration_seconds_sum{handler=%q,status=%q} %s\n", l.handler, l.status, formatMetricValue(r.sum))
+		fmt.Fprintf(&b, "gfs_http_request_duration_seconds_count{handler=%q,status=%q} %d\n", l.handler, l.status, r.count)
+	}
+
+	writeMetricHeader(&b, "gfs_logins_total", "counter", "The number of login attempts")
+	fmt.Fprintf(&b, "gfs_logins_total{result=\"success\"} %d\n", m.loginSuccess)
+	fmt.Fprintf(&b, "gfs_logins_total{result=\"failure\"} %d\n", m.loginFailures)
+	m.lock.Unlock()
+
+	writeMetricHeader(&b, "gfs_uploaded_bytes_total", "counter", "The number of bytes received by uploads")
+	fmt.Fprintf(&b, "gfs_uploaded_bytes_total %d\n", atomic.LoadInt64(&m.uploadedBytes))
+	writeMetricHeader(&b, "gfs_downloaded_bytes_total", "counter", "The number of bytes sent by downloads")
+	fmt.Fprintf(&b, "gfs_downloaded_bytes_total %d\n", atomic.LoadInt64(&m.downloadedBytes))
+
+	writeMetricHeader(&b, "gfs_active_transfers", "gauge", "The number of uploads and downloads in progress")
+	fmt.Fprintf(&b, "gfs_active_transfers{direction=\"upload\"} %d\n", atomic.LoadInt64(&m.activeUploads))
+	fmt.Fprintf(&b, "gfs_active_transfers{direction=\"download\"} %d\n", atomic.LoadInt64(&m.activeDownloads))
+
+	if m.quotas != nil {
+		size, files := m.quotas.Total()
+		writeMetricHeader(&b, "gfs_storage_bytes", "gauge", "The number of bytes stored in the serve path")
+		fmt.Fprintf(&b, "gfs_storage_bytes %d\n", size)
+		writeMetricHeader(&b, "gfs_storage_files", "gauge", "The number of files stored in the serve path")
+		fmt.Fprintf(&b, "gfs_storage_files %d\n", files)
+	}
+
+	_, err := b.WriteTo(writer)
+	return err
+}
+
+func writeMetricHeader(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
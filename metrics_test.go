@@ -0,0 +1,122 @@
+package gfs
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	a := assert.New(t)
+	metrics := NewMetrics(nil)
+
+	directory := metrics.instrument("directory", func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/file.txt" {
+			setMetricsHandler(writer, "file")
+			counted, done := metrics.startDownload(writer)
+			defer done()
+			counted.Write([]byte("content"))
+			return
+		}
+		http.NotFound(writer, request)
+	})
+	upload := metrics.instrument("upload", func(writer http.ResponseWriter, request *http.Request) {
+		ioutil.ReadAll(request.Body)
+		writer.WriteHeader(http.StatusAccepted)
+	})
+	login := metrics.instrument("login", func(writer http.ResponseWriter, request *http.Request) {
+		if request.FormValue("password") != "secret" {
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	directory(httptest.NewRecorder(), httptest.NewRequest("GET", "/file.txt", nil))
+	directory(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+	upload(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("uploaded")))
+	login(httptest.NewRecorder(), httptest.NewRequest("POST", "/login?password=secret", nil))
+	login(httptest.NewRecorder(), httptest.NewRequest("POST", "/login?password=wrong", nil))
+
+	var output bytes.Buffer
+	a.NoError(metrics.write(&output))
+	for _, line := range []string{
+		`gfs_http_requests_total{handler="file",status="200"} 1`,
+		`gfs_http_requests_total{handler="directory",status="404"} 1`,
+		`gfs_http_requests_total{handler="upload",status="202"} 1`,
+		`gfs_http_request_duration_seconds_bucket{handler="file",status="200",le="+Inf"} 1`,
+		`gfs_http_request_duration_seconds_count{handler="login",status="400"} 1`,
+		`gfs_logins_total{result="success"} 1`,
+		`gfs_logins_total{result="failure"} 1`,
+		`gfs_uploaded_bytes_total 8`,
+		`gfs_downloaded_bytes_total 7`,
+		`gfs_active_transfers{direction="download"} 0`,
+		`# TYPE gfs_http_request_duration_seconds histogram`,
+	} {
+		a.Contains(output.String(), line+"\n")
+	}
+}
+
+func TestMetricsConfig_CheckToken(t *testing.T) {
+	a := assert.New(t)
+	config := MetricsConfig{Token: "scrape"}
+
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	a.Equal(ErrInvalidMetricsToken, config.checkToken(request))
+
+	request.Header.Set("Authorization", "Bearer scrape")
+	a.NoError(config.checkToken(request))
+
+	a.NoError(MetricsConfig{}.checkToken(httptest.NewRequest("GET", "/metrics", nil)))
+}
+
+func TestMetrics_Streaming(t *testing.T) {
+	a := assert.New(t)
+
+	authorization, err := GetAuthorizationHandler(&Config{Secret: "secret"})
+	if !a.NoError(err) {
+		return
+	}
+	accessLog := &AccessLogger{format: LogFormatCombined, authorization: authorization, writer: ioutil.Discard}
+	metrics := NewMetrics(nil)
+
+	// Wrapped the same way as the routes in the server
+	release := make(chan bool)
+	server := httptest.NewServer(accessLog.wrap(traceRequests("/search", metrics.instrument("search", func(writer http.ResponseWriter, request *http.Request) {
+		_, isHijacker := writer.(http.Hijacker)
+		a.True(isHijacker, "Websockets should be able to take over the connection")
+		flusher, ok := writer.(http.Flusher)
+		if !a.True(ok, "Streamed responses should be able to flush") {
+			return
+		}
+		writer.Write([]byte("first\n"))
+		flusher.Flush()
+		<-release
+		writer.Write([]byte("second\n"))
+	}))))
+	defer server.Close()
+	defer close(release)
+
+	lines := make(chan string, 1)
+	go func() {
+		response, err := http.Get(server.URL)
+		if err != nil {
+			close(lines)
+			return
+		}
+		defer response.Body.Close()
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		a.Equal("first\n", line)
+	case <-time.After(5 * time.Second):
+		a.Fail("The first line should be received before the response is done")
+	}
+}
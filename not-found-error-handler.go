@@ -2,7 +2,7 @@ package gfs
 
 import (
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
@@ -47,6 +47,6 @@ func (h *NotFoundHandler) Handle(writer http.ResponseWriter, p, format string) {
 
 	err := h.responseHandler.WriteResponse(writer, http.StatusNotFound, h.htmlTemplate, format, response)
 	if err != nil {
-		log.Println("Something went wrong when responding", err.Error())
+		slog.Error("Something went wrong when responding", "error", err)
 	}
 }
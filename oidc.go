@@ -0,0 +1,447 @@
+package gfs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The claim the name of the user is read from, unless configured otherwise. The subject is
+	// unique at the provider and can't be changed by the user, unlike e.g. preferred_username
+	defaultOidcUsernameClaim string = "sub"
+	// The claim the groups of the user are read from, unless configured otherwise
+	defaultOidcGroupsClaim string = "groups"
+	// The cookie the state of a login is kept in, while the user logs in at the provider
+	oidcStateCookie string = "oidc"
+	// How long the user has to log in at the provider
+	oidcLoginTimeout = 10 * time.Minute
+	// How long the user of a bearer token is remembered, so the provider isn't asked on every request
+	oidcUserCacheTime = time.Minute
+	// Marks the tokens of users who logged in through the provider
+	oidcProvider string = "oidc"
+)
+
+var (
+	ErrOidcInvalidState = errors.New("The login expired, or was started in another browser. Please try again")
+	ErrOidcNoIdToken    = errors.New("The identity provider didn't return an id token")
+	ErrOidcInvalidNonce = errors.New("The id token wasn't issued for this login")
+	ErrOidcNotAllowed   = errors.New("You are not in any of the groups allowed to use gfs")
+)
+
+// Settings for logging in through an OpenID Connect provider
+type OidcConfig struct {
+	// Enables logging in through the provider
+	Enabled bool `json:"enabled"`
+	// The url of the provider, e.g. https://accounts.example.com. The endpoints are
+	// discovered from <issuer>/.well-known/openid-configuration
+	Issuer string `json:"issuer"`
+	// The id gfs is registered with at the provider
+	ClientId string `json:"clientId"`
+	// The secret gfs is registered with at the provider. Can be empty for public clients
+	ClientSecret string `json:"clientSecret"`
+	// The url the provider sends users back to, which has to end with /oidc/callback. Defaults
+	// to the callback on the host the user logged in on
+	RedirectUrl string `json:"redirectUrl"`
+	// The scopes to ask for. Defaults to openid, profile and email
+	Scopes []string `json:"scopes"`
+	// The claim used as the name of the user. Defaults to sub
+	UsernameClaim string `json:"usernameClaim"`
+	// The claim with the groups of the user. Defaults to groups
+	GroupsClaim string `json:"groupsClaim"`
+	// Only users in one of these groups are allowed in. Empty to allow every user
+	AllowedGroups []string `json:"allowedGroups"`
+	// Users in one of these groups are admins
+	AdminGroups []string `json:"adminGroups"`
+	// Also accepts access tokens as bearer tokens, by asking the user info endpoint of the
+	// provider who they belong to. The provider doesn't tell who the access token was issued
+	// for, so any client of the provider can use its tokens with gfs
+	AcceptAccessTokens bool `json:"acceptAccessTokens"`
+}
+
+func (c OidcConfig) getScopes() []string {
+	if len(c.Scopes) > 0 {
+		return c.Scopes
+	}
+	return []string{oidc.ScopeOpenID, "profile", "email"}
+}
+
+func (c OidcConfig) getUsernameClaim() string {
+	if c.UsernameClaim != "" {
+		return c.UsernameClaim
+	}
+	return defaultOidcUsernameClaim
+}
+
+func (c OidcConfig) getGroupsClaim() string {
+	if c.GroupsClaim != "" {
+		return c.GroupsClaim
+	}
+	return defaultOidcGroupsClaim
+}
+
+// Checks if any of the groups is an admin group
+func (c OidcConfig) isAdmin(groups []string) bool {
+	return containsAny(c.AdminGroups, groups)
+}
+
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		for _, item := range list {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Maps the claims of the user to who the user is in gfs
+func (c OidcConfig) getTokenData(claims map[string]interface{}) (TokenData, error) {
+	username, _ := claims[c.getUsernameClaim()].(string)
+	if username == "" {
+		return TokenData{}, fmt.Errorf("The identity provider didn't give the '%s' claim", c.getUsernameClaim())
+	}
+
+	var groups []string
+	switch value := claims[c.getGroupsClaim()].(type) {
+	case string:
+		groups = []string{value}
+	case []interface{}:
+		for _, group := range value {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	if len(c.AllowedGroups) > 0 && !containsAny(c.AllowedGroups, groups) {
+		return TokenData{}, ErrOidcNotAllowed
+	}
+	return TokenData{Username: username, Groups: groups, Provider: oidcProvider}, nil
+}
+
+// A user looked up from a bearer token
+type cachedOidcUser struct {
+	data    TokenData
+	err     error
+	expires time.Time
+}
+
+// Talks to the OpenID Connect provider
+type oidcClient struct {
+	config OidcConfig
+	client *http.Client
+
+	lock     sync.Mutex
+	provider *oidc.Provider
+	// The users of recently seen bearer tokens, by the hash of the token
+	users map[string]cachedOidcUser
+}
+
+var (
+	oidcClientsLock sync.Mutex
+	// Shared by every handler, so the provider is only discovered once, and each
+	// bearer token is only looked up once
+	oidcClients = make(map[string]*oidcClient)
+)
+
+func getOidcClient(config OidcConfig) *oidcClient {
+	oidcClientsLock.Lock()
+	defer oidcClientsLock.Unlock()
+
+	key := config.Issuer + " " + config.ClientId
+	client, ok := oidcClients[key]
+	if !ok {
+		client = &oidcClient{
+			config: config,
+			client: &http.Client{Transport: &tracingTransport{}, Timeout: 30 * time.Second},
+			users:  make(map[string]cachedOidcUser),
+		}
+		oidcClients[key] = client
+	}
+	return client
+}
+
+// Makes requests to the provider done with the context use the client of gfs
+func (c *oidcClient) context(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, c.client)
+}
+
+// Gets the provider, discovering it the first time. Discovery is retried on the next
+// call if it fails, so gfs can start while the provider is down.
+func (c *oidcClient) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.provider == nil {
+		provider, err := oidc.NewProvider(c.context(ctx), c.config.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to discover the OpenID Connect provider: %s", err)
+		}
+		c.provider = provider
+	}
+	return c.provider, nil
+}
+
+func (c *oidcClient) getOauth2Config(provider *oidc.Provider, redirectUrl string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.config.ClientId,
+		ClientSecret: c.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectUrl,
+		Scopes:       c.config.getScopes(),
+	}
+}
+
+// Gets who the bearer token belongs to. The token is first checked as an id token issued
+// for gfs, and otherwise it's given to the provider as an access token, if enabled.
+func (c *oidcClient) authenticateBearer(ctx context.Context, token string) (TokenData, error) {
+	hash := sha256.Sum256([]byte(token))
+	key := base64.RawURLEncoding.EncodeToString(hash[:])
+	now := time.Now()
+
+	c.lock.Lock()
+	cached, ok := c.users[key]
+	c.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.data, cached.err
+	}
+
+	data, err := c.lookupBearer(ctx, token)
+
+	c.lock.Lock()
+	for k, user := range c.users {
+		if now.After(user.expires) {
+			delete(c.users, k)
+		}
+	}
+	c.users[key] = cachedOidcUser{data: data, err: err, expires: now.Add(oidcUserCacheTime)}
+	c.lock.Unlock()
+	return data, err
+}
+
+func (c *oidcClient) lookupBearer(ctx context.Context, token string) (TokenData, error) {
+	provider, err := c.getProvider(ctx)
+	if err != nil {
+		return TokenData{}, err
+	}
+
+	claims := make(map[string]interface{})
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: c.config.ClientId}).Verify(c.context(ctx), token)
+	if err == nil {
+		err = idToken.Claims(&claims)
+		if err != nil {
+			return TokenData{}, err
+		}
+		return c.config.getTokenData(claims)
+	}
+	if !c.config.AcceptAccessTokens {
+		return TokenData{}, fmt.Errorf("Invalid bearer token: %s", err)
+	}
+
+	// Access tokens are often opaque, or issued for another audience
+	info, err := provider.UserInfo(c.context(ctx), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}))
+	if err != nil {
+		return TokenData{}, fmt.Errorf("Invalid bearer token: %s", err)
+	}
+	err = info.Claims(&claims)
+	if err != nil {
+		return TokenData{}, err
+	}
+	return c.config.getTokenData(claims)
+}
+
+// What has to be remembered while the user logs in at the provider
+type oidcState struct {
+	State       string    `json:"state"`
+	Nonce       string    `json:"nonce"`
+	Verifier    string    `json:"verifier"`
+	RedirectTo  string    `json:"redirectTo"`
+	RedirectUrl string    `json:"redirectUrl"`
+	StartedAt   time.Time `json:"startedAt"`
+}
+
+// Logs users in through the OpenID Connect provider
+type OidcHandler struct {
+	responseHandler
+	config *Config
+	client *oidcClient
+}
+
+func GetOidcHandler(config *Config) *OidcHandler {
+	return &OidcHandler{
+		config: config,
+		client: getOidcClient(config.Oidc),
+	}
+}
+
+// Gets the key the login state is signed with. It's derived from the secret, so the state
+// can never be mistaken for a login token, which is signed with the secret itself.
+func (h *OidcHandler) stateKey() []byte {
+	mac := hmac.New(sha256.New, []byte(h.config.Secret))
+	mac.Write([]byte("gfs oidc state"))
+	return mac.Sum(nil)
+}
+
+// Gets the url the provider should send the user back to
+func (h *OidcHandler) getRedirectUrl(request *http.Request) string {
+	if h.config.Oidc.RedirectUrl != "" {
+		return h.config.Oidc.RedirectUrl
+	}
+	scheme := "http"
+	if isSecureRequest(request) {
+		scheme = "https"
+	}
+	return scheme + "://" + request.Host + getBasePath(request) + "/oidc/callback"
+}
+
+// Only paths on gfs itself can be redirected to after the login
+func getLocalRedirect(request *http.Request, redirectTo string) string {
+	if !strings.HasPrefix(redirectTo, "/") || strings.HasPrefix(redirectTo, "//") || strings.HasPrefix(redirectTo, "/\\") {
+		return getBasePath(request) + "/"
+	}
+	return redirectTo
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Sends the user to the provider to log in
+func (h *OidcHandler) Login(writer http.ResponseWriter, request *http.Request) error {
+	provider, err := h.client.getProvider(request.Context())
+	if err != nil {
+		return err
+	}
+
+	state := oidcState{
+		Verifier:    oauth2.GenerateVerifier(),
+		RedirectTo:  getLocalRedirect(request, request.URL.Query().Get("redirectTo")),
+		RedirectUrl: h.getRedirectUrl(request),
+		StartedAt:   time.Now(),
+	}
+	state.State, err = randomString()
+	if err != nil {
+		return err
+	}
+	state.Nonce, err = randomString()
+	if err != nil {
+		return err
+	}
+
+	// The state is signed, so it can't be tampered with while the user is away
+	cookie, _, err := signData(h.stateKey(), state, oidcLoginTimeout)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    cookie,
+		Path:     getBasePath(request) + "/oidc/",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   isSecureRequest(request),
+		// The provider sends the user back with a top level navigation, which lax allows
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	u := h.client.getOauth2Config(provider, state.RedirectUrl).AuthCodeURL(state.State, oidc.Nonce(state.Nonce), oauth2.S256ChallengeOption(state.Verifier))
+	http.Redirect(writer, request, u, http.StatusFound)
+	return nil
+}
+
+// Finishes the login when the provider sends the user back. The user gets the usual
+// token cookie, and is sent on to where the login was started. Returns the name of
+// the user and the id of the token.
+func (h *OidcHandler) Callback(writer http.ResponseWriter, request *http.Request) (username, tokenID string, err error) {
+	query := request.URL.Query()
+	if e := query.Get("error"); e != "" {
+		if description := query.Get("error_description"); description != "" {
+			e += ": " + description
+		}
+		return "", "", fmt.Errorf("The identity provider refused the login: %s", e)
+	}
+
+	cookie, err := request.Cookie(oidcStateCookie)
+	if err != nil {
+		return "", "", ErrOidcInvalidState
+	}
+	var state oidcState
+	err = GetTokenData(cookie.Value, h.stateKey(), &state)
+	if err != nil || state.State == "" || state.State != query.Get("state") || time.Since(state.StartedAt) > oidcLoginTimeout {
+		return "", "", ErrOidcInvalidState
+	}
+	// The state can only be used once
+	http.SetCookie(writer, &http.Cookie{Name: oidcStateCookie, Path: getBasePath(request) + "/oidc/", MaxAge: -1})
+
+	ctx := h.client.context(request.Context())
+	provider, err := h.client.getProvider(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	oauth2Config := h.client.getOauth2Config(provider, state.RedirectUrl)
+	token, err := oauth2Config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to get the token from the identity provider: %s", err)
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIdToken == "" {
+		return "", "", ErrOidcNoIdToken
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: h.config.Oidc.ClientId}).Verify(ctx, rawIdToken)
+	if err != nil {
+		return "", "", err
+	}
+	if idToken.Nonce != state.Nonce {
+		return "", "", ErrOidcInvalidNonce
+	}
+
+	claims := make(map[string]interface{})
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return "", "", err
+	}
+	// Some providers only give the profile of the user from the user info endpoint
+	if _, ok := claims[h.config.Oidc.getUsernameClaim()]; !ok {
+		info, err := provider.UserInfo(ctx, oauth2Config.TokenSource(ctx, token))
+		if err != nil {
+			return "", "", err
+		}
+		err = info.Claims(&claims)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	data, err := h.config.Oidc.getTokenData(claims)
+	if err != nil {
+		return "", "", err
+	}
+
+	gfsToken, tokenID, err := newToken([]byte(h.config.Secret), data)
+	if err != nil {
+		return data.Username, "", err
+	}
+	setTokenCookie(writer, request, gfsToken)
+	slog.Debug("Logged in through OpenID Connect", "user", data.Username, "groups", data.Groups)
+	http.Redirect(writer, request, state.RedirectTo, http.StatusFound)
+	return data.Username, tokenID, nil
+}
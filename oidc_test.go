@@ -0,0 +1,358 @@
+package gfs
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal OpenID Connect provider, which logs in a fixed user without asking
+type mockOidcProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientId string
+	claims   map[string]interface{}
+
+	lock sync.Mutex
+	// The pending logins, by their code
+	logins map[string]url.Values
+}
+
+func newMockOidcProvider(t *testing.T, clientId string, claims map[string]interface{}) *mockOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOidcProvider{key: key, clientId: clientId, claims: claims, logins: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"userinfo_endpoint":                     p.URL + "/userinfo",
+			"jwks_uri":                              p.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		code := "code-" + query.Get("state")
+		p.lock.Lock()
+		p.logins[code] = query
+		p.lock.Unlock()
+
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		q := redirect.Query()
+		q.Set("code", code)
+		q.Set("state", query.Get("state"))
+		redirect.RawQuery = q.Encode()
+		http.Redirect(writer, request, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(writer http.ResponseWriter, request *http.Request) {
+		p.lock.Lock()
+		login, ok := p.logins[request.FormValue("code")]
+		delete(p.logins, request.FormValue("code"))
+		p.lock.Unlock()
+		if !ok {
+			http.Error(writer, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		// PKCE: the verifier has to match the challenge given when the login started
+		hash := sha256.Sum256([]byte(request.FormValue("code_verifier")))
+		if login.Get("code_challenge_method") != "S256" || base64.RawURLEncoding.EncodeToString(hash[:]) != login.Get("code_challenge") {
+			http.Error(writer, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		writer.Header().Set("content-type", FormatJson)
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(t, login.Get("nonce")),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(writer, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("content-type", FormatJson)
+		json.NewEncoder(writer).Encode(p.claims)
+	})
+
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// Creates a signed id token for the user
+func (p *mockOidcProvider) idToken(t *testing.T, nonce string) string {
+	claims := jwt.MapClaims{
+		"iss": p.URL,
+		"sub": "1234",
+		"aud": p.clientId,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for name, value := range p.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestOidcConfig_GetTokenData(t *testing.T) {
+	a := assert.New(t)
+
+	config := OidcConfig{AllowedGroups: []string{"staff"}}
+	data, err := config.getTokenData(map[string]interface{}{"sub": "1234", "preferred_username": "alice", "groups": []interface{}{"staff", "admins"}})
+	a.NoError(err)
+	a.Equal(TokenData{Username: "1234", Groups: []string{"staff", "admins"}, Provider: oidcProvider}, data)
+
+	_, err = config.getTokenData(map[string]interface{}{"sub": "5678", "groups": "guests"})
+	a.Equal(ErrOidcNotAllowed, err)
+
+	_, err = config.getTokenData(map[string]interface{}{"preferred_username": "bob", "groups": "staff"})
+	a.Error(err, "The subject is required")
+
+	config = OidcConfig{UsernameClaim: "email", GroupsClaim: "roles"}
+	data, err = config.getTokenData(map[string]interface{}{"email": "carol@example.com", "roles": "admins"})
+	a.NoError(err)
+	a.Equal(TokenData{Username: "carol@example.com", Groups: []string{"admins"}, Provider: oidcProvider}, data)
+}
+
+func TestOidcLogin(t *testing.T) {
+	provider := newMockOidcProvider(t, "gfs", map[string]interface{}{
+		"preferred_username": "alice",
+		"groups":             []interface{}{"staff", "admins"},
+	})
+	defer provider.Close()
+
+	config := &Config{
+		Username: "admin",
+		Secret:   "secret",
+		Oidc: OidcConfig{
+			Enabled:       true,
+			Issuer:        provider.URL,
+			ClientId:      "gfs",
+			AllowedGroups: []string{"staff"},
+			AdminGroups:   []string{"admins"},
+		},
+	}
+	authorization, err := GetAuthorizationHandler(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	oidcHandlerFunc, err := getOidcHandlerFunc(config, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc/login", oidcHandlerFunc)
+	mux.HandleFunc("/oidc/callback", oidcHandlerFunc)
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		user, err := authorization.GetAuthenticatedUser(request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if authorization.IsAdmin(request) {
+			user += " (admin)"
+		}
+		writer.Write([]byte(user))
+	})
+	gfs := httptest.NewServer(mux)
+	defer gfs.Close()
+
+	t.Run("Browser", func(t *testing.T) {
+		a := assert.New(t)
+
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		response, err := client.Get(gfs.URL + "/oidc/login?redirectTo=/some/dir")
+		if !a.NoError(err) {
+			return
+		}
+		defer response.Body.Close()
+
+		a.Equal(http.StatusOK, response.StatusCode)
+		a.Equal("/some/dir", response.Request.URL.Path, "The user should end up where the login was started")
+		body, _ := ioutil.ReadAll(response.Body)
+		a.Equal("1234 (admin)", string(body))
+
+		u, _ := url.Parse(gfs.URL)
+		var names []string
+		for _, cookie := range jar.Cookies(u) {
+			names = append(names, cookie.Name)
+		}
+		a.Contains(names, "token")
+	})
+
+	t.Run("State is not a login", func(t *testing.T) {
+		a := assert.New(t)
+
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		response, err := client.Get(gfs.URL + "/oidc/login")
+		if !a.NoError(err) {
+			return
+		}
+		response.Body.Close()
+		var state string
+		for _, cookie := range response.Cookies() {
+			if cookie.Name == oidcStateCookie {
+				state = cookie.Value
+			}
+		}
+		if !a.NotEmpty(state) {
+			return
+		}
+
+		request, _ := http.NewRequest("GET", gfs.URL+"/", nil)
+		request.Header.Set("gfs-token", state)
+		response, err = http.DefaultClient.Do(request)
+		if !a.NoError(err) {
+			return
+		}
+		response.Body.Close()
+		a.Equal(http.StatusUnauthorized, response.StatusCode, "The state cookie of an anonymous login must not authenticate")
+	})
+
+	t.Run("Invalid state", func(t *testing.T) {
+		a := assert.New(t)
+
+		response, err := http.Get(gfs.URL + "/oidc/callback?code=code-forged&state=forged")
+		if !a.NoError(err) {
+			return
+		}
+		response.Body.Close()
+		a.Equal(http.StatusUnauthorized, response.StatusCode)
+	})
+
+	t.Run("Open redirect", func(t *testing.T) {
+		a := assert.New(t)
+
+		request := httptest.NewRequest("GET", "/", nil)
+		a.Equal("/", getLocalRedirect(request, "https://evil.example.com"))
+		a.Equal("/", getLocalRedirect(request, "//evil.example.com"))
+		a.Equal("/dir", getLocalRedirect(request, "/dir"))
+	})
+
+	t.Run("Bearer id token", func(t *testing.T) {
+		a := assert.New(t)
+
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Authorization", "Bearer "+provider.idToken(t, ""))
+		user, err := authorization.GetAuthenticatedUser(request)
+		a.NoError(err)
+		a.Equal("1234", user)
+		a.True(authorization.IsAdmin(request))
+	})
+
+	t.Run("Bearer access token", func(t *testing.T) {
+		a := assert.New(t)
+
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Authorization", "Bearer access-token")
+		_, err := authorization.GetAuthenticatedUser(request)
+		a.Error(err, "Access tokens are only accepted if enabled")
+	})
+
+	t.Run("Not admin by name", func(t *testing.T) {
+		a := assert.New(t)
+
+		// A user of the provider who picked the name of the configured user
+		token, _, err := newToken([]byte(config.Secret), TokenData{Username: "admin", Groups: []string{"staff"}, Provider: oidcProvider})
+		if !a.NoError(err) {
+			return
+		}
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("gfs-token", token)
+		user, err := authorization.GetAuthenticatedUser(request)
+		a.NoError(err)
+		a.Equal("admin", user)
+		a.False(authorization.IsAdmin(request))
+	})
+
+	t.Run("Password login still works", func(t *testing.T) {
+		a := assert.New(t)
+
+		token, _, err := newToken([]byte(config.Secret), TokenData{Username: "admin"})
+		if !a.NoError(err) {
+			return
+		}
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("gfs-token", token)
+		user, err := authorization.GetAuthenticatedUser(request)
+		a.NoError(err)
+		a.Equal("admin", user)
+	})
+}
+
+func TestOidcAccessTokens(t *testing.T) {
+	a := assert.New(t)
+
+	provider := newMockOidcProvider(t, "gfs", map[string]interface{}{"sub": "alice"})
+	defer provider.Close()
+
+	config := &Config{
+		Username: "admin",
+		Secret:   "secret",
+		Oidc: OidcConfig{
+			Enabled:            true,
+			Issuer:             provider.URL,
+			ClientId:           "gfs",
+			AcceptAccessTokens: true,
+		},
+	}
+	authorization, err := GetAuthorizationHandler(config)
+	if !a.NoError(err) {
+		return
+	}
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer access-token")
+	user, err := authorization.GetAuthenticatedUser(request)
+	a.NoError(err)
+	a.Equal("alice", user)
+
+	request.Header.Set("Authorization", "Bearer invalid")
+	_, err = authorization.GetAuthenticatedUser(request)
+	a.Error(err)
+}
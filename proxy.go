@@ -0,0 +1,212 @@
+package gfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The key the request info is stored under in the context of the request
+type requestInfoKey struct{}
+
+// What is known about how the client reached gfs
+type requestInfo struct {
+	// The path prefix of every link to gfs, e.g. "/files". Empty if gfs is served at the root
+	basePath string
+	// Either http or https, as seen by the client
+	scheme string
+	// The address of whoever connected to gfs, which is a proxy if the request was forwarded
+	peer string
+	// The host the client used, if a proxy in front of gfs changed it
+	host string
+}
+
+func getRequestInfo(request *http.Request) requestInfo {
+	if info, ok := request.Context().Value(requestInfoKey{}).(requestInfo); ok {
+		return info
+	}
+	info := requestInfo{scheme: "http"}
+	if request.TLS != nil {
+		info.scheme = "https"
+	}
+	return info
+}
+
+// Gets the path prefix every link to gfs has to start with
+func getBasePath(request *http.Request) string {
+	return getRequestInfo(request).basePath
+}
+
+// Gets the host that connected to gfs. Unlike the remote address of the request, it's
+// never changed by proxies.
+func getPeerHost(request *http.Request) string {
+	if peer := getRequestInfo(request).peer; peer != "" {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			return peer
+		}
+		return host
+	}
+	return getRemoteHost(request)
+}
+
+// Gets the host the client used to reach gfs, even if a proxy in front of gfs used another
+func getRequestHost(request *http.Request) string {
+	if host := getRequestInfo(request).host; host != "" {
+		return host
+	}
+	return request.Host
+}
+
+// Checks if the client reached gfs through https, even if a proxy in front of gfs didn't
+func isSecureRequest(request *http.Request) bool {
+	return getRequestInfo(request).scheme == "https"
+}
+
+// Cleans the base path, so it's either empty or starts with a slash and doesn't end with one
+func cleanBasePath(p string) string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// Trusted proxies can be given as this instead of an address, to trust every
+// connection made through a unix domain socket
+const trustedUnixSockets string = "unix"
+
+// The proxies allowed to tell who the client is, and where gfs is served
+type trustedProxies struct {
+	networks []*net.IPNet
+	// True if connections through unix domain sockets are trusted
+	unix bool
+}
+
+func parseTrustedProxies(proxies []string) (trusted trustedProxies, err error) {
+	for _, proxy := range proxies {
+		if proxy == trustedUnixSockets {
+			trusted.unix = true
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return trusted, fmt.Errorf("Invalid trusted proxy '%s'. It has to be an ip address, a cidr range or '%s'", proxy, trustedUnixSockets)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trusted.networks = append(trusted.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return trusted, fmt.Errorf("Invalid trusted proxy '%s'. It has to be an ip address, a cidr range or '%s'", proxy, trustedUnixSockets)
+		}
+		trusted.networks = append(trusted.networks, network)
+	}
+	return trusted, nil
+}
+
+func (t trustedProxies) contains(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the request was made by a trusted proxy
+func (t trustedProxies) trusts(request *http.Request) bool {
+	if addr, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return t.unix
+	}
+	return t.contains(getPeerHost(request))
+}
+
+// Gets the client from the X-Forwarded-For header. The addresses are added by each
+// proxy in turn, so the client is the last address not added by a trusted proxy.
+func (t trustedProxies) getForwardedFor(request *http.Request) string {
+	var addresses []string
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(header, ",") {
+			addresses = append(addresses, strings.TrimSpace(address))
+		}
+	}
+
+	for i := len(addresses) - 1; i >= 0; i-- {
+		if !t.contains(addresses[i]) || i == 0 {
+			return addresses[i]
+		}
+	}
+	return ""
+}
+
+// Wraps the handler, so gfs can be served under the configured base path, and
+// behind trusted proxies. Requests from trusted proxies get the address of the
+// client from X-Forwarded-For, and the scheme, host and path prefix the client used
+// from X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix.
+func getProxyHandler(config *Config, handler http.Handler) (http.HandlerFunc, error) {
+	trusted, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	basePath := cleanBasePath(config.BasePath)
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		info := getRequestInfo(request)
+		info.peer = request.RemoteAddr
+		remoteAddr := request.RemoteAddr
+		u := *request.URL
+
+		if trusted.trusts(request) {
+			if client := trusted.getForwardedFor(request); client != "" {
+				remoteAddr = client
+			}
+			if proto := strings.ToLower(request.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+				info.scheme = proto
+			}
+			info.basePath = cleanBasePath(request.Header.Get("X-Forwarded-Prefix"))
+			info.host = request.Header.Get("X-Forwarded-Host")
+		}
+
+		if basePath != "" {
+			if u.Path == basePath {
+				target := info.basePath + basePath + "/"
+				if u.RawQuery != "" {
+					target += "?" + u.RawQuery
+				}
+				http.Redirect(writer, request, target, http.StatusMovedPermanently)
+				return
+			}
+			if !strings.HasPrefix(u.Path, basePath+"/") {
+				http.NotFound(writer, request)
+				return
+			}
+			u.Path = strings.TrimPrefix(u.Path, basePath)
+			u.RawPath = ""
+			info.basePath += basePath
+		}
+
+		// The original request is left untouched, like http.StripPrefix does
+		r := request.WithContext(context.WithValue(request.Context(), requestInfoKey{}, info))
+		r.RemoteAddr = remoteAddr
+		r.URL = &u
+		handler.ServeHTTP(writer, r)
+	}
+
+	return f, nil
+}
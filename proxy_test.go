@@ -0,0 +1,177 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCleanBasePath(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("", cleanBasePath(""))
+	a.Equal("", cleanBasePath("/"))
+	a.Equal("/files", cleanBasePath("files"))
+	a.Equal("/files", cleanBasePath("/files/"))
+	a.Equal("/a/b", cleanBasePath("//a/./b/"))
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	a := assert.New(t)
+
+	trusted, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "::1", "unix"})
+	if !a.NoError(err) {
+		return
+	}
+	a.True(trusted.contains("10.0.0.1"))
+	a.False(trusted.contains("10.0.0.2"))
+	a.True(trusted.contains("192.168.42.1"))
+	a.True(trusted.contains("::1"))
+	a.False(trusted.contains("not an ip"))
+	a.True(trusted.unix)
+
+	_, err = parseTrustedProxies([]string{"proxy.example.com"})
+	a.Error(err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	a.Error(err)
+}
+
+func TestTrustedProxies_GetForwardedFor(t *testing.T) {
+	a := assert.New(t)
+
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	request := httptest.NewRequest("GET", "/", nil)
+
+	request.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 10.0.0.2")
+	a.Equal("5.6.7.8", trusted.getForwardedFor(request), "Addresses before the first untrusted one could be forged")
+
+	request.Header.Set("X-Forwarded-For", "10.0.0.3, 10.0.0.2")
+	a.Equal("10.0.0.3", trusted.getForwardedFor(request))
+
+	request.Header.Del("X-Forwarded-For")
+	a.Equal("", trusted.getForwardedFor(request))
+}
+
+func TestGetProxyHandler(t *testing.T) {
+	type seen struct {
+		path, remoteAddr, basePath string
+		secure                     bool
+	}
+	var last seen
+	var lastHost string
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		lastHost = getRequestHost(request)
+		last = seen{
+			path:       request.URL.Path,
+			remoteAddr: request.RemoteAddr,
+			basePath:   getBasePath(request),
+			secure:     isSecureRequest(request),
+		}
+	})
+
+	serve := func(f http.HandlerFunc, request *http.Request) *httptest.ResponseRecorder {
+		last = seen{}
+		recorder := httptest.NewRecorder()
+		f(recorder, request)
+		return recorder
+	}
+
+	t.Run("Base path", func(t *testing.T) {
+		a := assert.New(t)
+
+		f, err := getProxyHandler(&Config{BasePath: "/files/"}, handler)
+		if !a.NoError(err) {
+			return
+		}
+
+		recorder := serve(f, httptest.NewRequest("GET", "/files/some/dir", nil))
+		a.Equal(http.StatusOK, recorder.Code)
+		a.Equal("/some/dir", last.path)
+		a.Equal("/files", last.basePath)
+
+		recorder = serve(f, httptest.NewRequest("GET", "/files?sort=name", nil))
+		a.Equal(http.StatusMovedPermanently, recorder.Code)
+		a.Equal("/files/?sort=name", recorder.Header().Get("Location"))
+
+		recorder = serve(f, httptest.NewRequest("GET", "/filesystem", nil))
+		a.Equal(http.StatusNotFound, recorder.Code)
+		a.Equal(seen{}, last)
+	})
+
+	t.Run("Untrusted proxy", func(t *testing.T) {
+		a := assert.New(t)
+
+		f, err := getProxyHandler(&Config{TrustedProxies: []string{"10.0.0.1"}}, handler)
+		if !a.NoError(err) {
+			return
+		}
+
+		request := httptest.NewRequest("GET", "/dir", nil)
+		request.RemoteAddr = "10.0.0.2:1234"
+		request.Header.Set("X-Forwarded-For", "1.2.3.4")
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set("X-Forwarded-Prefix", "/files")
+		request.Header.Set("X-Forwarded-Host", "evil.example.com")
+		serve(f, request)
+		a.Equal(seen{path: "/dir", remoteAddr: "10.0.0.2:1234"}, last)
+		a.Equal("example.com", lastHost)
+	})
+
+	t.Run("Trusted proxy", func(t *testing.T) {
+		a := assert.New(t)
+
+		f, err := getProxyHandler(&Config{BasePath: "/gfs", TrustedProxies: []string{"10.0.0.1"}}, handler)
+		if !a.NoError(err) {
+			return
+		}
+
+		request := httptest.NewRequest("GET", "/gfs/dir", nil)
+		request.RemoteAddr = "10.0.0.1:1234"
+		request.Header.Set("X-Forwarded-For", "1.2.3.4")
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set("X-Forwarded-Prefix", "/files/")
+		request.Header.Set("X-Forwarded-Host", "files.example.com")
+		serve(f, request)
+		a.Equal(seen{path: "/dir", remoteAddr: "1.2.3.4", basePath: "/files/gfs", secure: true}, last)
+		a.Equal("files.example.com", lastHost)
+		a.Equal("/gfs/dir", request.URL.Path, "The original request should be left untouched")
+	})
+
+	t.Run("Invalid trusted proxy", func(t *testing.T) {
+		_, err := getProxyHandler(&Config{TrustedProxies: []string{"proxy"}}, handler)
+		assert.Error(t, err)
+	})
+}
+
+func TestDirectoryStats_WithBasePath(t *testing.T) {
+	a := assert.New(t)
+
+	stats := &DirectoryStats{Path: "/dir", Entries: []DirectoryEntry{{Name: "file", Path: "/dir/file"}}}
+	prefixed := stats.withBasePath("/files")
+	a.Equal("/files/dir", prefixed.Path)
+	a.Equal("/files/dir/file", prefixed.Entries[0].Path)
+	a.Equal("/dir", prefixed.RequestPath())
+	a.Equal("/dir/file", stats.Entries[0].Path, "The original stats should be left untouched")
+}
+
+func TestClient_GetUrl(t *testing.T) {
+	a := assert.New(t)
+
+	base, err := url.Parse("http://localhost:8080/files/")
+	if !a.NoError(err) {
+		return
+	}
+	client := &Client{url: base}
+
+	u, err := client.getUrl("/login")
+	a.NoError(err)
+	a.Equal("http://localhost:8080/files/login", u)
+
+	u, err = client.getUrl("/some/dir/?sort=name")
+	a.NoError(err)
+	a.Equal("http://localhost:8080/files/some/dir/?sort=name", u)
+
+	a.Equal("/some/dir", client.trimBasePath("/files/some/dir"))
+}
@@ -0,0 +1,482 @@
+package gfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The name of the file in the data path that keeps track of who uploaded what
+	ownersFilename string = "owners.json"
+	// How often the serve path is scanned for changes not done through gfs
+	quotaRescanInterval time.Duration = 10 * time.Minute
+	// Files being uploaded are written to a file with this prefix before being
+	// moved into place
+	stagingFilePrefix string = ".gfs-upload-"
+)
+
+var (
+	ErrQuotaExceeded     = errors.New("Upload exceeds the storage quota.")
+	ErrFileQuotaExceeded = errors.New("Upload exceeds the file count quota.")
+)
+
+// Returns true if the given filename is a file currently being uploaded
+func isStagingFile(name string) bool {
+	return strings.HasPrefix(name, stagingFilePrefix)
+}
+
+// Information about a file stored in gfs
+type fileUsage struct {
+	size  int64
+	owner string
+}
+
+// Keeps track of how much is stored in gfs, and by whom
+type QuotaTracker struct {
+	config *Config
+	lock   sync.Mutex
+	// The stored files, keyed by their path relative to the serve root
+	files map[string]fileUsage
+	// The space set aside for files that are being stored right now
+	reservations map[*QuotaReservation]bool
+}
+
+// Space set aside for files that are about to be stored, so uploads running at the
+// same time can't exceed the quotas together
+type QuotaReservation struct {
+	tracker *QuotaTracker
+	user    string
+	// The sizes of the files that haven't been stored yet, by their path
+	files map[string]int64
+}
+
+// Creates a new quota tracker, and scans the serve path for existing files
+func NewQuotaTracker(config *Config) (*QuotaTracker, error) {
+	t := &QuotaTracker{
+		config:       config,
+		reservations: make(map[*QuotaReservation]bool),
+	}
+
+	err := t.Rescan()
+	return t, err
+}
+
+// Scans the serve path for files. Files that was not uploaded through gfs
+// doesn't count towards any user's quota.
+func (t *QuotaTracker) Rescan() error {
+	owners, err := t.readOwners()
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]fileUsage)
+	err = filepath.Walk(t.config.Serve, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || isStagingFile(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(t.config.Serve, p)
+		if err != nil {
+			return err
+		}
+		rel = path.Join("/", filepath.ToSlash(rel))
+
+		files[rel] = fileUsage{
+			size:  info.Size(),
+			owner: owners[rel],
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	t.files = files
+	t.lock.Unlock()
+	return nil
+}
+
+// Rescans the serve path every once in a while, to pick up on changes
+// done outside of gfs
+func (t *QuotaTracker) rescanPeriodically() {
+	for range time.Tick(quotaRescanInterval) {
+		err := t.Rescan()
+		if err != nil {
+			slog.Error("Error when scanning for storage usage", "error", err)
+		}
+	}
+}
+
+func (t *QuotaTracker) readOwners() (map[string]string, error) {
+	owners := make(map[string]string)
+
+	file, err := os.Open(path.Join(t.config.getDataPath(), ownersFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return owners, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&owners)
+	if err != nil {
+		// Losing track of the owners is better than not starting at all
+		slog.Warn("Unable to read the owners of the files, they don't count towards any user's quota", "error", err)
+		return make(map[string]string), nil
+	}
+	return owners, nil
+}
+
+// Saves who owns which files. Should only be called while holding the lock.
+func (t *QuotaTracker) writeOwners() error {
+	owners := make(map[string]string)
+	for p, usage := range t.files {
+		if usage.owner != "" {
+			owners[p] = usage.owner
+		}
+	}
+
+	err := os.MkdirAll(t.config.getDataPath(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(path.Join(t.config.getDataPath(), ownersFilename), func(writer io.Writer) error {
+		return json.NewEncoder(writer).Encode(owners)
+	})
+}
+
+// Returns true if p is the prefix, or is below the prefix
+func hasPathPrefix(p, prefix string) bool {
+	prefix = path.Join("/", prefix)
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// Calculates how much is used by files matching the filter.
+// Should only be called while holding the lock.
+func (t *QuotaTracker) usage(filter func(p string, usage fileUsage) bool) (bytes, files int64) {
+	for p, usage := range t.files {
+		if filter(p, usage) {
+			bytes += usage.size
+			files++
+		}
+	}
+	return bytes, files
+}
+
+// Calculates how much is used by files matching the filter, including the
+// space reserved for files being stored. Should only be called while holding the lock.
+func (t *QuotaTracker) usageWithReservations(filter func(p string, usage fileUsage) bool) (bytes, files int64) {
+	bytes, files = t.usage(filter)
+	for reservation := range t.reservations {
+		for p, size := range reservation.files {
+			if filter(p, fileUsage{size: size, owner: reservation.user}) {
+				bytes += size
+				files++
+			}
+		}
+	}
+	return bytes, files
+}
+
+// Gets how many bytes the given user can upload to the given path. Any file
+// that will be overwritten by the upload is counted as free space.
+// Returns -1 if there is no limit.
+func (t *QuotaTracker) Remaining(user, p string) (int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	remaining, err := t.check(user, map[string]int64{p: 0})
+	if err != nil {
+		return 0, err
+	}
+	if remaining == 0 {
+		return 0, ErrQuotaExceeded
+	}
+	return remaining, nil
+}
+
+// Gets how many bytes the given user can upload before it's known where to. Only the
+// global quota and the quota of the user are counted, as the path quotas depend on
+// where the files end up. Returns -1 if there is no limit.
+func (t *QuotaTracker) RemainingForUser(user string) (int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	remaining, err := t.checkUser(user, nil)
+	if err != nil {
+		return 0, err
+	}
+	if remaining == 0 {
+		return 0, ErrQuotaExceeded
+	}
+	return remaining, nil
+}
+
+// Sets space aside for the given files, with their sizes by their path, if the
+// user can store all of them. The reservation has to be released once the files
+// have been stored, or have failed to be stored.
+func (t *QuotaTracker) Reserve(user string, files map[string]int64) (*QuotaReservation, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, err := t.check(user, files)
+	if err != nil {
+		return nil, err
+	}
+
+	reservation := &QuotaReservation{
+		tracker: t,
+		user:    user,
+		files:   make(map[string]int64, len(files)),
+	}
+	for p, size := range files {
+		reservation.files[p] = size
+	}
+	t.reservations[reservation] = true
+	return reservation, nil
+}
+
+// Checks if the user can store the given files, with their sizes by their path,
+// and gets how many bytes would be left afterwards, or -1 if there is no limit.
+// Any file that will be overwritten is counted as free space.
+// Should only be called while holding the lock.
+func (t *QuotaTracker) check(user string, files map[string]int64) (int64, error) {
+	remaining, err := t.checkUser(user, files)
+	if err != nil {
+		return 0, err
+	}
+
+	for prefix, quota := range t.config.Quotas.Paths {
+		applies := false
+		for p := range files {
+			applies = applies || hasPathPrefix(p, prefix)
+		}
+		if !applies {
+			continue
+		}
+		prefix := prefix
+		err = t.checkQuota(user, files, quota, func(p string, usage fileUsage) bool {
+			return hasPathPrefix(p, prefix)
+		}, &remaining)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return remaining, nil
+}
+
+// Like check, but only checks the global quota and the quota of the user, which
+// apply no matter where the files are stored. Should only be called while holding the lock.
+func (t *QuotaTracker) checkUser(user string, files map[string]int64) (int64, error) {
+	remaining := int64(-1)
+	err := t.checkQuota(user, files, t.config.Quotas.Global, func(p string, usage fileUsage) bool {
+		return true
+	}, &remaining)
+	if err != nil {
+		return 0, err
+	}
+
+	if quota, ok := t.config.Quotas.Users[user]; ok {
+		err = t.checkQuota(user, files, quota, func(p string, usage fileUsage) bool {
+			return usage.owner == user
+		}, &remaining)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return remaining, nil
+}
+
+// Checks the files against a single quota, which applies to the files matching the
+// filter. Lowers remaining to the bytes left in the quota, unless it's already lower.
+// Should only be called while holding the lock.
+func (t *QuotaTracker) checkQuota(user string, files map[string]int64, quota Quota, filter func(p string, usage fileUsage) bool, remaining *int64) error {
+	if quota.MaxBytes == 0 && quota.MaxFiles == 0 {
+		return nil
+	}
+
+	bytes, count := t.usageWithReservations(filter)
+	for p, size := range files {
+		if !filter(p, fileUsage{size: size, owner: user}) {
+			continue
+		}
+		if existing, overwrite := t.files[p]; overwrite && filter(p, existing) {
+			bytes -= existing.size
+		} else {
+			count++
+		}
+		bytes += size
+	}
+
+	if quota.MaxFiles != 0 && count > quota.MaxFiles {
+		return ErrFileQuotaExceeded
+	}
+	if quota.MaxBytes != 0 {
+		left := quota.MaxBytes - bytes
+		if left < 0 {
+			return ErrQuotaExceeded
+		}
+		if *remaining == -1 || left < *remaining {
+			*remaining = left
+		}
+	}
+	return nil
+}
+
+// Records that the given user has uploaded a file with the given size
+func (t *QuotaTracker) Record(user, p string, size int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.record(user, p, size)
+}
+
+// Should only be called while holding the lock
+func (t *QuotaTracker) record(user, p string, size int64) {
+	t.files[p] = fileUsage{
+		size:  size,
+		owner: user,
+	}
+
+	err := t.writeOwners()
+	if err != nil {
+		slog.Error("Unable to save file owners", "error", err)
+	}
+}
+
+// Records that the reserved file at the given path has been stored, and
+// no longer needs the space set aside for it
+func (r *QuotaReservation) Commit(p string) {
+	t := r.tracker
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	size, ok := r.files[p]
+	if !ok {
+		return
+	}
+	delete(r.files, p)
+	t.record(r.user, p, size)
+}
+
+// Gives back the space set aside for the files that weren't stored
+func (r *QuotaReservation) Release() {
+	t := r.tracker
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.reservations, r)
+}
+
+// Gets how much is stored in the serve path in total
+func (t *QuotaTracker) Total() (bytes, files int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.usage(func(p string, usage fileUsage) bool {
+		return true
+	})
+}
+
+// Records that the file at the given path has been deleted
+func (t *QuotaTracker) Forget(p string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.files[p]; !ok {
+		return
+	}
+	delete(t.files, p)
+
+	err := t.writeOwners()
+	if err != nil {
+		slog.Error("Unable to save file owners", "error", err)
+	}
+}
+
+// Current storage consumption, compared to the limits
+type QuotaUsage struct {
+	// What is being limited. Either "global", a username or a path prefix
+	Name string `json:"name" xml:"name"`
+	// The number of bytes currently stored
+	Bytes int64 `json:"bytes" xml:"bytes"`
+	// The number of files currently stored
+	Files int64 `json:"files" xml:"files"`
+	// The max number of bytes that can be stored. 0 if unlimited
+	MaxBytes int64 `json:"max_bytes,omitempty" xml:"max_bytes,omitempty"`
+	// The max number of files that can be stored. 0 if unlimited
+	MaxFiles int64 `json:"max_files,omitempty" xml:"max_files,omitempty"`
+}
+
+// Gets the current storage consumption
+func (t *QuotaTracker) Usage(user string) *UsageResponse {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	quotas := t.config.Quotas
+	response := &UsageResponse{}
+
+	response.Global = QuotaUsage{
+		Name:     "global",
+		MaxBytes: quotas.Global.MaxBytes,
+		MaxFiles: quotas.Global.MaxFiles,
+	}
+	response.Global.Bytes, response.Global.Files = t.usage(func(p string, usage fileUsage) bool {
+		return true
+	})
+
+	userQuota := quotas.Users[user]
+	response.User = QuotaUsage{
+		Name:     user,
+		MaxBytes: userQuota.MaxBytes,
+		MaxFiles: userQuota.MaxFiles,
+	}
+	response.User.Bytes, response.User.Files = t.usage(func(p string, usage fileUsage) bool {
+		return usage.owner == user
+	})
+
+	for prefix, quota := range quotas.Paths {
+		pathUsage := QuotaUsage{
+			Name:     prefix,
+			MaxBytes: quota.MaxBytes,
+			MaxFiles: quota.MaxFiles,
+		}
+		pathUsage.Bytes, pathUsage.Files = t.usage(func(p string, usage fileUsage) bool {
+			return hasPathPrefix(p, prefix)
+		})
+		response.Paths = append(response.Paths, pathUsage)
+	}
+	sort.Slice(response.Paths, func(i, j int) bool {
+		return response.Paths[i].Name < response.Paths[j].Name
+	})
+
+	return response
+}
+
+// Wraps a reader, and fails when more than the remaining quota has been read.
+// A negative remaining quota means unlimited.
+func newQuotaReader(reader io.Reader, remaining int64) io.Reader {
+	if remaining < 0 {
+		return reader
+	}
+	return newLimitedReader(reader, remaining, ErrQuotaExceeded)
+}
@@ -0,0 +1,119 @@
+package gfs
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-quota")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Serve: filepath.Join(dir, "serve"),
+		Data:  filepath.Join(dir, "data"),
+		Quotas: QuotaConfig{
+			Global: Quota{MaxBytes: 100},
+			Users:  map[string]Quota{"test": {MaxFiles: 2}},
+			Paths:  map[string]Quota{"/small": {MaxBytes: 10}},
+		},
+	}
+	a.NoError(os.MkdirAll(filepath.Join(config.Serve, "small"), os.ModePerm))
+	a.NoError(ioutil.WriteFile(filepath.Join(config.Serve, "small", "existing.txt"), []byte("1234"), 0644))
+
+	quotas, err := NewQuotaTracker(config)
+	if !a.NoError(err) {
+		return
+	}
+
+	remaining, err := quotas.Remaining("test", "/small/new.txt")
+	if a.NoError(err) {
+		a.Equal(int64(6), remaining)
+	}
+
+	remaining, err = quotas.Remaining("test", "/small/existing.txt")
+	if a.NoError(err) {
+		a.Equal(int64(10), remaining, "Overwritten files should count as free space")
+	}
+
+	remaining, err = quotas.Remaining("test", "/other.txt")
+	if a.NoError(err) {
+		a.Equal(int64(96), remaining)
+	}
+
+	quotas.Record("test", "/a.txt", 1)
+	quotas.Record("test", "/b.txt", 1)
+	_, err = quotas.Remaining("test", "/c.txt")
+	a.Equal(ErrFileQuotaExceeded, err)
+
+	t.Run("Reservations", func(t *testing.T) {
+		a := assert.New(t)
+
+		first, err := quotas.Reserve("other", map[string]int64{"/small/first.txt": 4})
+		if !a.NoError(err) {
+			return
+		}
+		_, err = quotas.Reserve("other", map[string]int64{"/small/second.txt": 4})
+		a.Equal(ErrQuotaExceeded, err, "The space reserved by the first upload should be taken")
+		remaining, err := quotas.Remaining("other", "/small/second.txt")
+		if a.NoError(err) {
+			a.Equal(int64(2), remaining)
+		}
+
+		first.Commit("/small/first.txt")
+		first.Release()
+		a.Equal(int64(8), quotas.Usage("other").Paths[0].Bytes, "Committed files should be recorded")
+
+		second, err := quotas.Reserve("other", map[string]int64{"/small/second.txt": 2})
+		if a.NoError(err) {
+			second.Release()
+		}
+		remaining, err = quotas.Remaining("other", "/small/second.txt")
+		if a.NoError(err) {
+			a.Equal(int64(2), remaining, "Released space should be free again")
+		}
+		quotas.Forget("/small/first.txt")
+	})
+
+	t.Run("Owners are persisted", func(t *testing.T) {
+		a := assert.New(t)
+
+		a.NoError(ioutil.WriteFile(filepath.Join(config.Serve, "a.txt"), []byte("a"), 0644))
+
+		reloaded, err := NewQuotaTracker(config)
+		if a.NoError(err) {
+			usage := reloaded.Usage("test")
+			a.Equal(int64(1), usage.User.Files)
+			a.Equal(int64(2), usage.Global.Files)
+		}
+	})
+
+	t.Run("Corrupt owners", func(t *testing.T) {
+		a := assert.New(t)
+
+		owners := filepath.Join(config.Data, ownersFilename)
+		a.NoError(ioutil.WriteFile(owners, []byte(`{"/a.txt": "te`), 0644))
+		defer quotas.writeOwners()
+
+		reloaded, err := NewQuotaTracker(config)
+		if a.NoError(err, "A half written file shouldn't keep gfs from starting") {
+			a.Equal(int64(0), reloaded.Usage("test").User.Files)
+		}
+	})
+
+	t.Run("Reader stops when quota is exceeded", func(t *testing.T) {
+		a := assert.New(t)
+
+		_, err := ioutil.ReadAll(newQuotaReader(bytes.NewBufferString("12345"), 4))
+		a.Equal(ErrQuotaExceeded, err)
+	})
+}
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
@@ -17,7 +17,7 @@ func (r *responseHandler) WriteResponse(writer http.ResponseWriter, statusCode i
 
 	switch format {
 	default:
-		log.Println("Unknown response format", format)
+		slog.Warn("Unknown response format", "format", format)
 		fallthrough
 	case FormatHtml:
 		writer.Header().Set("content-type", FormatHtml)
@@ -27,6 +27,11 @@ func (r *responseHandler) WriteResponse(writer http.ResponseWriter, statusCode i
 		writer.Header().Set("content-type", FormatJson)
 		writer.WriteHeader(statusCode)
 		return json.NewEncoder(writer).Encode(response)
+	case FormatNdjson:
+		// A single object is also a valid stream of objects
+		writer.Header().Set("content-type", FormatNdjson)
+		writer.WriteHeader(statusCode)
+		return json.NewEncoder(writer).Encode(response)
 	case FormatXml:
 		writer.Header().Set("content-type", FormatXml)
 		writer.WriteHeader(statusCode)
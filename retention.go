@@ -0,0 +1,253 @@
+package gfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// How often the retention rules are applied, unless configured otherwise
+	defaultRetentionInterval time.Duration = time.Hour
+)
+
+// Settings for automatically deleting old files
+type RetentionConfig struct {
+	// The number of minutes between applying the rules. Defaults to 60
+	Interval int `json:"interval"`
+	// If true, the files that would be deleted are only logged
+	DryRun bool `json:"dryRun"`
+	// The rules to apply
+	Rules []RetentionRule `json:"rules"`
+}
+
+// A rule for the entries directly in a directory. Every file or directory in it
+// counts as one entry, and directories are deleted with everything in them.
+// A zero value means no limit.
+type RetentionRule struct {
+	// The directory the rule applies to, relative to the serve root
+	Path string `json:"path"`
+	// Entries last modified more than this many days ago are deleted
+	MaxAgeDays int `json:"maxAgeDays"`
+	// Only the newest entries are kept
+	MaxEntries int `json:"maxEntries"`
+	// The newest entries are kept until their combined size reaches this many bytes
+	MaxTotalSize int64 `json:"maxTotalSize"`
+}
+
+func (r RetentionRule) validate() error {
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("Invalid retention rule path '%s'. It has to start with '/'", r.Path)
+	}
+	if r.MaxAgeDays < 0 || r.MaxEntries < 0 || r.MaxTotalSize < 0 {
+		return fmt.Errorf("Invalid retention rule for '%s'. Limits can't be negative", r.Path)
+	}
+	if r.MaxAgeDays == 0 && r.MaxEntries == 0 && r.MaxTotalSize == 0 {
+		return fmt.Errorf("Invalid retention rule for '%s'. It has no limits", r.Path)
+	}
+	return nil
+}
+
+func (r RetentionRule) getMaxAge() time.Duration {
+	return time.Duration(r.MaxAgeDays) * 24 * time.Hour
+}
+
+// Gets the entries the rule deletes, oldest last
+func (r RetentionRule) expired(entries []retainedEntry, now time.Time) []retainedEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.After(entries[j].modTime)
+	})
+
+	var expired []retainedEntry
+	var total int64
+	full := false
+	for i, entry := range entries {
+		total += entry.size
+		if r.MaxTotalSize > 0 && total > r.MaxTotalSize {
+			// Everything older goes too, even if it would still fit
+			full = true
+		}
+
+		switch {
+		case full:
+		case r.MaxEntries > 0 && i >= r.MaxEntries:
+		case r.MaxAgeDays > 0 && now.Sub(entry.modTime) > r.getMaxAge():
+		default:
+			continue
+		}
+		expired = append(expired, entry)
+	}
+	return expired
+}
+
+// An entry in a directory with a retention rule
+type retainedEntry struct {
+	// The path of the entry, relative to the serve root
+	path    string
+	modTime time.Time
+	// The size of the entry, including everything in it if it's a directory
+	size int64
+}
+
+// Gets the time the entry at the given path will be deleted because of its age.
+// Returns nil if no rule limits the age of the entry.
+func (c *Config) getExpiryTime(p string, modTime time.Time) *time.Time {
+	var expiresAt *time.Time
+	for _, rule := range c.Retention.Rules {
+		if rule.MaxAgeDays <= 0 || p == path.Clean(rule.Path) || !hasPathPrefix(p, rule.Path) {
+			continue
+		}
+
+		// Entries deeper down go when the entry directly in the rule path they're in does
+		entryModTime := modTime
+		if dir := path.Dir(p); dir != path.Clean(rule.Path) {
+			rel := strings.TrimPrefix(p, path.Join("/", rule.Path)+"/")
+			top := path.Join(rule.Path, strings.SplitN(rel, "/", 2)[0])
+			info, err := os.Stat(filepath.Join(c.Serve, filepath.FromSlash(top)))
+			if err != nil {
+				continue
+			}
+			entryModTime = info.ModTime()
+		}
+
+		t := entryModTime.Add(rule.getMaxAge())
+		if expiresAt == nil || t.Before(*expiresAt) {
+			expiresAt = &t
+		}
+	}
+	return expiresAt
+}
+
+// Deletes the files expired by the retention rules on a schedule
+type Janitor struct {
+	config *Config
+	quotas *QuotaTracker
+}
+
+func NewJanitor(config *Config, quotas *QuotaTracker) (*Janitor, error) {
+	for _, rule := range config.Retention.Rules {
+		err := rule.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Janitor{
+		config: config,
+		quotas: quotas,
+	}, nil
+}
+
+func (j *Janitor) getInterval() time.Duration {
+	if j.config.Retention.Interval > 0 {
+		return time.Duration(j.config.Retention.Interval) * time.Minute
+	}
+	return defaultRetentionInterval
+}
+
+// Applies the rules on startup, and then periodically until the program stops
+func (j *Janitor) run() {
+	for {
+		_, err := j.Sweep()
+		if err != nil {
+			slog.Error("Error when applying retention rules", "error", err)
+		}
+		time.Sleep(j.getInterval())
+	}
+}
+
+// Applies all the rules. Returns the paths of the deleted entries, or the ones
+// that would have been deleted in dry run mode.
+func (j *Janitor) Sweep() ([]string, error) {
+	now := time.Now()
+	var deleted []string
+	for _, rule := range j.config.Retention.Rules {
+		expired, err := j.apply(rule, now)
+		deleted = append(deleted, expired...)
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	// The deletions are published by the watcher, but the quotas only pick them up when rescanning
+	if len(deleted) > 0 && !j.config.Retention.DryRun && j.quotas != nil {
+		err := j.quotas.Rescan()
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func (j *Janitor) apply(rule RetentionRule, now time.Time) ([]string, error) {
+	dir := filepath.Join(j.config.Serve, filepath.FromSlash(rule.Path))
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]retainedEntry, 0, len(infos))
+	for _, info := range infos {
+		// Files still being uploaded are cleaned up by the upload handler
+		if isStagingFile(info.Name()) {
+			continue
+		}
+		size, err := getTotalSize(filepath.Join(dir, info.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, retainedEntry{
+			path:    path.Join(rule.Path, info.Name()),
+			modTime: info.ModTime(),
+			size:    size,
+		})
+	}
+
+	var deleted []string
+	for _, entry := range rule.expired(entries, now) {
+		if j.config.Retention.DryRun {
+			slog.Info("Retention rule would delete entry (dry run)", "rule", rule.Path, "path", entry.path)
+			deleted = append(deleted, entry.path)
+			continue
+		}
+
+		err := os.RemoveAll(filepath.Join(j.config.Serve, filepath.FromSlash(entry.path)))
+		if err != nil {
+			return deleted, err
+		}
+		slog.Info("Retention rule deleted entry", "rule", rule.Path, "path", entry.path)
+		deleted = append(deleted, entry.path)
+	}
+	return deleted, nil
+}
+
+// Gets the size of the file, or of everything in the directory
+func getTotalSize(fullpath string, info os.FileInfo) (int64, error) {
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+
+	var size int64
+	err := filepath.Walk(fullpath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && !isStagingFile(info.Name()) {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,113 @@
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionRuleExpired(t *testing.T) {
+	now := time.Now()
+	entries := func() []retainedEntry {
+		return []retainedEntry{
+			{path: "/a", modTime: now.Add(-10 * 24 * time.Hour), size: 10},
+			{path: "/b", modTime: now.Add(-1 * time.Hour), size: 10},
+			{path: "/c", modTime: now.Add(-3 * 24 * time.Hour), size: 10},
+			{path: "/d", modTime: now.Add(-2 * time.Hour), size: 10},
+		}
+	}
+	paths := func(entries []retainedEntry) []string {
+		var paths []string
+		for _, entry := range entries {
+			paths = append(paths, entry.path)
+		}
+		return paths
+	}
+
+	tests := []struct {
+		rule     RetentionRule
+		expected []string
+	}{
+		{RetentionRule{MaxAgeDays: 2}, []string{"/c", "/a"}},
+		{RetentionRule{MaxEntries: 3}, []string{"/a"}},
+		{RetentionRule{MaxTotalSize: 25}, []string{"/c", "/a"}},
+		{RetentionRule{MaxAgeDays: 5, MaxEntries: 1}, []string{"/d", "/c", "/a"}},
+		{RetentionRule{MaxAgeDays: 30}, nil},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, paths(test.rule.expired(entries(), now)), "%+v", test.rule)
+	}
+}
+
+func TestRetentionRuleValidate(t *testing.T) {
+	a := assert.New(t)
+	a.NoError(RetentionRule{Path: "/logs", MaxEntries: 1}.validate())
+	a.Error(RetentionRule{Path: "logs", MaxEntries: 1}.validate())
+	a.Error(RetentionRule{Path: "/logs"}.validate())
+	a.Error(RetentionRule{Path: "/logs", MaxAgeDays: -1}.validate())
+}
+
+func TestJanitor(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-retention")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Serve: filepath.Join(dir, "serve"),
+		Data:  filepath.Join(dir, "data"),
+		Retention: RetentionConfig{
+			DryRun: true,
+			Rules:  []RetentionRule{{Path: "/nightly", MaxAgeDays: 7}},
+		},
+	}
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	nightly := filepath.Join(config.Serve, "nightly")
+	a.NoError(os.MkdirAll(filepath.Join(nightly, "old"), os.ModePerm))
+	a.NoError(ioutil.WriteFile(filepath.Join(nightly, "old", "build.zip"), []byte("1234"), 0644))
+	a.NoError(os.Chtimes(filepath.Join(nightly, "old"), old, old))
+	a.NoError(ioutil.WriteFile(filepath.Join(nightly, "new.zip"), []byte("1234"), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(nightly, stagingFilePrefix+"upload"), []byte("1234"), 0644))
+	a.NoError(os.Chtimes(filepath.Join(nightly, stagingFilePrefix+"upload"), old, old))
+
+	t.Run("Expiry time", func(t *testing.T) {
+		a := assert.New(t)
+		expected := old.Add(7 * 24 * time.Hour)
+
+		expiresAt := config.getExpiryTime("/nightly/old", old)
+		if a.NotNil(expiresAt) {
+			a.True(expected.Equal(*expiresAt))
+		}
+		expiresAt = config.getExpiryTime("/nightly/old/build.zip", time.Now())
+		if a.NotNil(expiresAt, "Entries deeper down should expire with the entry in the rule path") {
+			a.True(expected.Equal(*expiresAt))
+		}
+		a.Nil(config.getExpiryTime("/nightly", old))
+		a.Nil(config.getExpiryTime("/other.zip", old))
+	})
+
+	janitor, err := NewJanitor(config, nil)
+	if !a.NoError(err) {
+		return
+	}
+
+	deleted, err := janitor.Sweep()
+	a.NoError(err)
+	a.Equal([]string{"/nightly/old"}, deleted)
+	a.DirExists(filepath.Join(nightly, "old"), "Nothing should be deleted in dry run mode")
+
+	config.Retention.DryRun = false
+	deleted, err = janitor.Sweep()
+	a.NoError(err)
+	a.Equal([]string{"/nightly/old"}, deleted)
+	_, err = os.Stat(filepath.Join(nightly, "old"))
+	a.True(os.IsNotExist(err))
+	a.FileExists(filepath.Join(nightly, "new.zip"))
+	a.FileExists(filepath.Join(nightly, stagingFilePrefix+"upload"), "Files being uploaded should be left alone")
+}
@@ -0,0 +1,253 @@
+package gfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The possible results of scanning a file
+const (
+	ScanClean     string = "clean"
+	ScanInfected  string = "infected"
+	ScanUnscanned string = "unscanned"
+)
+
+const (
+	// The directory in the data path infected files are moved to
+	quarantineDirname string = "quarantine"
+	// How long a scan can take, unless configured otherwise
+	defaultScanTimeout time.Duration = time.Minute
+	// The size of the chunks files are streamed to the scanner in
+	scanChunkSize int = 64 << 10
+)
+
+// Settings for scanning uploads for malware with a scanner speaking the clamd protocol
+type ScannerConfig struct {
+	// The address of the scanner, e.g. "tcp://localhost:3310" or "unix:///var/run/clamav/clamd.ctl".
+	// Uploads are not scanned if this is empty.
+	Address string `json:"address"`
+	// Only uploads below these paths are scanned. Defaults to all uploads
+	Paths []string `json:"paths"`
+	// If true, infected files are moved to the quarantine directory in the data path
+	// instead of rejecting the upload
+	Quarantine bool `json:"quarantine"`
+	// Accept uploads without scanning them if the scanner can't be reached
+	AllowUnscanned bool `json:"allowUnscanned"`
+	// The max number of seconds a scan can take. Defaults to 60
+	Timeout int `json:"timeout"`
+}
+
+// The verdict of the scanner
+type ScanResult struct {
+	// One of clean, infected or unscanned
+	Status string `json:"status" xml:"status"`
+	// The name of the malware that was found, if the file is infected
+	Signature string `json:"signature,omitempty" xml:"signature,omitempty"`
+	// True if the infected file was quarantined instead of being rejected
+	Quarantined bool `json:"quarantined,omitempty" xml:"quarantined,omitempty"`
+}
+
+// An upload that was rejected because malware was found in it
+type UploadScanError struct {
+	Message string
+}
+
+func (e *UploadScanError) Error() string {
+	return e.Message
+}
+
+func isUploadScanError(err error) bool {
+	_, ok := err.(*UploadScanError)
+	return ok
+}
+
+// Information about a quarantined file, saved next to it
+type quarantinedFile struct {
+	Path      string    `json:"path"`
+	User      string    `json:"user"`
+	Signature string    `json:"signature"`
+	Time      time.Time `json:"time"`
+}
+
+// Scans uploaded files with a clamd scanner
+type Scanner struct {
+	config *Config
+}
+
+func NewScanner(config *Config) *Scanner {
+	return &Scanner{
+		config: config,
+	}
+}
+
+// Checks if uploads to the given path should be scanned
+func (s *Scanner) shouldScan(p string) bool {
+	if s.config.Scanner.Address == "" {
+		return false
+	}
+	if len(s.config.Scanner.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range s.config.Scanner.Paths {
+		if hasPathPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scanner) getTimeout() time.Duration {
+	if s.config.Scanner.Timeout > 0 {
+		return time.Duration(s.config.Scanner.Timeout) * time.Second
+	}
+	return defaultScanTimeout
+}
+
+// Scans the file uploaded to the given path. Returns nil if the file
+// shouldn't be scanned.
+func (s *Scanner) Scan(p, file string) (*ScanResult, error) {
+	if !s.shouldScan(p) {
+		return nil, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result, err := s.scan(f)
+	if err != nil {
+		if s.config.Scanner.AllowUnscanned {
+			slog.Warn("Unable to scan upload, accepting it anyway", "path", p, "error", err)
+			return &ScanResult{Status: ScanUnscanned}, nil
+		}
+		return nil, err
+	}
+	if result.Status == ScanInfected {
+		slog.Warn("Found malware in upload", "path", p, "signature", result.Signature)
+	}
+	return result, nil
+}
+
+// Gets the network and address to connect to the scanner with
+func (s *Scanner) getAddress() (network, address string) {
+	address = s.config.Scanner.Address
+	if strings.HasPrefix(address, "unix://") {
+		return "unix", strings.TrimPrefix(address, "unix://")
+	}
+	return "tcp", strings.TrimPrefix(address, "tcp://")
+}
+
+// Streams the content to the scanner using the INSTREAM command
+func (s *Scanner) scan(reader io.Reader) (*ScanResult, error) {
+	network, address := s.getAddress()
+	conn, err := net.DialTimeout(network, address, s.getTimeout())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.getTimeout()))
+
+	writer := bufio.NewWriterSize(conn, scanChunkSize+4)
+	_, err = writer.WriteString("zINSTREAM\x00")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each chunk is prefixed with its length. A zero length chunk ends the stream.
+	chunk := make([]byte, scanChunkSize)
+	length := make([]byte, 4)
+	for {
+		n, readErr := io.ReadFull(reader, chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(length, uint32(n))
+			writer.Write(length)
+			_, err = writer.Write(chunk[:n])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	binary.BigEndian.PutUint32(length, 0)
+	writer.Write(length)
+	err = writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseScanReply(reply)
+}
+
+// Parses a reply like "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseScanReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	verdict := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case verdict == "OK":
+		return &ScanResult{Status: ScanClean}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return &ScanResult{
+			Status:    ScanInfected,
+			Signature: strings.TrimSuffix(verdict, " FOUND"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unexpected reply from scanner: '%s'", reply)
+	}
+}
+
+// Moves the infected file uploaded to the given path to the quarantine directory
+func (s *Scanner) Quarantine(user, p, file string, result *ScanResult) error {
+	dir := path.Join(s.config.getDataPath(), quarantineDirname)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(dir, uuid.NewV4().String())
+	info, err := json.Marshal(quarantinedFile{
+		Path:      p,
+		User:      user,
+		Signature: result.Signature,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(target+".json", info, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = moveFile(file, target)
+	if err != nil {
+		os.Remove(target + ".json")
+		return err
+	}
+
+	result.Quarantined = true
+	slog.Warn("Quarantined upload", "path", p, "target", target)
+	return nil
+}
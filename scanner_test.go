@@ -0,0 +1,172 @@
+package gfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Starts a fake clamd that finds "EICAR" in anything containing it
+func startFakeClamd(t *testing.T, network, address string) net.Listener {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var content bytes.Buffer
+				for {
+					var length uint32
+					err = binary.Read(reader, binary.BigEndian, &length)
+					if err != nil {
+						return
+					}
+					if length == 0 {
+						break
+					}
+					_, err = io.CopyN(&content, reader, int64(length))
+					if err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(content.String(), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestScanner(t *testing.T) {
+	h, cleanup := getTestUploadHandler(t)
+	defer cleanup()
+
+	clamd := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	defer clamd.Close()
+	h.config.Scanner.Address = "tcp://" + clamd.Addr().String()
+	h.config.Scanner.Paths = []string{"/partners"}
+
+	t.Run("Infected files are rejected", func(t *testing.T) {
+		a := assert.New(t)
+
+		_, err := h.uploadFile(context.Background(), "test", "/partners/virus.txt", strings.NewReader("EICAR"), -1, UploadExpiry{})
+		a.True(isUploadScanError(err))
+		a.Contains(err.Error(), "Eicar-Test-Signature")
+		_, err = os.Stat(filepath.Join(h.config.Serve, "partners", "virus.txt"))
+		a.True(os.IsNotExist(err))
+	})
+
+	t.Run("Clean files are uploaded with the verdict", func(t *testing.T) {
+		a := assert.New(t)
+
+		request := httptest.NewRequest("POST", "/upload?filename=/partners/clean.txt", strings.NewReader("clean"))
+		request.Header.Set("Content-Type", FormatOctetStream)
+		recorder := httptest.NewRecorder()
+		if !a.NoError(h.Handle(recorder, request, FormatJson, "test")) {
+			return
+		}
+		a.Equal(http.StatusAccepted, recorder.Code)
+
+		var response UploadResponse
+		if a.NoError(json.NewDecoder(recorder.Body).Decode(&response)) && a.Len(response.Files, 1) {
+			a.Equal("/partners/clean.txt", response.Files[0].Path)
+			a.Equal(&ScanResult{Status: ScanClean}, response.Files[0].Scan)
+		}
+	})
+
+	t.Run("Files outside the paths are not scanned", func(t *testing.T) {
+		a := assert.New(t)
+
+		file, err := h.uploadFile(context.Background(), "test", "/internal/virus.txt", strings.NewReader("EICAR"), -1, UploadExpiry{})
+		if a.NoError(err) {
+			a.Nil(file.Scan)
+		}
+	})
+
+	t.Run("Infected files can be quarantined", func(t *testing.T) {
+		a := assert.New(t)
+
+		h.config.Scanner.Quarantine = true
+		defer func() {
+			h.config.Scanner.Quarantine = false
+		}()
+
+		file, err := h.uploadFile(context.Background(), "test", "/partners/quarantined.txt", strings.NewReader("EICAR"), -1, UploadExpiry{})
+		if !a.NoError(err) {
+			return
+		}
+		a.Equal(&ScanResult{Status: ScanInfected, Signature: "Eicar-Test-Signature", Quarantined: true}, file.Scan)
+
+		_, err = os.Stat(filepath.Join(h.config.Serve, "partners", "quarantined.txt"))
+		a.True(os.IsNotExist(err))
+		entries, err := ioutil.ReadDir(filepath.Join(h.config.Data, quarantineDirname))
+		if a.NoError(err) {
+			a.Len(entries, 2, "The file and the information about it")
+		}
+	})
+
+	t.Run("Unreachable scanner", func(t *testing.T) {
+		a := assert.New(t)
+
+		h.config.Scanner.Address = "unix://" + filepath.Join(h.config.Data, "missing.sock")
+		_, err := h.uploadFile(context.Background(), "test", "/partners/a.txt", strings.NewReader("a"), -1, UploadExpiry{})
+		a.Error(err)
+		a.False(isUploadScanError(err))
+
+		h.config.Scanner.AllowUnscanned = true
+		file, err := h.uploadFile(context.Background(), "test", "/partners/a.txt", strings.NewReader("a"), -1, UploadExpiry{})
+		if a.NoError(err) {
+			a.Equal(ScanUnscanned, file.Scan.Status)
+		}
+	})
+}
+
+func TestScanner_UnixSocket(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-scanner")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	clamd := startFakeClamd(t, "unix", filepath.Join(dir, "clamd.sock"))
+	defer clamd.Close()
+
+	s := NewScanner(&Config{Scanner: ScannerConfig{Address: "unix://" + filepath.Join(dir, "clamd.sock")}})
+	result, err := s.scan(strings.NewReader(strings.Repeat("x", 3*scanChunkSize) + "EICAR"))
+	if a.NoError(err) {
+		a.Equal(ScanInfected, result.Status)
+	}
+}
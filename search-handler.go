@@ -0,0 +1,495 @@
+package gfs
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	//language=html
+	SearchResponseHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>Search in {{.Options.Path}}</title>
+</head>
+<body>
+<h1>Search in <a href="{{.BasePath}}{{.Options.Path}}">{{.Options.Path}}</a></h1>
+<form action="{{.BasePath}}/search" method="get">
+    <input type="hidden" name="path" value="{{.Options.Path}}" />
+    <label for="nameInput">Name</label>
+    <input name="name" id="nameInput" type="search" value="{{.Options.Name}}" placeholder="*.zip" />
+    <button type="submit">Search</button>
+</form>
+<hr />
+<table>
+    <thead>
+        <tr>
+            <th>Path</th>
+            <th>Size</th>
+            <th>Last modified</th>
+        </tr>
+    </thead>
+    <tbody>
+		{{range .Results}}
+		<tr>
+			<td><a href="{{.Path}}">{{.Path}}</a></td>
+			<td>
+			{{if .IsDirectory}}
+				&lt;Dir&gt;
+			{{else}}
+				{{.Size}}
+			{{end}}
+			</td>
+			<td>
+			{{.LastModificationTime}}
+			</td>
+		</tr>
+		{{else}}
+		<tr>
+			<td colspan="3">Nothing found</td>
+		</tr>
+		{{end}}
+    </tbody>
+</table>
+{{if .LimitReached}}
+<p>Only the first {{len .Results}} results are shown.</p>
+{{end}}
+</body>
+</html>`
+
+	// The max number of results shown in html, as the html is not streamed
+	maxHtmlSearchResults int = 1000
+)
+
+var (
+	ErrInvalidSearchRegex = errors.New("Invalid regex")
+	ErrInvalidSearchName  = errors.New("Invalid name pattern")
+	ErrInvalidSearchSize  = errors.New("Invalid size. Sizes has to be a number of bytes")
+	ErrInvalidSearchTime  = errors.New("Invalid time. Times has to be in RFC 3339 format, e.g. 2017-07-02T19:17:03Z")
+
+	// Used to stop walking the tree when enough results has been found
+	errSearchLimitReached = errors.New("Search limit reached")
+)
+
+func isSearchClientError(err error) bool {
+	return err == ErrInvalidSearchRegex ||
+		err == ErrInvalidSearchName ||
+		err == ErrInvalidSearchSize ||
+		err == ErrInvalidSearchTime ||
+		err == ErrInvalidOnly ||
+		err == ErrInvalidLimit
+}
+
+// What to search for. Empty values are ignored.
+type SearchOptions struct {
+	// The directory to search in. Defaults to the serve root
+	Path string
+	// Glob pattern the name has to match, e.g. "*.zip"
+	Name string
+	// Regular expression the path has to match
+	Regex string
+	// The min size in bytes of matching files
+	MinSize int64
+	// The max size in bytes of matching files
+	MaxSize int64
+	// Only match entries modified after this time
+	ModifiedAfter time.Time
+	// Only match entries modified before this time
+	ModifiedBefore time.Time
+	// Only match files or directories
+	Only string
+	// The max number of results
+	Limit int
+
+	regex *regexp.Regexp
+}
+
+// Reads the search options from the query parameters of a request
+func parseSearchOptions(query url.Values) (options SearchOptions, err error) {
+	options.Path = path.Join("/", query.Get("path"))
+	options.Name = query.Get("name")
+	// An invalid pattern would otherwise silently match nothing
+	if _, err = path.Match(options.Name, ""); err != nil {
+		return options, ErrInvalidSearchName
+	}
+
+	options.Regex = query.Get("regex")
+	if options.Regex != "" {
+		options.regex, err = regexp.Compile(options.Regex)
+		if err != nil {
+			return options, ErrInvalidSearchRegex
+		}
+	}
+
+	sizes := map[string]*int64{
+		"minSize": &options.MinSize,
+		"maxSize": &options.MaxSize,
+	}
+	for name, size := range sizes {
+		if value := query.Get(name); value != "" {
+			*size, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return options, ErrInvalidSearchSize
+			}
+		}
+	}
+
+	times := map[string]*time.Time{
+		"modifiedAfter":  &options.ModifiedAfter,
+		"modifiedBefore": &options.ModifiedBefore,
+	}
+	for name, t := range times {
+		if value := query.Get(name); value != "" {
+			*t, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return options, ErrInvalidSearchTime
+			}
+		}
+	}
+
+	options.Only = query.Get("only")
+	switch options.Only {
+	case "", OnlyFiles, OnlyDirectories:
+	default:
+		return options, ErrInvalidOnly
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		options.Limit, err = strconv.Atoi(limit)
+		if err != nil || options.Limit < 0 {
+			return options, ErrInvalidLimit
+		}
+	}
+
+	return options, nil
+}
+
+// Converts the options to query parameters
+func (o SearchOptions) Query() url.Values {
+	query := url.Values{}
+	if o.Path != "" {
+		query.Set("path", o.Path)
+	}
+	if o.Name != "" {
+		query.Set("name", o.Name)
+	}
+	if o.Regex != "" {
+		query.Set("regex", o.Regex)
+	}
+	if o.MinSize != 0 {
+		query.Set("minSize", strconv.FormatInt(o.MinSize, 10))
+	}
+	if o.MaxSize != 0 {
+		query.Set("maxSize", strconv.FormatInt(o.MaxSize, 10))
+	}
+	if !o.ModifiedAfter.IsZero() {
+		query.Set("modifiedAfter", o.ModifiedAfter.Format(time.RFC3339))
+	}
+	if !o.ModifiedBefore.IsZero() {
+		query.Set("modifiedBefore", o.ModifiedBefore.Format(time.RFC3339))
+	}
+	if o.Only != "" {
+		query.Set("only", o.Only)
+	}
+	if o.Limit != 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return query
+}
+
+// Checks if the entry matches the search
+func (o SearchOptions) matches(entry DirectoryEntry) bool {
+	if o.Only == OnlyFiles && entry.IsDirectory {
+		return false
+	}
+	if o.Only == OnlyDirectories && !entry.IsDirectory {
+		return false
+	}
+
+	if o.Name != "" {
+		matched, err := path.Match(o.Name, entry.Name)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	if o.regex != nil && !o.regex.MatchString(entry.Path) {
+		return false
+	}
+
+	// Directories doesn't have a size, so they can never match a size range
+	if (o.MinSize != 0 || o.MaxSize != 0) && entry.IsDirectory {
+		return false
+	}
+	if o.MinSize != 0 && entry.Size < o.MinSize {
+		return false
+	}
+	if o.MaxSize != 0 && entry.Size > o.MaxSize {
+		return false
+	}
+
+	if !o.ModifiedAfter.IsZero() && !entry.LastModificationTime.After(o.ModifiedAfter) {
+		return false
+	}
+	if !o.ModifiedBefore.IsZero() && !entry.LastModificationTime.Before(o.ModifiedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// Walks the directory tree, calling found for every matching entry. Entries that
+// can't be read are skipped, since the results might already be partly sent.
+// Stops without an error when the limit is reached, or the context is done.
+// Returns true if the search stopped because the limit was reached.
+func (o SearchOptions) search(ctx context.Context, serve string, found func(entry DirectoryEntry) error) (bool, error) {
+	root := path.Join(serve, o.Path)
+	count := 0
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			slog.Debug("Skipping unreadable entry in search", "path", p, "error", err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if p == root || isStagingFile(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		entry := DirectoryEntry{
+			Name:                 info.Name(),
+			Path:                 path.Join(o.Path, filepath.ToSlash(rel)),
+			IsDirectory:          info.IsDir(),
+			LastModificationTime: info.ModTime(),
+		}
+		if !info.IsDir() {
+			entry.Size = info.Size()
+		}
+
+		if !o.matches(entry) {
+			return nil
+		}
+
+		err = found(entry)
+		if err != nil {
+			return err
+		}
+
+		count++
+		if o.Limit > 0 && count >= o.Limit {
+			return errSearchLimitReached
+		}
+		return nil
+	})
+
+	if err == errSearchLimitReached {
+		return true, nil
+	}
+	if err == ctx.Err() {
+		return false, nil
+	}
+	return false, err
+}
+
+// The results of a search, when not streamed
+type SearchResponse struct {
+	// The search that was done
+	Options SearchOptions `json:"-" xml:"-"`
+	// The entries that was found
+	Results []DirectoryEntry `json:"results" xml:"results"`
+	// True if there are more results than shown
+	LimitReached bool `json:"limit_reached" xml:"limit_reached"`
+	// The path prefix of every link to gfs
+	BasePath string `json:"-" xml:"-"`
+}
+
+type SearchHandler struct {
+	responseHandler
+	config       *Config
+	htmlTemplate *template.Template
+}
+
+func GetSearchHandler(config *Config) (h *SearchHandler, err error) {
+	t := template.New("Search Response Html Template")
+	t, err = t.Parse(SearchResponseHtml)
+	if err != nil {
+		return nil, err
+	}
+	h = &SearchHandler{
+		config:       config,
+		htmlTemplate: t,
+	}
+
+	return h, nil
+}
+
+// Searches for files, and streams the results to the response as they are found.
+// Returns any errors that happens before the response is started.
+func (h *SearchHandler) Handle(writer http.ResponseWriter, request *http.Request, format string) error {
+	options, err := parseSearchOptions(request.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	root := path.Join(h.config.Serve, options.Path)
+	directory, err := isDirectory(root)
+	if err != nil {
+		return err
+	}
+	if !directory {
+		return os.ErrNotExist
+	}
+
+	ctx := request.Context()
+	basePath := getBasePath(request)
+
+	switch format {
+	case FormatNdjson, FormatJson, FormatXml:
+		writer.Header().Set("content-type", format)
+		writer.WriteHeader(http.StatusOK)
+
+		stream := newSearchStream(writer, format)
+		var limitReached bool
+		limitReached, err = options.search(ctx, h.config.Serve, func(entry DirectoryEntry) error {
+			entry.Path = basePath + entry.Path
+			return stream.write(entry)
+		})
+		if err == nil {
+			err = stream.close(limitReached)
+		}
+	default:
+		response := SearchResponse{
+			Options:  options,
+			BasePath: basePath,
+		}
+		if options.Limit == 0 || options.Limit > maxHtmlSearchResults {
+			options.Limit = maxHtmlSearchResults
+		}
+
+		response.LimitReached, err = options.search(ctx, h.config.Serve, func(entry DirectoryEntry) error {
+			entry.Path = basePath + entry.Path
+			response.Results = append(response.Results, entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = h.responseHandler.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, response)
+	}
+
+	if err != nil {
+		slog.Error("Something went wrong when responding", "error", err)
+	}
+	return nil
+}
+
+// Writes search results as they are found
+type searchStream struct {
+	writer  io.Writer
+	flusher http.Flusher
+	format  string
+	count   int
+	json    *json.Encoder
+	xml     *xml.Encoder
+}
+
+func newSearchStream(writer http.ResponseWriter, format string) *searchStream {
+	s := &searchStream{
+		writer: writer,
+		format: format,
+		json:   json.NewEncoder(writer),
+		xml:    xml.NewEncoder(writer),
+	}
+	s.flusher, _ = writer.(http.Flusher)
+	return s
+}
+
+func (s *searchStream) write(entry DirectoryEntry) (err error) {
+	switch s.format {
+	case FormatNdjson:
+		err = s.json.Encode(entry)
+	case FormatJson:
+		separator := ","
+		if s.count == 0 {
+			separator = `{"results":[`
+		}
+		_, err = io.WriteString(s.writer, separator)
+		if err == nil {
+			err = s.json.Encode(entry)
+		}
+	case FormatXml:
+		if s.count == 0 {
+			err = s.xml.EncodeToken(xml.StartElement{Name: xml.Name{Local: "SearchResponse"}})
+		}
+		if err == nil {
+			err = s.xml.EncodeElement(entry, xml.StartElement{Name: xml.Name{Local: "results"}})
+		}
+		if err == nil {
+			err = s.xml.Flush()
+		}
+	}
+	s.count++
+
+	if err == nil && s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return err
+}
+
+// Ends the stream. limitReached tells if there are more results than was written.
+func (s *searchStream) close(limitReached bool) error {
+	switch s.format {
+	case FormatJson:
+		if s.count == 0 {
+			_, err := io.WriteString(s.writer, `{"results":[`)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(s.writer, "],\"limit_reached\":%t}\n", limitReached)
+		return err
+	case FormatXml:
+		if s.count == 0 {
+			err := s.xml.EncodeToken(xml.StartElement{Name: xml.Name{Local: "SearchResponse"}})
+			if err != nil {
+				return err
+			}
+		}
+		err := s.xml.EncodeElement(limitReached, xml.StartElement{Name: xml.Name{Local: "limit_reached"}})
+		if err == nil {
+			err = s.xml.EncodeToken(xml.EndElement{Name: xml.Name{Local: "SearchResponse"}})
+		}
+		if err == nil {
+			err = s.xml.Flush()
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package gfs
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchHandler(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-search")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	a.NoError(os.MkdirAll(filepath.Join(dir, "nightly", "2017-07-02"), os.ModePerm))
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, "nightly", "2017-07-02", "build.zip"), make([]byte, 100), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, "nightly", "2017-07-02", "build.log"), make([]byte, 10), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, "nightly", stagingFilePrefix+"build.zip"), make([]byte, 100), 0644))
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, "readme.zip"), make([]byte, 1), 0644))
+
+	h, err := GetSearchHandler(&Config{Serve: dir})
+	if !a.NoError(err) {
+		return
+	}
+
+	search := func(query, format string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		err := h.Handle(recorder, httptest.NewRequest("GET", "/search?"+query, nil), format)
+		a.NoError(err)
+		return recorder
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		a := assert.New(t)
+
+		var response SearchResponse
+		err := json.NewDecoder(search("path=/nightly&name=*.zip", FormatJson).Body).Decode(&response)
+		if a.NoError(err) && a.Len(response.Results, 1) {
+			a.Equal("/nightly/2017-07-02/build.zip", response.Results[0].Path)
+			a.False(response.LimitReached)
+		}
+	})
+
+	t.Run("XML", func(t *testing.T) {
+		a := assert.New(t)
+
+		var response SearchResponse
+		err := xml.NewDecoder(search("minSize=10&maxSize=10", FormatXml).Body).Decode(&response)
+		if a.NoError(err) && a.Len(response.Results, 1) {
+			a.Equal("/nightly/2017-07-02/build.log", response.Results[0].Path)
+		}
+	})
+
+	t.Run("NDJSON", func(t *testing.T) {
+		a := assert.New(t)
+
+		decoder := json.NewDecoder(search("regex=^/nightly/.*&only=dirs", FormatNdjson).Body)
+		var entry DirectoryEntry
+		if a.NoError(decoder.Decode(&entry)) {
+			a.Equal("/nightly/2017-07-02", entry.Path)
+			a.True(entry.IsDirectory)
+		}
+		a.False(decoder.More())
+	})
+
+	t.Run("Unreadable directory", func(t *testing.T) {
+		a := assert.New(t)
+
+		if os.Geteuid() == 0 {
+			t.Skip("Permissions doesn't apply to root")
+		}
+		private := filepath.Join(dir, "private")
+		a.NoError(os.MkdirAll(private, os.ModePerm))
+		a.NoError(ioutil.WriteFile(filepath.Join(private, "secret.zip"), make([]byte, 1), 0644))
+		a.NoError(os.Chmod(private, 0000))
+		defer os.Chmod(private, os.ModePerm)
+
+		var response SearchResponse
+		err := json.NewDecoder(search("name=*.zip", FormatJson).Body).Decode(&response)
+		if a.NoError(err, "The response should still be a valid document") {
+			a.Len(response.Results, 2)
+		}
+	})
+
+	t.Run("Invalid options", func(t *testing.T) {
+		a := assert.New(t)
+
+		err := h.Handle(httptest.NewRecorder(), httptest.NewRequest("GET", "/search?regex=(", nil), FormatJson)
+		a.Equal(ErrInvalidSearchRegex, err)
+
+		err = h.Handle(httptest.NewRecorder(), httptest.NewRequest("GET", "/search?name=[a-", nil), FormatJson)
+		a.Equal(ErrInvalidSearchName, err, "A broken pattern should not silently match nothing")
+	})
+}
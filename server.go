@@ -1,44 +1,242 @@
 package gfs
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
+	"time"
 )
 
 const (
 	// The running version of GFS
 	GFSVersion string = "0.0.4"
+	// How long requests are given to finish when gfs is stopped
+	shutdownTimeout time.Duration = 30 * time.Second
 )
 
 func RunServer(config *Config) {
 	go checkForUpdates() // Check for updates on startup
 
-	handlerFunc, err := getHandler(config)
+	err := SetupTracing(config)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	http.HandleFunc("/", handlerFunc)
 
-	loginHandlerFunc, err := getLoginHandler(config, handlerFunc)
+	throttler := NewThrottler(config.Bandwidth)
+
+	quotas, err := NewQuotaTracker(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go quotas.rescanPeriodically()
+
+	expiry, err := NewExpiryTracker(config, quotas)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go expiry.run()
+
+	metrics := NewMetrics(quotas)
+	accessLog, err := NewAccessLogger(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	audit, err := NewAuditLog(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	handlerFunc, err := getHandler(config, throttler, expiry, metrics, audit)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/", accessLog.wrap(traceRequests("/", metrics.instrument("directory", handlerFunc))))
+
+	// Probes are frequent and uninteresting, so they are kept out of the access log and metrics
+	healthHandlerFunc, err := getHealthHandlerFunc(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/healthz", healthHandlerFunc)
+	http.HandleFunc("/readyz", healthHandlerFunc)
+	http.HandleFunc("/version", healthHandlerFunc)
+
+	loginHandlerFunc, err := getLoginHandler(config, handlerFunc, audit)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/login", accessLog.wrap(traceRequests("/login", metrics.instrument("login", loginHandlerFunc))))
+
+	if config.Oidc.Enabled {
+		oidcHandlerFunc, err := getOidcHandlerFunc(config, audit)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		http.HandleFunc("/oidc/login", accessLog.wrap(traceRequests("/oidc/login", metrics.instrument("login", oidcHandlerFunc))))
+		http.HandleFunc("/oidc/callback", accessLog.wrap(traceRequests("/oidc/callback", metrics.instrument("login", oidcHandlerFunc))))
+	}
+
+	if len(config.Retention.Rules) > 0 {
+		janitor, err := NewJanitor(config, quotas)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go janitor.run()
+	}
+
+	var index *ContentIndex
+	if config.ContentIndex.Enabled {
+		index, err = NewContentIndex(config, expiry)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		expiry.setIndex(index)
+		go index.run()
+	}
+
+	events := NewEventBus()
+	err = startWatching(config.Serve, events)
+	if err != nil {
+		slog.Warn("Unable to watch the serve path for changes, only changes done through gfs will be published", "error", err)
+	}
+
+	if len(config.Webhooks) > 0 {
+		webhooks, err := NewWebhookDispatcher(config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go webhooks.run(events)
+	}
+
+	eventsHandlerFunc, err := getEventsHandlerFunc(config, events)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/events", accessLog.wrap(eventsHandlerFunc))
+
+	hooks, err := NewUploadHooks(config.Hooks)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	http.HandleFunc("/login", loginHandlerFunc)
 
-	uploadHandlerFunc, err := getUploadHandlerFunc(config, handlerFunc)
+	uploadHandlerFunc, err := getUploadHandlerFunc(config, handlerFunc, quotas, throttler, index, events, hooks, expiry, audit)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	http.HandleFunc("/upload", uploadHandlerFunc)
+	http.HandleFunc("/upload", accessLog.wrap(traceRequests("/upload", metrics.instrument("upload", uploadHandlerFunc))))
 
-	log.Fatal(http.ListenAndServe(":"+config.Port, nil))
+	usageHandlerFunc, err := getUsageHandlerFunc(config, handlerFunc, quotas)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/usage", accessLog.wrap(traceRequests("/usage", metrics.instrument("usage", usageHandlerFunc))))
+
+	searchHandlerFunc, err := getSearchHandlerFunc(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/search", accessLog.wrap(traceRequests("/search", metrics.instrument("search", searchHandlerFunc))))
+
+	contentSearchHandlerFunc, err := getContentSearchHandlerFunc(config, index)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/search/content", accessLog.wrap(traceRequests("/search/content", metrics.instrument("content_search", contentSearchHandlerFunc))))
+	http.HandleFunc("/search/content/rebuild", accessLog.wrap(traceRequests("/search/content/rebuild", metrics.instrument("content_search", contentSearchHandlerFunc))))
+
+	bandwidthHandlerFunc, err := getBandwidthHandlerFunc(config, throttler, audit)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	http.HandleFunc("/bandwidth", accessLog.wrap(traceRequests("/bandwidth", metrics.instrument("bandwidth", bandwidthHandlerFunc))))
+
+	if audit != nil {
+		auditHandlerFunc, err := getAuditHandlerFunc(config, audit)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		http.HandleFunc("/audit", accessLog.wrap(traceRequests("/audit", metrics.instrument("audit", auditHandlerFunc))))
+	}
+
+	if config.Metrics.Enabled {
+		metricsHandlerFunc, err := getMetricsHandlerFunc(config, metrics)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if config.Metrics.Address == "" {
+			http.HandleFunc("/metrics", metricsHandlerFunc)
+		} else {
+			// Kept off the normal port, so it can be bound to an internal interface
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", metricsHandlerFunc)
+			go func() {
+				log.Fatal(http.ListenAndServe(config.Metrics.Address, mux))
+			}()
+		}
+	}
+
+	err = serve(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
 
-func getHandler(config *Config) (f http.HandlerFunc, err error) {
+// Serves requests on every listener until gfs is told to stop
+func serve(config *Config) error {
+	handler, err := getProxyHandler(config, http.DefaultServeMux)
+	if err != nil {
+		return err
+	}
+	listeners, err := getListeners(config)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	notifier := NewSystemdNotifier()
+	notifier.Ready()
+	go notifier.runWatchdog()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		notifier.Stopping()
+		server.Close()
+		return err
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+		notifier.Stopping()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err == context.DeadlineExceeded {
+			// Event streams are never idle, so they are cut off
+			return server.Close()
+		}
+		return err
+	}
+}
+
+func getHandler(config *Config, throttler *Throttler, expiry *ExpiryTracker, metrics *Metrics, audit *AuditLog) (f http.HandlerFunc, err error) {
 
 	notFoundHandler, err := GetNotFoundHandler()
 	if err != nil {
@@ -56,7 +254,7 @@ func getHandler(config *Config) (f http.HandlerFunc, err error) {
 	if err != nil {
 		return nil, err
 	}
-	fileResponserHandler, err := GetFileResponseHandler()
+	fileResponserHandler, err := GetFileResponseHandler(throttler, expiry, metrics)
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +262,10 @@ func getHandler(config *Config) (f http.HandlerFunc, err error) {
 	if err != nil {
 		return nil, err
 	}
+	checksumHandler, err := GetChecksumHandler()
+	if err != nil {
+		return nil, err
+	}
 
 	f = func(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Set("gfs-version", GFSVersion)
@@ -71,12 +273,12 @@ func getHandler(config *Config) (f http.HandlerFunc, err error) {
 
 		if request.Method == "GET" {
 			authorized := false
-			err := authorizationHandler.CheckAuthenticated(request)
+			user, err := authorizationHandler.GetAuthenticatedUser(request)
 			if err == nil {
 				authorized = true
 			}
 			if config.LoginRequiredForRead && !authorized {
-				log.Println("authentication error", err)
+				slog.Debug("Authentication failed", "error", err)
 				clientErrorHandler.Handle(writer, errors.New("Not authenticated"), responseFormat, http.StatusUnauthorized)
 				return
 			}
@@ -90,22 +292,64 @@ func getHandler(config *Config) (f http.HandlerFunc, err error) {
 					notFoundHandler.Handle(writer, p, responseFormat)
 					return
 				}
-				log.Println("Error when detecting directory", err)
+				slog.Error("Error when detecting directory", "path", p, "error", err)
 				internalServerErrorHandler.Handle(writer, err, responseFormat)
 				return
 			}
 
 			if directory {
-				stats, err := GetDirectoryStats(fullpath, p)
+				if algorithm := request.URL.Query().Get("checksums"); algorithm != "" {
+					_, span := startSpan(request.Context(), "storage.checksums", attribute.String("file.path", p), attribute.String("checksum.algorithm", algorithm))
+					err := checksumHandler.Handle(writer, fullpath, algorithm)
+					endSpan(span, err)
+					if err == ErrUnknownChecksumAlgorithm {
+						clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+					} else if err != nil {
+						slog.Error("Something went wrong when writing checksums", "path", p, "error", err)
+						internalServerErrorHandler.Handle(writer, err, responseFormat)
+					}
+					return
+				}
+
+				options, err := parseListingOptions(request.URL.Query())
+				if err != nil {
+					clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+					return
+				}
+
+				_, span := startSpan(request.Context(), "storage.list", attribute.String("file.path", p))
+				stats, err := GetDirectoryStats(fullpath, p, options)
+				endSpan(span, err)
+				if err == ErrInvalidCursor {
+					clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+					return
+				}
 				if err != nil {
 					internalServerErrorHandler.Handle(writer, err, responseFormat)
+					return
+				}
+				for i, entry := range stats.Entries {
+					stats.Entries[i].ExpiresAt = expiry.getExpiryTime(entry.Path, entry.LastModificationTime)
 				}
 				stats.Authorized = authorized
-				directoryResponseHandler.Handle(writer, stats, responseFormat)
+				stats.OidcLogin = config.Oidc.Enabled
+				directoryResponseHandler.Handle(writer, stats.withBasePath(getBasePath(request)), responseFormat)
 			} else {
-				err := fileResponserHandler.Handle(writer, fullpath, p, responseFormat)
+				setMetricsHandler(writer, "file")
+				ctx, span := startSpan(request.Context(), "storage.read", attribute.String("file.path", p))
+				err := fileResponserHandler.Handle(ctx, writer, fullpath, p, getBasePath(request), responseFormat, user)
+				endSpan(span, err)
+				if err == ErrFileExpired {
+					notFoundHandler.Handle(writer, p, responseFormat)
+					return
+				}
 				if err != nil {
-					log.Println("Something went wrong when serving file:", err.Error())
+					slog.Error("Something went wrong when serving file", "path", p, "error", err)
+					return
+				}
+				// Only downloads of files that are protected by a login are interesting
+				if config.LoginRequiredForRead {
+					audit.RecordRequest(request, AuditEntry{Action: AuditDownload, User: user, Path: p})
 				}
 			}
 			return
@@ -116,7 +360,7 @@ func getHandler(config *Config) (f http.HandlerFunc, err error) {
 	return f, nil
 }
 
-func getLoginHandler(config *Config, defaultHandler http.HandlerFunc) (http.HandlerFunc, error) {
+func getLoginHandler(config *Config, defaultHandler http.HandlerFunc, audit *AuditLog) (http.HandlerFunc, error) {
 	authorizationHandler, err := GetAuthorizationHandler(config)
 	if err != nil {
 		return nil, err
@@ -129,11 +373,15 @@ func getLoginHandler(config *Config, defaultHandler http.HandlerFunc) (http.Hand
 
 			responseFormat := getResponseFormat(request)
 
-			err := authorizationHandler.Login(writer, request, responseFormat)
+			user, tokenID, err := authorizationHandler.Login(writer, request, responseFormat)
+			span := trace.SpanFromContext(request.Context())
+			span.SetAttributes(attribute.String("enduser.id", user), attribute.Bool("login.succeeded", err == nil))
 			if err != nil {
-				log.Println("Something went wrong during authentication", err)
+				slog.Warn("Login failed", "user", user, "remote", getRemoteHost(request), "error", err)
+				audit.RecordRequest(request, AuditEntry{Action: AuditLoginFailed, User: user, Details: err.Error()})
 			} else {
-				log.Println("Login successful")
+				slog.Info("Login successful", "user", user)
+				audit.RecordRequest(request, AuditEntry{Action: AuditLogin, User: user, TokenID: tokenID})
 			}
 		} else {
 			defaultHandler(writer, request)
@@ -143,12 +391,53 @@ func getLoginHandler(config *Config, defaultHandler http.HandlerFunc) (http.Hand
 	return f, nil
 }
 
-func getUploadHandlerFunc(config *Config, defaultHandler http.HandlerFunc) (http.HandlerFunc, error) {
+func getOidcHandlerFunc(config *Config, audit *AuditLog) (http.HandlerFunc, error) {
+	oidcHandler := GetOidcHandler(config)
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		responseFormat := getResponseFormat(request)
+
+		if request.Method != "GET" {
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if request.URL.Path == "/oidc/login" {
+			err := oidcHandler.Login(writer, request)
+			if err != nil {
+				slog.Error("Unable to start OpenID Connect login", "error", err)
+				clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadGateway)
+			}
+			return
+		}
+
+		user, tokenID, err := oidcHandler.Callback(writer, request)
+		span := trace.SpanFromContext(request.Context())
+		span.SetAttributes(attribute.String("enduser.id", user), attribute.Bool("login.succeeded", err == nil))
+		if err != nil {
+			slog.Warn("Login failed", "user", user, "remote", getRemoteHost(request), "error", err)
+			audit.RecordRequest(request, AuditEntry{Action: AuditLoginFailed, User: user, Details: err.Error()})
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusUnauthorized)
+			return
+		}
+		slog.Info("Login successful", "user", user)
+		audit.RecordRequest(request, AuditEntry{Action: AuditLogin, User: user, TokenID: tokenID, Details: "OpenID Connect"})
+	}
+
+	return f, nil
+}
+
+func getUploadHandlerFunc(config *Config, defaultHandler http.HandlerFunc, quotas *QuotaTracker, throttler *Throttler, index *ContentIndex, events *EventBus, hooks *UploadHooks, expiry *ExpiryTracker, audit *AuditLog) (http.HandlerFunc, error) {
 	authorizationHandler, err := GetAuthorizationHandler(config)
 	if err != nil {
 		return nil, err
 	}
-	uploadHandler, err := GetUploadHandler(config)
+	uploadHandler, err := GetUploadHandler(config, quotas, throttler, index, events, hooks, expiry, audit)
 	if err != nil {
 		return nil, err
 	}
@@ -166,14 +455,18 @@ func getUploadHandlerFunc(config *Config, defaultHandler http.HandlerFunc) (http
 		if request.Method == "POST" {
 			responseFormat := getResponseFormat(request)
 
-			err := authorizationHandler.CheckAuthenticated(request)
+			user, err := authorizationHandler.GetAuthenticatedUser(request)
 			if err != nil {
 				clientErrorHandler.Handle(writer, err, responseFormat, http.StatusUnauthorized)
 				return
 			}
 
-			err = uploadHandler.Handle(writer, request, responseFormat)
+			err = uploadHandler.Handle(writer, request, responseFormat, user)
 			if err != nil {
+				if isUploadTooLarge(err) {
+					clientErrorHandler.Handle(writer, err, responseFormat, http.StatusRequestEntityTooLarge)
+					return
+				}
 				if IsClientError(err) {
 					clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
 					return
@@ -189,6 +482,379 @@ func getUploadHandlerFunc(config *Config, defaultHandler http.HandlerFunc) (http
 	return f, nil
 }
 
+func getUsageHandlerFunc(config *Config, defaultHandler http.HandlerFunc, quotas *QuotaTracker) (http.HandlerFunc, error) {
+	authorizationHandler, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	usageHandler, err := GetUsageHandler(quotas)
+	if err != nil {
+		return nil, err
+	}
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		if request.Method == "GET" {
+			responseFormat := getResponseFormat(request)
+
+			user, err := authorizationHandler.GetAuthenticatedUser(request)
+			if err != nil {
+				clientErrorHandler.Handle(writer, err, responseFormat, http.StatusUnauthorized)
+				return
+			}
+
+			usageHandler.Handle(writer, user, responseFormat)
+		} else {
+			defaultHandler(writer, request)
+		}
+	}
+
+	return f, nil
+}
+
+func getSearchHandlerFunc(config *Config) (http.HandlerFunc, error) {
+	authorizationHandler, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	searchHandler, err := GetSearchHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	notFoundHandler, err := GetNotFoundHandler()
+	if err != nil {
+		return nil, err
+	}
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+	internalServerErrorHandler, err := GetInternalServerErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		responseFormat := getResponseFormat(request)
+
+		if request.Method != "GET" {
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if config.LoginRequiredForRead {
+			err := authorizationHandler.CheckAuthenticated(request)
+			if err != nil {
+				slog.Debug("Authentication failed", "error", err)
+				clientErrorHandler.Handle(writer, errors.New("Not authenticated"), responseFormat, http.StatusUnauthorized)
+				return
+			}
+		}
+
+		err := searchHandler.Handle(writer, request, responseFormat)
+		if err != nil {
+			if os.IsNotExist(err) {
+				notFoundHandler.Handle(writer, request.URL.Query().Get("path"), responseFormat)
+				return
+			}
+			if isSearchClientError(err) {
+				clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+				return
+			}
+			internalServerErrorHandler.Handle(writer, err, responseFormat)
+		}
+	}
+
+	return f, nil
+}
+
+func getContentSearchHandlerFunc(config *Config, index *ContentIndex) (http.HandlerFunc, error) {
+	authorizationHandler, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	contentSearchHandler, err := GetContentSearchHandler(index)
+	if err != nil {
+		return nil, err
+	}
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+	internalServerErrorHandler, err := GetInternalServerErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		responseFormat := getResponseFormat(request)
+
+		var err error
+		if request.URL.Path == "/search/content/rebuild" && request.Method == "POST" {
+			err = authorizationHandler.CheckAuthenticated(request)
+			if err != nil {
+				clientErrorHandler.Handle(writer, err, responseFormat, http.StatusUnauthorized)
+				return
+			}
+			if !authorizationHandler.IsAdmin(request) {
+				clientErrorHandler.Handle(writer, ErrNotAdmin, responseFormat, http.StatusForbidden)
+				return
+			}
+
+			err = contentSearchHandler.Rebuild(writer)
+		} else if request.URL.Path == "/search/content" && request.Method == "GET" {
+			if config.LoginRequiredForRead {
+				err = authorizationHandler.CheckAuthenticated(request)
+				if err != nil {
+					slog.Debug("Authentication failed", "error", err)
+					clientErrorHandler.Handle(writer, errors.New("Not authenticated"), responseFormat, http.StatusUnauthorized)
+					return
+				}
+			}
+
+			err = contentSearchHandler.Handle(writer, request, responseFormat)
+		} else {
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch err {
+		case nil:
+		case ErrContentIndexDisabled:
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusNotFound)
+		case ErrNoSearchQuery, ErrInvalidLimit:
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+		case ErrContentIndexRebuilding:
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusConflict)
+		default:
+			internalServerErrorHandler.Handle(writer, err, responseFormat)
+		}
+	}
+
+	return f, nil
+}
+
+func getEventsHandlerFunc(config *Config, events *EventBus) (http.HandlerFunc, error) {
+	authorizationHandler, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	eventsHandler, err := GetEventsHandler(events)
+	if err != nil {
+		return nil, err
+	}
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+	internalServerErrorHandler, err := GetInternalServerErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		responseFormat := getResponseFormat(request)
+
+		if request.Method != "GET" {
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if config.LoginRequiredForRead {
+			err := authorizationHandler.CheckAuthenticated(request)
+			if err != nil {
+				slog.Debug("Authentication failed", "error", err)
+				clientErrorHandler.Handle(writer, errors.New("Not authenticated"), responseFormat, http.StatusUnauthorized)
+				return
+			}
+		}
+
+		err := eventsHandler.Handle(writer, request)
+		switch err {
+		case nil:
+		case ErrInvalidEventID, ErrInvalidWebSocketRequest:
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+		case ErrWebSocketCrossOrigin:
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusForbidden)
+		default:
+			internalServerErrorHandler.Handle(writer, err, responseFormat)
+		}
+	}
+
+	return f, nil
+}
+
+func getBandwidthHandlerFunc(config *Config, throttler *Throttler, audit *AuditLog) (http.HandlerFunc, error) {
+	authorizationHandler, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	bandwidthHandler, err := GetBandwidthHandler(throttler)
+	if err != nil {
+		return nil, err
+	}
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		responseFormat := getResponseFormat(request)
+
+		user, err := authorizationHandler.GetAuthenticatedUser(request)
+		if err != nil {
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusUnauthorized)
+			return
+		}
+
+		switch request.Method {
+		case "GET":
+			bandwidthHandler.Handle(writer, request, responseFormat)
+		case "POST":
+			if !authorizationHandler.IsAdmin(request) {
+				clientErrorHandler.Handle(writer, ErrNotAdmin, responseFormat, http.StatusForbidden)
+				return
+			}
+			err := bandwidthHandler.Update(writer, request, responseFormat)
+			if err != nil {
+				clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+				return
+			}
+			limits, _ := json.Marshal(throttler.Limits())
+			audit.RecordRequest(request, AuditEntry{Action: AuditConfigChange, User: user, Details: "Bandwidth limits changed to " + string(limits)})
+		default:
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+		}
+	}
+
+	return f, nil
+}
+
+func getHealthHandlerFunc(config *Config) (http.HandlerFunc, error) {
+	healthHandler, err := GetHealthHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	versionHandler, err := GetVersionHandler()
+	if err != nil {
+		return nil, err
+	}
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		writer.Header().Set("Cache-Control", "no-store")
+		responseFormat := getResponseFormat(request)
+
+		if request.Method != "GET" && request.Method != "HEAD" {
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch request.URL.Path {
+		case "/healthz":
+			healthHandler.HandleLiveness(writer, responseFormat)
+		case "/readyz":
+			healthHandler.HandleReadiness(writer, responseFormat)
+		case "/version":
+			versionHandler.Handle(writer, responseFormat)
+		}
+	}
+
+	return f, nil
+}
+
+func getAuditHandlerFunc(config *Config, audit *AuditLog) (http.HandlerFunc, error) {
+	authorizationHandler, err := GetAuthorizationHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	auditHandler, err := GetAuditHandler(audit)
+	if err != nil {
+		return nil, err
+	}
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+	internalServerErrorHandler, err := GetInternalServerErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		responseFormat := getResponseFormat(request)
+
+		_, err := authorizationHandler.GetAuthenticatedUser(request)
+		if err != nil {
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusUnauthorized)
+			return
+		}
+		if !authorizationHandler.IsAdmin(request) {
+			clientErrorHandler.Handle(writer, ErrNotAdmin, responseFormat, http.StatusForbidden)
+			return
+		}
+
+		if request.Method != "GET" {
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+			return
+		}
+
+		err = auditHandler.Handle(writer, request, responseFormat)
+		if err == ErrInvalidAuditQuery {
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusBadRequest)
+		} else if err != nil {
+			slog.Error("Something went wrong when querying the audit log", "error", err)
+			internalServerErrorHandler.Handle(writer, err, responseFormat)
+		}
+	}
+
+	return f, nil
+}
+
+func getMetricsHandlerFunc(config *Config, metrics *Metrics) (http.HandlerFunc, error) {
+	clientErrorHandler, err := GetClientErrorHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("gfs-version", GFSVersion)
+		responseFormat := getResponseFormat(request)
+
+		err := config.Metrics.checkToken(request)
+		if err != nil {
+			clientErrorHandler.Handle(writer, err, responseFormat, http.StatusUnauthorized)
+			return
+		}
+
+		if request.Method != "GET" {
+			clientErrorHandler.Handle(writer, errors.New(fmt.Sprintf("Unsupported method: '%s'", request.Method)), responseFormat, http.StatusMethodNotAllowed)
+			return
+		}
+
+		writer.Header().Set("Content-Type", FormatPrometheus)
+		err = metrics.write(writer)
+		if err != nil {
+			slog.Error("Something went wrong when writing metrics", "error", err)
+		}
+	}
+
+	return f, nil
+}
+
 // Returns true if the given error was an error on the clients side
 func IsClientError(err error) bool {
 	return isUploadClientError(err)
@@ -0,0 +1,81 @@
+package gfs
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tells systemd about the state of gfs, when it runs as a Type=notify service.
+// Does nothing if gfs wasn't started by systemd.
+type SystemdNotifier struct {
+	socket string
+	// How often systemd expects to hear from gfs, or 0 if the watchdog is disabled
+	watchdog time.Duration
+}
+
+// Creates the notifier from the environment systemd started gfs with
+func NewSystemdNotifier() *SystemdNotifier {
+	n := &SystemdNotifier{socket: os.Getenv("NOTIFY_SOCKET")}
+
+	// The watchdog might be meant for a parent process
+	pid := os.Getenv("WATCHDOG_PID")
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+// Sends the state to systemd, e.g. "READY=1"
+func (n *SystemdNotifier) Notify(state string) error {
+	if n.socket == "" {
+		return nil
+	}
+
+	address := n.socket
+	// Abstract sockets are given with @ instead of a leading null byte
+	if address[0] == '@' {
+		address = "\x00" + address[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Tells systemd that gfs has started and is serving requests
+func (n *SystemdNotifier) Ready() {
+	err := n.Notify("READY=1")
+	if err != nil {
+		slog.Warn("Unable to notify systemd", "error", err)
+	}
+}
+
+// Tells systemd that gfs is shutting down
+func (n *SystemdNotifier) Stopping() {
+	err := n.Notify("STOPPING=1")
+	if err != nil {
+		slog.Warn("Unable to notify systemd", "error", err)
+	}
+}
+
+// Keeps the systemd watchdog happy until the program stops. Pings are sent twice
+// as often as required, so a single late ping doesn't get gfs restarted.
+func (n *SystemdNotifier) runWatchdog() {
+	if n.watchdog <= 0 {
+		return
+	}
+	for {
+		err := n.Notify("WATCHDOG=1")
+		if err != nil {
+			slog.Warn("Unable to ping the systemd watchdog", "error", err)
+		}
+		time.Sleep(n.watchdog / 2)
+	}
+}
@@ -0,0 +1,244 @@
+package gfs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// The max number of bytes transferred before waiting for the buckets,
+	// to keep throttled transfers smooth
+	maxThrottleChunkSize int = 16 << 10
+)
+
+// Bandwidth limits in bytes per second. A zero value means unlimited.
+type BandwidthLimits struct {
+	// Limit for all downloads combined
+	Download int64 `json:"download" xml:"download"`
+	// Limit for each individual download
+	DownloadPerConnection int64 `json:"downloadPerConnection" xml:"downloadPerConnection"`
+	// Limit for all uploads combined
+	Upload int64 `json:"upload" xml:"upload"`
+	// Limit for each individual upload
+	UploadPerConnection int64 `json:"uploadPerConnection" xml:"uploadPerConnection"`
+	// Limits for specific users
+	Users []UserBandwidthLimits `json:"users" xml:"users"`
+}
+
+// Bandwidth limits in bytes per second for all transfers of a specific user combined.
+// A zero value means unlimited.
+type UserBandwidthLimits struct {
+	Username string `json:"username" xml:"username"`
+	Download int64  `json:"download" xml:"download"`
+	Upload   int64  `json:"upload" xml:"upload"`
+}
+
+// A token bucket that refills with the given rate. The bucket can hold at most
+// one second worth of tokens.
+type tokenBucket struct {
+	lock sync.Mutex
+	// Gets the current rate in bytes per second. Checked on every wait, so
+	// changes to the rate takes effect immediately.
+	rate   func() int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate func() int64) *tokenBucket {
+	return &tokenBucket{
+		rate: rate,
+	}
+}
+
+// Takes n tokens from the bucket, waiting until they are available. Stops
+// waiting if the context is cancelled, like when the client disconnects.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	rate := float64(b.rate())
+	if rate <= 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// The buckets limiting a single user
+type userBuckets struct {
+	download *tokenBucket
+	upload   *tokenBucket
+}
+
+// Limits the bandwidth used by uploads and downloads. The limits can be
+// changed while running, and also affects transfers that are in progress.
+type Throttler struct {
+	lock     sync.RWMutex
+	limits   BandwidthLimits
+	download *tokenBucket
+	upload   *tokenBucket
+	users    map[string]*userBuckets
+}
+
+func NewThrottler(limits BandwidthLimits) *Throttler {
+	t := &Throttler{
+		limits: limits,
+		users:  make(map[string]*userBuckets),
+	}
+	t.download = newTokenBucket(func() int64 {
+		return t.Limits().Download
+	})
+	t.upload = newTokenBucket(func() int64 {
+		return t.Limits().Upload
+	})
+	return t
+}
+
+// Gets the current limits
+func (t *Throttler) Limits() BandwidthLimits {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.limits
+}
+
+// Changes the limits
+func (t *Throttler) SetLimits(limits BandwidthLimits) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.limits = limits
+}
+
+// Gets the limits of the given user
+func (t *Throttler) userLimits(user string) UserBandwidthLimits {
+	for _, limits := range t.Limits().Users {
+		if limits.Username == user {
+			return limits
+		}
+	}
+	return UserBandwidthLimits{Username: user}
+}
+
+// Gets the buckets shared by all transfers of the given user
+func (t *Throttler) getUserBuckets(user string) *userBuckets {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	buckets, ok := t.users[user]
+	if !ok {
+		buckets = &userBuckets{
+			download: newTokenBucket(func() int64 {
+				return t.userLimits(user).Download
+			}),
+			upload: newTokenBucket(func() int64 {
+				return t.userLimits(user).Upload
+			}),
+		}
+		t.users[user] = buckets
+	}
+	return buckets
+}
+
+// Wraps the reader of an upload done by the given user. Reading fails once the
+// context is cancelled.
+func (t *Throttler) Reader(ctx context.Context, reader io.Reader, user string) io.Reader {
+	perConnection := newTokenBucket(func() int64 {
+		return t.Limits().UploadPerConnection
+	})
+
+	return &throttledReader{
+		ctx:     ctx,
+		reader:  reader,
+		buckets: []*tokenBucket{t.upload, t.getUserBuckets(user).upload, perConnection},
+	}
+}
+
+// Wraps the writer of a download done by the given user. Writing fails once the
+// context is cancelled.
+func (t *Throttler) Writer(ctx context.Context, writer io.Writer, user string) io.Writer {
+	perConnection := newTokenBucket(func() int64 {
+		return t.Limits().DownloadPerConnection
+	})
+
+	return &throttledWriter{
+		ctx:     ctx,
+		writer:  writer,
+		buckets: []*tokenBucket{t.download, t.getUserBuckets(user).download, perConnection},
+	}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	buckets []*tokenBucket
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > maxThrottleChunkSize {
+		p = p[:maxThrottleChunkSize]
+	}
+
+	n, err := r.reader.Read(p)
+	for _, bucket := range r.buckets {
+		if waitErr := bucket.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	ctx     context.Context
+	writer  io.Writer
+	buckets []*tokenBucket
+}
+
+func (w *throttledWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxThrottleChunkSize {
+			chunk = chunk[:maxThrottleChunkSize]
+		}
+
+		for _, bucket := range w.buckets {
+			if err := bucket.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
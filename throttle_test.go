@@ -0,0 +1,51 @@
+package gfs
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestThrottler(t *testing.T) {
+	a := assert.New(t)
+
+	throttler := NewThrottler(BandwidthLimits{Upload: 100 << 10})
+	data := make([]byte, 150<<10)
+
+	start := time.Now()
+	read, err := ioutil.ReadAll(throttler.Reader(context.Background(), bytes.NewReader(data), "test"))
+	a.NoError(err)
+	a.Len(read, len(data))
+	// The first second worth of data is available right away
+	a.True(time.Since(start) >= 400*time.Millisecond, "Upload should have been throttled")
+
+	t.Run("Limits can be changed at runtime", func(t *testing.T) {
+		a := assert.New(t)
+
+		throttler.SetLimits(BandwidthLimits{})
+
+		start := time.Now()
+		var buf bytes.Buffer
+		_, err := throttler.Writer(context.Background(), &buf, "test").Write(data)
+		a.NoError(err)
+		a.Equal(len(data), buf.Len())
+		a.True(time.Since(start) < 100*time.Millisecond, "Download should not have been throttled")
+	})
+
+	t.Run("Stops waiting when cancelled", func(t *testing.T) {
+		a := assert.New(t)
+
+		throttler.SetLimits(BandwidthLimits{DownloadPerConnection: 1 << 10})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		var buf bytes.Buffer
+		_, err := throttler.Writer(ctx, &buf, "test").Write(data)
+		a.Equal(context.DeadlineExceeded, err)
+		a.True(time.Since(start) < time.Second, "The download should not keep waiting for the bucket")
+	})
+}
@@ -0,0 +1,195 @@
+package gfs
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+)
+
+// The supported trace exporters
+const (
+	TracingExporterOtlp   string = "otlp"
+	TracingExporterStdout string = "stdout"
+)
+
+const (
+	// The name spans are created under
+	tracerName string = "github.com/zlepper/gfs"
+	// The service name traces are reported with, unless configured otherwise
+	defaultTracingServiceName string = "gfs"
+)
+
+// Trace context is always sent and received in the W3C format, even if tracing isn't set up
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Settings for OpenTelemetry tracing
+type TracingConfig struct {
+	// Enables exporting traces. Trace context is propagated even when disabled
+	Enabled bool `json:"enabled"`
+	// Either otlp or stdout. Defaults to otlp
+	Exporter string `json:"exporter"`
+	// The url of the OTLP/HTTP collector, e.g. http://localhost:4318. Defaults to
+	// the standard OTEL_EXPORTER_OTLP_ENDPOINT environment variable
+	Endpoint string `json:"endpoint"`
+	// Headers sent to the collector, e.g. for authentication
+	Headers map[string]string `json:"headers"`
+	// The fraction of new traces that are sampled, between 0 and 1. Defaults to 1.
+	// Traces continued from a client keep the decision of the client
+	SampleRatio float64 `json:"sampleRatio"`
+	// The name gfs is reported as. Defaults to gfs
+	ServiceName string `json:"serviceName"`
+}
+
+func (c TracingConfig) getSampleRatio() float64 {
+	if c.SampleRatio > 0 {
+		return c.SampleRatio
+	}
+	return 1
+}
+
+func (c TracingConfig) getServiceName() string {
+	if c.ServiceName != "" {
+		return c.ServiceName
+	}
+	return defaultTracingServiceName
+}
+
+// Sets up exporting of traces, if enabled
+func SetupTracing(config *Config) error {
+	if !config.Tracing.Enabled {
+		return nil
+	}
+
+	exporter, err := newTraceExporter(config.Tracing)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(newTracerProvider(config.Tracing, sdktrace.WithBatcher(exporter)))
+	return nil
+}
+
+func newTraceExporter(config TracingConfig) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case "", TracingExporterOtlp:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		if len(config.Headers) > 0 {
+			options = append(options, otlptracehttp.WithHeaders(config.Headers))
+		}
+		return otlptracehttp.New(context.Background(), options...)
+	case TracingExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	return nil, fmt.Errorf("Invalid trace exporter '%s'. Valid exporters are: '%s' and '%s'", config.Exporter, TracingExporterOtlp, TracingExporterStdout)
+}
+
+// Creates a tracer provider sending spans to the given span processor
+func newTracerProvider(config TracingConfig, processor sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.getSampleRatio()))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", config.getServiceName()),
+			attribute.String("service.version", GFSVersion),
+		)),
+	)
+}
+
+// Gets the tracer from the current global provider, so replacing the provider takes effect
+func getTracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Wraps the handler, so every request gets a span. The trace started by the client
+// is continued, if it sent a trace context.
+func traceRequests(route string, f http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := tracePropagator.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := getTracer().Start(ctx, request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", request.URL.Path),
+				attribute.String("client.address", getRemoteHost(request)),
+				attribute.String("user_agent.original", request.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		// Only the status is needed, which the access log writer already keeps track of
+		w := &accessLogWriter{ResponseWriter: writer}
+		f(w, request.WithContext(ctx))
+
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", w.status))
+		if w.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(w.status))
+		}
+	}
+}
+
+// Starts a span for slow work done while handling a request, like reading or writing files
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return getTracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Ends the span, marking it as failed if there was an error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Sends the trace context of the requests along, so the server continues the trace
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx, span := getTracer().Start(request.Context(), request.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", request.Method),
+			attribute.String("url.full", request.URL.Redacted()),
+		),
+	)
+
+	// The request must not be modified, so the headers are added to a copy
+	request = request.Clone(ctx)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	response, err := base.RoundTrip(request)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	if response.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, response.Status)
+	}
+	// Streamed responses can outlive the span, but the time to the response is what matters
+	span.End()
+	return response, nil
+}
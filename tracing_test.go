@@ -0,0 +1,113 @@
+package gfs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Sends the spans to an in-memory exporter until the returned function is called
+func useTestTracer(t *testing.T) (*tracetest.InMemoryExporter, func()) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := newTracerProvider(TracingConfig{}, sdktrace.WithSyncer(exporter))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	return exporter, func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(previous)
+	}
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestTraceRequests(t *testing.T) {
+	a := assert.New(t)
+	exporter, done := useTestTracer(t)
+	defer done()
+
+	f := traceRequests("/", func(writer http.ResponseWriter, request *http.Request) {
+		_, span := startSpan(request.Context(), "storage.read")
+		endSpan(span, nil)
+		writer.WriteHeader(http.StatusNotFound)
+	})
+
+	request := httptest.NewRequest("GET", "/missing.txt", nil)
+	request.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	f(httptest.NewRecorder(), request)
+
+	spans := exporter.GetSpans()
+	server := findSpan(spans, "GET /")
+	storage := findSpan(spans, "storage.read")
+	if !a.NotNil(server) || !a.NotNil(storage) {
+		return
+	}
+	a.Equal("0af7651916cd43dd8448eb211c80319c", server.SpanContext.TraceID().String(), "The trace of the client should be continued")
+	a.Equal("b7ad6b7169203331", server.Parent.SpanID().String())
+	a.Equal(trace.SpanKindServer, server.SpanKind)
+	a.Equal(server.SpanContext.SpanID(), storage.Parent.SpanID())
+	a.Contains(server.Attributes, attribute.Int("http.response.status_code", http.StatusNotFound))
+}
+
+func TestUploadHandler_Tracing(t *testing.T) {
+	a := assert.New(t)
+	exporter, done := useTestTracer(t)
+	defer done()
+
+	h, cleanup := getTestUploadHandler(t)
+	defer cleanup()
+
+	ctx, span := startSpan(context.Background(), "test")
+	_, err := h.uploadFile(ctx, "test", "/traced.txt", strings.NewReader("traced"), -1, UploadExpiry{})
+	span.End()
+	a.NoError(err)
+
+	spans := exporter.GetSpans()
+	for _, name := range []string{"upload.receive", "upload.commit", "upload.scan", "upload.hooks"} {
+		s := findSpan(spans, name)
+		if a.NotNil(s, name) {
+			a.Equal(span.SpanContext().TraceID(), s.SpanContext.TraceID(), name)
+		}
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	a := assert.New(t)
+	exporter, done := useTestTracer(t)
+	defer done()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		traceparent = request.Header.Get("traceparent")
+		writer.Header().Set("content-type", FormatJson)
+		writer.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	client := &Client{url: u, client: http.Client{Transport: &tracingTransport{}}}
+
+	ctx, span := startSpan(context.Background(), "test")
+	_, err := client.WithContext(ctx).GetFileData("/file.txt")
+	span.End()
+	a.NoError(err)
+
+	a.Contains(traceparent, span.SpanContext().TraceID().String(), "The trace context should be sent to the server")
+	a.NotNil(findSpan(exporter.GetSpans(), "GET"))
+}
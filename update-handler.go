@@ -3,10 +3,46 @@ package gfs
 import (
 	"github.com/zlepper/gfs/internal"
 	ghc "github.com/zlepper/github-release-checker"
-	"log"
+	"log/slog"
+	"sync"
+	"time"
 )
 
-var hasUpdate string = ""
+// The result of checking github for a newer release
+type UpdateStatus struct {
+	// False until the check has completed
+	Checked bool `json:"checked" xml:"checked"`
+	// When the check completed
+	CheckedAt *time.Time `json:"checked_at,omitempty" xml:"checked_at,omitempty"`
+	// True if a newer release is available
+	Available bool `json:"available" xml:"available"`
+	// The url the newer release can be downloaded at
+	Url string `json:"url,omitempty" xml:"url,omitempty"`
+	// Why the check failed, if it did
+	Error string `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+var (
+	updateLock   sync.RWMutex
+	updateStatus UpdateStatus
+)
+
+// Gets the result of the last update check
+func getUpdateStatus() UpdateStatus {
+	updateLock.RLock()
+	defer updateLock.RUnlock()
+	return updateStatus
+}
+
+func setUpdateStatus(status UpdateStatus) {
+	now := time.Now()
+	status.Checked = true
+	status.CheckedAt = &now
+
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	updateStatus = status
+}
 
 func checkForUpdates() {
 	release, err := ghc.GetLatestReleaseForPlatform("zlepper", "gfs", internal.FilenameRegex, true)
@@ -14,16 +50,20 @@ func checkForUpdates() {
 		newer, err := ghc.IsNewer(release, GFSVersion)
 
 		if err != nil {
-			log.Println("Error when comparing update versions", err.Error())
+			slog.Warn("Error when comparing update versions", "error", err)
+			setUpdateStatus(UpdateStatus{Error: err.Error()})
+			return
 		}
 
 		if newer {
-			log.Printf("\n\nA newer GFS release is available on github. Download at:\n%s\n\n", release.DownloadUrl)
-			hasUpdate = release.DownloadUrl
+			slog.Info("A newer GFS release is available on github", "url", release.DownloadUrl)
+			setUpdateStatus(UpdateStatus{Available: true, Url: release.DownloadUrl})
 		} else {
-			log.Println("No new version available")
+			slog.Debug("No new version available")
+			setUpdateStatus(UpdateStatus{})
 		}
 	} else {
-		log.Println("Error when checking for updates:", err.Error())
+		slog.Warn("Error when checking for updates", "error", err)
+		setUpdateStatus(UpdateStatus{Error: err.Error()})
 	}
 }
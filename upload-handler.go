@@ -1,21 +1,77 @@
 package gfs
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"html/template"
 	"io"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
 type UploadHandler struct {
 	responseHandler
 	config             *Config
 	clientErrorHandler *ClientErrorHandler
+	quotas             *QuotaTracker
+	throttler          *Throttler
+	// nil if content indexing is disabled
+	index   *ContentIndex
+	events  *EventBus
+	hooks   *UploadHooks
+	scanner *Scanner
+	expiry  *ExpiryTracker
+	// nil if the audit log is disabled
+	audit *AuditLog
+	// The template used to respond to uploads from browsers
+	htmlTemplate *template.Template
 }
 
+const (
+	//language=html
+	UploadResponseHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>Upload to {{.Path}}</title>
+</head>
+<body>
+<h1>Upload to <a href="{{.Path}}">{{.Path}}</a></h1>
+<table>
+    <thead>
+        <tr>
+            <th>File</th>
+            <th>Size</th>
+            <th>Scan</th>
+            <th>Expires</th>
+        </tr>
+    </thead>
+    <tbody>
+		{{range .Files}}
+		<tr>
+			<td>{{.Path}}</td>
+			<td>{{.Size}}</td>
+			<td>{{with .Scan}}{{.Status}}{{with .Signature}}: {{.}}{{end}}{{if .Quarantined}} (quarantined){{end}}{{end}}</td>
+			<td>{{with .ExpiresAt}}{{.}}{{end}}{{with .MaxDownloads}} after {{.}} downloads{{end}}</td>
+		</tr>
+		{{end}}
+    </tbody>
+</table>
+</body>
+</html>`
+
+	// The max length of the path field in multipart uploads
+	maxPathFieldSize int64 = 4096
+)
+
 var (
 	ErrNoUploadingUp      = errors.New("Unable to upload up outside the <serve> directory.")
 	ErrNoFilenameProvided = errors.New("No filename provided. Cannot accept upload")
@@ -25,99 +81,564 @@ var (
 func isUploadClientError(err error) bool {
 	return err == ErrNoUploadingUp ||
 		err == ErrNoFilenameProvided ||
-		err == ErrUnknownContentType
+		err == ErrUnknownContentType ||
+		err == ErrQuotaExceeded ||
+		err == ErrFileQuotaExceeded ||
+		isUploadLimitError(err) ||
+		isUploadHookError(err) ||
+		err == ErrInvalidTTL ||
+		err == ErrInvalidMaxDownloads ||
+		isUploadScanError(err) ||
+		isArchiveError(err)
 }
 
-func (h *UploadHandler) Handle(writer http.ResponseWriter, request *http.Request, responseFormat string) error {
+func isUploadLimitError(err error) bool {
+	_, ok := err.(*UploadLimitError)
+	return ok
+}
 
-	ct := getContentType(request)
-	if ct == "multipart/form-data" {
+// The result of uploading a single file
+type UploadedFile struct {
+	// The path of the file, relative to the serve root
+	Path string `json:"path" xml:"path"`
+	Size int64  `json:"size" xml:"size"`
+	// The verdict of the malware scanner, if the file was scanned
+	Scan *ScanResult `json:"scan,omitempty" xml:"scan,omitempty"`
+	// The time the file will be deleted, if it was uploaded with a ttl
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+	// The number of downloads before the file is deleted, if limited
+	MaxDownloads int `json:"max_downloads,omitempty" xml:"max_downloads,omitempty"`
+	// True if the file replaced an existing file
+	Overwritten bool `json:"overwritten,omitempty" xml:"overwritten,omitempty"`
+}
 
-		uploadPath := request.FormValue("path")
+// The response to an upload
+type UploadResponse struct {
+	// The directory the files were uploaded to
+	Path  string         `json:"path" xml:"path"`
+	Files []UploadedFile `json:"files" xml:"files"`
+}
 
-		err := request.ParseMultipartForm(1 << 20) // 1MB
-		if err != nil {
-			return err
-		}
+// Gets a copy of the response, with the base path added to the paths
+func (r UploadResponse) withBasePath(basePath string) UploadResponse {
+	response := UploadResponse{Path: basePath + r.Path, Files: make([]UploadedFile, len(r.Files))}
+	for i, file := range r.Files {
+		file.Path = basePath + file.Path
+		response.Files[i] = file
+	}
+	return response
+}
 
-		files, ok := request.MultipartForm.File["uploadfiles"]
-		if !ok {
-			log.Println("No upload files")
-			log.Println(request.MultipartForm)
+// Checks if any of the uploaded files were quarantined
+func (r UploadResponse) hasQuarantined() bool {
+	for _, file := range r.Files {
+		if file.Scan != nil && file.Scan.Quarantined {
+			return true
 		}
-		log.Println(files)
-		for i := range files {
-			err := func(i int) error {
-				fileRef := files[i]
-				log.Println("Handling file", fileRef.Filename)
-				file, err := fileRef.Open()
-				if err != nil {
-					return err
-				}
-				defer file.Close()
+	}
+	return false
+}
 
-				return h.uploadFile(path.Join(uploadPath, fileRef.Filename), file)
-			}(i)
-			if err != nil {
-				return err
-			}
+// Handles an upload done by the given user
+func (h *UploadHandler) Handle(writer http.ResponseWriter, request *http.Request, responseFormat, user string) error {
+	body, err := h.config.Uploads.limitRequest(request)
+	if err != nil {
+		return err
+	}
+	request.Body = readCloser{Reader: h.throttler.Reader(request.Context(), request.Body, user), Closer: request.Body}
+
+	response, err := h.handle(writer, request, responseFormat, user)
+	// Files can be in place even if the upload failed later on
+	for _, file := range response.Files {
+		h.auditUpload(request, user, file)
+	}
+	// The actual error might have been wrapped while parsing the request
+	if err != nil && body.exceeded {
+		return body.err
+	}
+	return err
+}
+
+// Handles the upload. Returns the files that were uploaded, even if it fails.
+func (h *UploadHandler) handle(writer http.ResponseWriter, request *http.Request, responseFormat, user string) (UploadResponse, error) {
+	ct := getContentType(request)
+	if ct == "multipart/form-data" {
+		response, err := h.handleMultipart(request, user)
+		if err != nil {
+			return response, err
 		}
 
-		http.Redirect(writer, request, uploadPath, http.StatusFound)
+		// Browsers are sent to the uploaded files, unless they need to know about quarantined files
+		if (responseFormat == FormatHtml || responseFormat == "") && !response.hasQuarantined() {
+			http.Redirect(writer, request, getBasePath(request)+response.Path, http.StatusFound)
+			return response, nil
+		}
 
-		return nil
+		return response, h.WriteResponse(writer, http.StatusAccepted, h.htmlTemplate, responseFormat, response.withBasePath(getBasePath(request)))
 	} else if ct == FormatOctetStream {
 		filename := request.URL.Query().Get("filename")
 		if filename == "" {
-			return ErrNoFilenameProvided
+			return UploadResponse{}, ErrNoFilenameProvided
 		}
 
 		defer request.Body.Close()
 
-		err := h.uploadFile(filename, request.Body)
+		options := uploadOptions{extract: isExtractRequested(request.URL.Query().Get("extract"))}
+		var err error
+		options.expiry.TTL, err = parseTTL(request.URL.Query().Get("ttl"))
+		if err != nil {
+			return UploadResponse{}, err
+		}
+		options.expiry.MaxDownloads, err = parseMaxDownloads(request.URL.Query().Get("maxDownloads"))
 		if err != nil {
-			return err
+			return UploadResponse{}, err
 		}
 
-		writer.WriteHeader(http.StatusAccepted)
+		response := UploadResponse{Path: path.Dir(path.Join("/", filename))}
+		response.Files, err = h.uploadOrExtract(request.Context(), user, filename, request.Body, request.ContentLength, options)
+		if err != nil {
+			return response, err
+		}
 
-		return nil
+		return response, h.WriteResponse(writer, http.StatusAccepted, h.htmlTemplate, responseFormat, response.withBasePath(getBasePath(request)))
 	} else {
-		return ErrUnknownContentType
+		return UploadResponse{}, ErrUnknownContentType
 	}
 }
 
-func (h *UploadHandler) uploadFile(filename string, file io.Reader) error {
+// Records the uploaded file in the audit log
+func (h *UploadHandler) auditUpload(request *http.Request, user string, file UploadedFile) {
+	entry := AuditEntry{Action: AuditUpload, User: user, Path: file.Path}
+	if file.Overwritten {
+		entry.Action = AuditOverwrite
+	}
+	if file.Scan != nil && file.Scan.Quarantined {
+		entry.Details = "Quarantined, infected with " + file.Scan.Signature
+	}
+	h.audit.RecordRequest(request, entry)
+}
+
+// Checks the value of the extract parameter. Checkboxes sends "on".
+func isExtractRequested(value string) bool {
+	return value == "true" || value == "on" || value == "1"
+}
+
+// The settings an upload was done with
+type uploadOptions struct {
+	// Extract the file, if it's an archive
+	extract bool
+	// When the uploaded files expire. Applies to the extracted files of archives
+	expiry UploadExpiry
+}
+
+// Uploads the file, or extracts it if extraction was requested and the file is an archive
+func (h *UploadHandler) uploadOrExtract(ctx context.Context, user, filename string, file io.Reader, size int64, options uploadOptions) ([]UploadedFile, error) {
+	if options.extract && getArchiveFormat(filename) != "" {
+		return h.extractArchive(ctx, user, filename, file, options.expiry)
+	}
+
+	uploaded, err := h.uploadFile(ctx, user, filename, file, size, options.expiry)
+	if err != nil {
+		return nil, err
+	}
+	return []UploadedFile{uploaded}, nil
+}
+
+// A file that was received before it was known where it should be uploaded to
+type pendingFile struct {
+	filename    string
+	stagingPath string
+	size        int64
+	// The settings the file was uploaded with
+	options uploadOptions
+}
+
+// Gets the total size of the files received so far
+func pendingSize(pending []pendingFile) int64 {
+	var size int64
+	for _, file := range pending {
+		size += file.size
+	}
+	return size
+}
+
+// Streams the files of a multipart upload directly to disk, without buffering the
+// whole request first. The path can be sent both before and after the files.
+func (h *UploadHandler) handleMultipart(request *http.Request, user string) (response UploadResponse, err error) {
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return response, err
+	}
+
+	pathReceived := false
+	var options uploadOptions
+	var pending []pendingFile
+	// Make sure nothing is left behind if something goes wrong
+	defer func() {
+		for _, file := range pending {
+			os.Remove(file.stagingPath)
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return response, err
+		}
+
+		switch part.FormName() {
+		case "path":
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxPathFieldSize))
+			if err != nil {
+				return response, err
+			}
+			response.Path = path.Join("/", string(value))
+			pathReceived = true
+		case "extract":
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxPathFieldSize))
+			if err != nil {
+				return response, err
+			}
+			options.extract = isExtractRequested(string(value))
+		case "ttl":
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxPathFieldSize))
+			if err != nil {
+				return response, err
+			}
+			options.expiry.TTL, err = parseTTL(string(value))
+			if err != nil {
+				return response, err
+			}
+		case "maxDownloads":
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxPathFieldSize))
+			if err != nil {
+				return response, err
+			}
+			options.expiry.MaxDownloads, err = parseMaxDownloads(string(value))
+			if err != nil {
+				return response, err
+			}
+		case "uploadfiles":
+			// Browsers sends an empty part if no files was selected
+			if part.FileName() == "" {
+				break
+			}
+
+			if pathReceived {
+				files, err := h.uploadOrExtract(request.Context(), user, path.Join(response.Path, part.FileName()), part, -1, options)
+				if err != nil {
+					return response, err
+				}
+				response.Files = append(response.Files, files...)
+				break
+			}
+
+			// The file is kept in the serve root until the path is known. The quotas of
+			// the path can't be checked yet, but the ones of the user and the server can
+			remaining, err := h.quotas.RemainingForUser(user)
+			if err != nil {
+				return response, err
+			}
+			if remaining >= 0 {
+				remaining -= pendingSize(pending)
+				if remaining <= 0 {
+					return response, ErrQuotaExceeded
+				}
+			}
+			_, span := startSpan(request.Context(), "upload.receive", attribute.String("file.name", part.FileName()))
+			stagingPath, written, err := h.writeStagingFile(h.config.Serve, part.FileName(), part, -1, remaining)
+			span.SetAttributes(attribute.Int64("file.size", written))
+			endSpan(span, err)
+			if err != nil {
+				return response, err
+			}
+			pending = append(pending, pendingFile{
+				filename:    part.FileName(),
+				stagingPath: stagingPath,
+				size:        written,
+				options:     options,
+			})
+		}
+		part.Close()
+	}
+
+	for len(pending) > 0 {
+		file := pending[0]
+		filename := path.Join(response.Path, file.filename)
+		if file.options.extract && getArchiveFormat(filename) != "" {
+			files, err := h.extractStagingFile(request.Context(), user, filename, file.stagingPath, file.options.expiry)
+			if err != nil {
+				return response, err
+			}
+			response.Files = append(response.Files, files...)
+			pending = pending[1:]
+			continue
+		}
+
+		uploaded, err := h.commitFile(request.Context(), user, filename, file.stagingPath, file.size, file.options.expiry)
+		if err != nil {
+			return response, err
+		}
+		response.Files = append(response.Files, uploaded)
+		pending = pending[1:]
+	}
+
+	return response, nil
+}
+
+// Gets the full path the given filename should be uploaded to
+func (h *UploadHandler) getOutputPath(filename string) (string, error) {
 	outputPath := path.Join(h.config.Serve, filename)
-	log.Println("outputPath", outputPath)
 
 	// Ensure that it's not possible to upload "upwards" in the tree
 	if !strings.HasPrefix(outputPath, h.config.Serve) {
-		return ErrNoUploadingUp
+		return "", ErrNoUploadingUp
 	}
 
-	err := os.MkdirAll(path.Dir(outputPath), os.ModePerm)
+	return outputPath, nil
+}
+
+// Uploads the file to the given filename. The file is written next to the target
+// and only moved into place once it has been fully received, so a failed upload
+// never leaves a partial file behind.
+// size is the expected size of the file, or -1 if unknown.
+func (h *UploadHandler) uploadFile(ctx context.Context, user, filename string, file io.Reader, size int64, expiry UploadExpiry) (UploadedFile, error) {
+	outputPath, err := h.getOutputPath(filename)
 	if err != nil {
-		return err
+		return UploadedFile{}, err
+	}
+
+	remaining, err := h.quotas.Remaining(user, path.Join("/", filename))
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	// No reason to receive the whole file if we already know it's too big
+	if remaining >= 0 && size > remaining {
+		return UploadedFile{}, ErrQuotaExceeded
+	}
+
+	_, span := startSpan(ctx, "upload.receive", attribute.String("file.path", path.Join("/", filename)))
+	stagingPath, written, err := h.writeStagingFile(path.Dir(outputPath), filename, file, size, remaining)
+	span.SetAttributes(attribute.Int64("file.size", written))
+	endSpan(span, err)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+
+	return h.commitFile(ctx, user, filename, stagingPath, written, expiry)
+}
+
+// Gets the directory the staging files for the given directory are written to. That's
+// the closest directory that already exists, so the directories aren't created until the
+// files are moved into place, and a rejected upload doesn't leave empty directories behind.
+func (h *UploadHandler) getStagingDir(dir string) (string, error) {
+	for dir != h.config.Serve && strings.HasPrefix(dir, h.config.Serve) {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+		dir = path.Dir(dir)
+	}
+	return h.config.Serve, os.MkdirAll(h.config.Serve, os.ModePerm)
+}
+
+// Writes the file to a new staging file for the given directory, making sure it
+// respects the upload limits and the remaining quota. A negative remaining quota
+// means unlimited.
+func (h *UploadHandler) writeStagingFile(dir, filename string, file io.Reader, size, remaining int64) (stagingPath string, written int64, err error) {
+	file, err = h.config.Uploads.checkFile(filename, file, size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	dir, err = h.getStagingDir(dir)
+	if err != nil {
+		return "", 0, err
+	}
+
+	stagingPath = path.Join(dir, stagingFilePrefix+uuid.NewV4().String())
+	dst, err := os.OpenFile(stagingPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return "", 0, err
+	}
+
+	written, err = io.Copy(dst, newQuotaReader(file, remaining))
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(stagingPath)
+		return "", 0, err
+	}
+
+	return stagingPath, written, nil
+}
+
+// A staging file being moved into place
+type fileCommit struct {
+	pendingFile
+	// The path of the file, relative to the serve root
+	p          string
+	outputPath string
+	uploaded   UploadedFile
+	// False if the file was quarantined instead of moved into place
+	place bool
+	ctx   context.Context
+	span  trace.Span
+}
+
+// Moves a fully received staging file into place, if it passes the malware
+// scan and the hooks. The staging file is removed if it isn't moved into place.
+func (h *UploadHandler) commitFile(ctx context.Context, user, filename, stagingPath string, size int64, expiry UploadExpiry) (UploadedFile, error) {
+	files, err := h.commitFiles(ctx, user, []pendingFile{{filename: filename, stagingPath: stagingPath, size: size}}, expiry)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	return files[0], nil
+}
+
+// Moves fully received staging files into place. All of the files are checked against
+// the quotas, the malware scan and the hooks before any of them are moved, so if one of
+// them is rejected, none of them are moved into place. Infected files are quarantined
+// instead, if configured. The staging files are removed if they aren't moved into place.
+func (h *UploadHandler) commitFiles(ctx context.Context, user string, pending []pendingFile, expiry UploadExpiry) (files []UploadedFile, err error) {
+	commits := make([]*fileCommit, len(pending))
+	for i, file := range pending {
+		p := path.Join("/", file.filename)
+		c := &fileCommit{pendingFile: file, p: p, uploaded: UploadedFile{Path: p, Size: file.size}, place: true}
+		c.ctx, c.span = startSpan(ctx, "upload.commit", attribute.String("file.path", p), attribute.Int64("file.size", file.size))
+		commits[i] = c
+	}
+	defer func() {
+		for _, c := range commits {
+			c.span.SetAttributes(attribute.Bool("file.overwritten", c.uploaded.Overwritten))
+			endSpan(c.span, err)
+			os.Remove(c.stagingPath)
+		}
+	}()
+
+	sizes := make(map[string]int64, len(commits))
+	for _, c := range commits {
+		c.outputPath, err = h.getOutputPath(c.filename)
+		if err != nil {
+			return nil, err
+		}
+		sizes[c.p] = c.size
 	}
 
-	dst, err := os.Create(outputPath)
+	// Other uploads might have used the quota while these were received
+	reservation, err := h.quotas.Reserve(user, sizes)
+	if err != nil {
+		return nil, err
+	}
+	defer reservation.Release()
+
+	for _, c := range commits {
+		err = h.checkFile(user, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range commits {
+		if c.place {
+			err = h.placeFile(user, c, reservation, expiry)
+			if err != nil {
+				return files, err
+			}
+		}
+		files = append(files, c.uploaded)
+	}
+	return files, nil
+}
+
+// Scans the staging file for malware, and runs the hooks that can reject it.
+// Infected files are quarantined, if configured.
+func (h *UploadHandler) checkFile(user string, c *fileCommit) error {
+	slog.Debug("Checking upload", "path", c.p, "outputPath", c.outputPath)
+
+	var err error
+	_, scanSpan := startSpan(c.ctx, "upload.scan")
+	c.uploaded.Scan, err = h.scanner.Scan(c.p, c.stagingPath)
+	if c.uploaded.Scan != nil {
+		scanSpan.SetAttributes(attribute.String("scan.status", c.uploaded.Scan.Status))
+	}
+	endSpan(scanSpan, err)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
+	if c.uploaded.Scan != nil && c.uploaded.Scan.Status == ScanInfected {
+		if !h.config.Scanner.Quarantine {
+			return &UploadScanError{Message: fmt.Sprintf("Upload rejected, '%s' is infected with %s", c.p, c.uploaded.Scan.Signature)}
+		}
+		c.place = false
+		return h.scanner.Quarantine(user, c.p, c.stagingPath, c.uploaded.Scan)
+	}
 
-	_, err = io.Copy(dst, file)
+	_, hookSpan := startSpan(c.ctx, "upload.hooks")
+	err = h.hooks.BeforeCommit(user, c.p, c.stagingPath)
+	endSpan(hookSpan, err)
 	return err
 }
 
-func GetUploadHandler(config *Config) (*UploadHandler, error) {
+// Moves the checked staging file into place, and lets everyone know about it
+func (h *UploadHandler) placeFile(user string, c *fileCommit, reservation *QuotaReservation, expiry UploadExpiry) error {
+	slog.Debug("Committing upload", "path", c.p, "outputPath", c.outputPath)
+
+	err := os.MkdirAll(path.Dir(c.outputPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	event := ChangeEvent{Type: EventCreated, Path: c.p, User: user}
+	if _, err := os.Stat(c.outputPath); err == nil {
+		event.Type = EventModified
+		c.uploaded.Overwritten = true
+	}
+
+	err = os.Rename(c.stagingPath, c.outputPath)
+	if err != nil {
+		return err
+	}
+
+	reservation.Commit(c.p)
+	h.expiry.Set(c.p, expiry)
+	if file, _ := h.expiry.Get(c.p); file != nil {
+		c.uploaded.ExpiresAt = file.ExpiresAt
+		c.uploaded.MaxDownloads = file.MaxDownloads
+	}
+	h.events.Publish(event)
+	if h.index != nil {
+		go h.index.Update(c.p)
+	}
+	h.hooks.AfterCommit(user, c.p, c.outputPath)
+	return nil
+}
+
+func GetUploadHandler(config *Config, quotas *QuotaTracker, throttler *Throttler, index *ContentIndex, events *EventBus, hooks *UploadHooks, expiry *ExpiryTracker, audit *AuditLog) (*UploadHandler, error) {
 	chl, err := GetClientErrorHandler()
 	if err != nil {
 		return nil, err
 	}
+	t := template.New("Upload Response Html Template")
+	t, err = t.Parse(UploadResponseHtml)
+	if err != nil {
+		return nil, err
+	}
 	return &UploadHandler{
 		config:             config,
 		clientErrorHandler: chl,
+		quotas:             quotas,
+		throttler:          throttler,
+		index:              index,
+		events:             events,
+		hooks:              hooks,
+		scanner:            NewScanner(config),
+		expiry:             expiry,
+		audit:              audit,
+		htmlTemplate:       t,
 	}, nil
 }
@@ -0,0 +1,197 @@
+package gfs
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a multipart upload body with the given files. The path is written
+// either before or after the files.
+func createMultipartBody(uploadPath string, pathFirst bool, files map[string][]byte) (*bytes.Buffer, string) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	if pathFirst {
+		writer.WriteField("path", uploadPath)
+	}
+	for name, content := range files {
+		part, _ := writer.CreateFormFile("uploadfiles", name)
+		part.Write(content)
+	}
+	if !pathFirst {
+		writer.WriteField("path", uploadPath)
+	}
+	writer.Close()
+
+	return &buf, writer.FormDataContentType()
+}
+
+func getTestUploadHandler(t testing.TB) (*UploadHandler, func()) {
+	dir, err := ioutil.TempDir("", "gfs-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Serve: filepath.Join(dir, "serve"),
+		Data:  filepath.Join(dir, "data"),
+	}
+	quotas, err := NewQuotaTracker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := NewUploadHooks(config.Hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry, err := NewExpiryTracker(config, quotas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := GetUploadHandler(config, quotas, NewThrottler(config.Bandwidth), nil, NewEventBus(), hooks, expiry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUploadHandler_Multipart(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt": []byte("first file"),
+		"b.txt": []byte("second file"),
+	}
+
+	for _, pathFirst := range []bool{true, false} {
+		a := assert.New(t)
+		h, cleanup := getTestUploadHandler(t)
+
+		body, contentType := createMultipartBody("/test-path", pathFirst, files)
+		request := httptest.NewRequest("POST", "/upload", body)
+		request.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+
+		err := h.Handle(recorder, request, FormatHtml, "test")
+		if a.NoError(err) {
+			a.Equal(http.StatusFound, recorder.Code)
+
+			for name, content := range files {
+				uploaded, err := ioutil.ReadFile(filepath.Join(h.config.Serve, "test-path", name))
+				if a.NoError(err) {
+					a.Equal(content, uploaded)
+				}
+			}
+
+			entries, err := ioutil.ReadDir(h.config.Serve)
+			if a.NoError(err) {
+				a.Len(entries, 1, "No staging files should be left behind")
+			}
+		}
+
+		cleanup()
+	}
+}
+
+func TestUploadHandler_MultipartQuota(t *testing.T) {
+	a := assert.New(t)
+	h, cleanup := getTestUploadHandler(t)
+	defer cleanup()
+	h.config.Quotas.Users = map[string]Quota{"test": {MaxBytes: 1 << 10}}
+
+	// The path is sent last, so the file has to be received before it's known where it goes
+	body, contentType := createMultipartBody("/test-path", false, map[string][]byte{"big.bin": bytes.Repeat([]byte{1}, 1<<20)})
+	var read int64
+	request := httptest.NewRequest("POST", "/upload", &countingReader{reader: body, count: &read})
+	request.Header.Set("Content-Type", contentType)
+
+	err := h.Handle(httptest.NewRecorder(), request, FormatHtml, "test")
+	a.Equal(ErrQuotaExceeded, err)
+	a.True(read < 1<<19, "The upload should be stopped once it exceeds the quota of the user, not after it's received")
+
+	entries, err := ioutil.ReadDir(h.config.Serve)
+	if a.NoError(err) {
+		a.Empty(entries, "No staging files should be left behind")
+	}
+}
+
+// Uploads the files by first parsing the whole form, which is how uploads
+// used to be handled, to have something to compare against.
+func uploadBuffered(h *UploadHandler, request *http.Request) error {
+	err := request.ParseMultipartForm(1 << 20) // 1MB
+	if err != nil {
+		return err
+	}
+	defer request.MultipartForm.RemoveAll()
+
+	uploadPath := request.FormValue("path")
+	for _, fileRef := range request.MultipartForm.File["uploadfiles"] {
+		file, err := fileRef.Open()
+		if err != nil {
+			return err
+		}
+
+		dst, err := os.Create(path.Join(h.config.Serve, uploadPath, fileRef.Filename))
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		_, err = io.Copy(dst, file)
+		dst.Close()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func benchmarkMultipartUpload(b *testing.B, upload func(h *UploadHandler, request *http.Request) error) {
+	h, cleanup := getTestUploadHandler(b)
+	defer cleanup()
+
+	if err := os.MkdirAll(filepath.Join(h.config.Serve, "bench"), os.ModePerm); err != nil {
+		b.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"small.bin": bytes.Repeat([]byte{1}, 64<<10),
+		"large.bin": bytes.Repeat([]byte{2}, 16<<20),
+	}
+	body, contentType := createMultipartBody("/bench", true, files)
+	content := body.Bytes()
+
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := httptest.NewRequest("POST", "/upload", bytes.NewReader(content))
+		request.Header.Set("Content-Type", contentType)
+
+		err := upload(h, request)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMultipartUpload_Streaming(b *testing.B) {
+	benchmarkMultipartUpload(b, func(h *UploadHandler, request *http.Request) error {
+		return h.Handle(httptest.NewRecorder(), request, FormatHtml, "bench")
+	})
+}
+
+func BenchmarkMultipartUpload_Buffered(b *testing.B) {
+	benchmarkMultipartUpload(b, uploadBuffered)
+}
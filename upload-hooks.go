@@ -0,0 +1,228 @@
+package gfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// How long hook commands can run, unless configured otherwise
+	defaultUploadHookTimeout time.Duration = time.Minute
+	// The number of hook commands that can run at once, unless configured otherwise
+	defaultMaxConcurrentHooks int = 4
+	// How long to wait for the output of a command after it has been killed, in case it
+	// started processes of its own that are still holding on to it
+	uploadHookWaitDelay time.Duration = 5 * time.Second
+	// The max number of bytes of output that are logged per command
+	maxUploadHookOutput int = 64 << 10
+)
+
+var (
+	ErrNoHookCommand = errors.New("Upload hooks must have a command")
+)
+
+// The environment variables of gfs that are passed on to the commands. The rest, like
+// secrets given to gfs through the environment, are kept from them unless configured.
+var uploadHookEnvironment = []string{"PATH", "HOME", "LANG", "TZ", "TMPDIR", "SystemRoot", "TEMP", "TMP"}
+
+// Settings for the commands that run when files are uploaded
+type HooksConfig struct {
+	// The max number of hook commands running at once. Defaults to 4
+	MaxConcurrent int `json:"maxConcurrent"`
+	// The commands to run when files are uploaded
+	Upload []UploadHookConfig `json:"upload"`
+}
+
+// A command that runs when a file matching the path is uploaded. Only a few of the
+// environment variables of gfs are passed on, and the command gets the upload in these:
+//
+//	GFS_PATH: The path of the file, relative to the serve root
+//	GFS_FILE: The full path of the file on disk
+//	GFS_USER: The user who uploaded the file
+type UploadHookConfig struct {
+	// Glob pattern the path of the uploaded file, or one of the directories it's in,
+	// has to match, e.g. "/nightly/*.zip" or "/nightly"
+	Path string `json:"path"`
+	// The program to run, followed by its arguments
+	Command []string `json:"command"`
+	// The max number of seconds the command can run. Defaults to 60
+	Timeout int `json:"timeout"`
+	// If true, the upload is rejected if the command fails. Such hooks run before the
+	// file is moved into place, so GFS_FILE is a temporary file next to the target.
+	Reject bool `json:"reject"`
+	// The names of other environment variables of gfs to pass on to the command
+	Env []string `json:"env"`
+}
+
+// Checks if the hook should run for the given path
+func (c UploadHookConfig) matches(p string) bool {
+	for dir := p; ; dir = path.Dir(dir) {
+		if matched, _ := path.Match(c.Path, dir); matched {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+// Gets the environment the command runs with
+func (c UploadHookConfig) getEnv(user, p, file string) []string {
+	var env []string
+	for _, names := range [][]string{uploadHookEnvironment, c.Env} {
+		for _, name := range names {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+	return append(env,
+		"GFS_PATH="+p,
+		"GFS_FILE="+file,
+		"GFS_USER="+user,
+	)
+}
+
+func (c UploadHookConfig) getTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return defaultUploadHookTimeout
+}
+
+// An upload that was rejected by a hook
+type UploadHookError struct {
+	Message string
+}
+
+func (e *UploadHookError) Error() string {
+	return e.Message
+}
+
+func isUploadHookError(err error) bool {
+	_, ok := err.(*UploadHookError)
+	return ok
+}
+
+// Runs the configured commands when files are uploaded
+type UploadHooks struct {
+	hooks []UploadHookConfig
+	// Limits how many commands run at once
+	slots chan struct{}
+}
+
+func NewUploadHooks(config HooksConfig) (*UploadHooks, error) {
+	for _, hook := range config.Upload {
+		if len(hook.Command) == 0 {
+			return nil, ErrNoHookCommand
+		}
+		_, err := path.Match(hook.Path, "/")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid upload hook path '%s': %s", hook.Path, err)
+		}
+	}
+
+	maxConcurrent := config.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentHooks
+	}
+
+	return &UploadHooks{
+		hooks: config.Upload,
+		slots: make(chan struct{}, maxConcurrent),
+	}, nil
+}
+
+// Runs the hooks that can reject the upload. file is the staging file that
+// will be moved into place if all the hooks succeed.
+func (h *UploadHooks) BeforeCommit(user, p, file string) error {
+	for _, hook := range h.hooks {
+		if !hook.Reject || !hook.matches(p) {
+			continue
+		}
+
+		err := h.run(hook, user, p, file)
+		if err != nil {
+			return &UploadHookError{Message: fmt.Sprintf("Upload rejected by hook '%s': %s", hook.Command[0], err)}
+		}
+	}
+	return nil
+}
+
+// Runs the remaining hooks in the background, after the file has been moved into place
+func (h *UploadHooks) AfterCommit(user, p, file string) {
+	for _, hook := range h.hooks {
+		if hook.Reject || !hook.matches(p) {
+			continue
+		}
+
+		go h.run(hook, user, p, file)
+	}
+}
+
+// Runs the command of the hook, and logs the output
+func (h *UploadHooks) run(hook UploadHookConfig, user, p, file string) error {
+	h.slots <- struct{}{}
+	defer func() {
+		<-h.slots
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), hook.getTimeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = hook.getEnv(user, p, file)
+	cmd.WaitDelay = uploadHookWaitDelay
+	output := &boundedBuffer{max: maxUploadHookOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Timed out after %s", hook.getTimeout())
+	}
+
+	name := strings.Join(hook.Command, " ")
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		slog.Info("Hook output", "hook", name, "path", p, "output", scanner.Text())
+	}
+	if output.truncated {
+		slog.Warn("Hook output was cut off", "hook", name, "path", p, "maxBytes", maxUploadHookOutput)
+	}
+	if err != nil {
+		slog.Warn("Hook failed", "hook", name, "path", p, "duration", time.Since(start), "error", err)
+		return err
+	}
+	slog.Info("Hook finished", "hook", name, "path", p, "duration", time.Since(start))
+	return nil
+}
+
+// A buffer that keeps the first max bytes written to it, and throws away the rest
+type boundedBuffer struct {
+	bytes.Buffer
+	max int
+	// True if anything was thrown away
+	truncated bool
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
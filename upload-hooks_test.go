@@ -0,0 +1,93 @@
+// +build !windows
+
+package gfs
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadHooks(t *testing.T) {
+	a := assert.New(t)
+
+	h, cleanup := getTestUploadHandler(t)
+	defer cleanup()
+
+	marker := filepath.Join(h.config.Data, "hook-ran")
+	hooks, err := NewUploadHooks(HooksConfig{
+		Upload: []UploadHookConfig{
+			{Path: "/checked", Command: []string{"sh", "-c", `grep -q valid "$GFS_FILE"`}, Reject: true},
+			{Path: "/slow/*.zip", Command: []string{"sleep", "5"}, Timeout: 1, Reject: true},
+			{Path: "/checked/*.txt", Command: []string{"sh", "-c", `mkdir -p "$(dirname "$MARKER")" && echo "$GFS_USER $GFS_PATH ${GFS_TEST_SECRET:-hidden}" > "$MARKER"`}, Env: []string{"MARKER"}},
+		},
+	})
+	if !a.NoError(err) {
+		return
+	}
+	h.hooks = hooks
+	os.Setenv("MARKER", marker)
+	defer os.Unsetenv("MARKER")
+	os.Setenv("GFS_TEST_SECRET", "secret")
+	defer os.Unsetenv("GFS_TEST_SECRET")
+
+	_, err = h.uploadFile(context.Background(), "username", "/checked/sub/invalid.txt", bytes.NewReader([]byte("nope")), -1, UploadExpiry{})
+	a.True(isUploadHookError(err))
+	_, err = os.Stat(filepath.Join(h.config.Serve, "checked", "sub", "invalid.txt"))
+	a.True(os.IsNotExist(err))
+
+	start := time.Now()
+	_, err = h.uploadFile(context.Background(), "username", "/slow/build.zip", bytes.NewReader([]byte("valid")), -1, UploadExpiry{})
+	a.True(isUploadHookError(err))
+	a.True(time.Since(start) < 4*time.Second)
+
+	_, err = h.uploadFile(context.Background(), "username", "/checked/valid.txt", bytes.NewReader([]byte("valid")), -1, UploadExpiry{})
+	if !a.NoError(err) {
+		return
+	}
+
+	var content []byte
+	for i := 0; i < 100; i++ {
+		content, err = ioutil.ReadFile(marker)
+		if err == nil && len(content) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	a.Equal("username /checked/valid.txt hidden\n", string(content), "Only the configured environment should be passed on")
+}
+
+func TestBoundedBuffer(t *testing.T) {
+	a := assert.New(t)
+
+	buffer := &boundedBuffer{max: 10}
+	n, err := buffer.Write([]byte("hello "))
+	a.Equal(6, n)
+	a.NoError(err)
+	a.False(buffer.truncated)
+
+	// The command should not fail because its output is thrown away
+	n, err = buffer.Write([]byte("world, and everyone else"))
+	a.Equal(24, n)
+	a.NoError(err)
+	a.True(buffer.truncated)
+	a.Equal("hello worl", buffer.String())
+
+	buffer.Write([]byte("more"))
+	a.Equal("hello worl", buffer.String())
+}
+
+func TestUploadHookConfig_Matches(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(UploadHookConfig{Path: "/nightly"}.matches("/nightly/2017/build.zip"))
+	a.True(UploadHookConfig{Path: "/nightly/*.zip"}.matches("/nightly/build.zip"))
+	a.False(UploadHookConfig{Path: "/nightly/*.zip"}.matches("/nightly/build.txt"))
+	a.True(UploadHookConfig{Path: "/"}.matches("/build.zip"))
+	a.False(UploadHookConfig{Path: "/other"}.matches("/nightly/build.zip"))
+}
@@ -0,0 +1,166 @@
+package gfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Restrictions on what can be uploaded. Zero values means unlimited.
+type UploadLimits struct {
+	// The max number of bytes in a single upload request
+	MaxRequestSize int64 `json:"maxRequestSize"`
+	// The max number of bytes of a single uploaded file
+	MaxFileSize int64 `json:"maxFileSize"`
+	// If set, only files with these extensions can be uploaded, e.g. ".zip"
+	AllowedExtensions []string `json:"allowedExtensions"`
+	// Files with these extensions cannot be uploaded
+	DeniedExtensions []string `json:"deniedExtensions"`
+	// If set, only files of these types can be uploaded, e.g. "image/*".
+	// The type is detected from the content of the file.
+	AllowedMimeTypes []string `json:"allowedMimeTypes"`
+	// Files of these types cannot be uploaded
+	DeniedMimeTypes []string `json:"deniedMimeTypes"`
+	// The max number of bytes extracted from a single archive. Defaults to 1GB
+	MaxExtractedSize int64 `json:"maxExtractedSize"`
+	// The max number of files extracted from a single archive. Defaults to 10000
+	MaxExtractedFiles int `json:"maxExtractedFiles"`
+}
+
+func (l *UploadLimits) getMaxExtractedSize() int64 {
+	if l.MaxExtractedSize > 0 {
+		return l.MaxExtractedSize
+	}
+	return defaultMaxExtractedSize
+}
+
+func (l *UploadLimits) getMaxExtractedFiles() int {
+	if l.MaxExtractedFiles > 0 {
+		return l.MaxExtractedFiles
+	}
+	return defaultMaxExtractedFiles
+}
+
+// An upload that was rejected because it doesn't respect the upload limits
+type UploadLimitError struct {
+	Message string
+	// True if the upload was rejected for being too large
+	TooLarge bool
+}
+
+func (e *UploadLimitError) Error() string {
+	return e.Message
+}
+
+func newUploadLimitError(format string, args ...interface{}) *UploadLimitError {
+	return &UploadLimitError{Message: fmt.Sprintf(format, args...)}
+}
+
+func newUploadSizeError(format string, args ...interface{}) *UploadLimitError {
+	return &UploadLimitError{Message: fmt.Sprintf(format, args...), TooLarge: true}
+}
+
+// Returns true if the upload was rejected for being too large
+func isUploadTooLarge(err error) bool {
+	e, ok := err.(*UploadLimitError)
+	return ok && e.TooLarge
+}
+
+// Limits the body of the request to the max request size. Check `exceeded` on the
+// returned reader to know if a failure was caused by the request being too large.
+func (l *UploadLimits) limitRequest(request *http.Request) (*limitedReader, error) {
+	err := newUploadSizeError("Upload is too large. Max request size is %d bytes", l.MaxRequestSize)
+	if l.MaxRequestSize > 0 && request.ContentLength > l.MaxRequestSize {
+		return nil, err
+	}
+
+	limit := l.MaxRequestSize
+	if limit <= 0 {
+		limit = -1
+	}
+	body := newLimitedReader(request.Body, limit, err)
+	request.Body = readCloser{Reader: body, Closer: request.Body}
+	return body, nil
+}
+
+// Checks that the given file can be uploaded. Returns a reader that should be used
+// instead of the given reader.
+// size is the expected size of the file, or -1 if unknown.
+func (l *UploadLimits) checkFile(filename string, file io.Reader, size int64) (io.Reader, error) {
+	name := path.Base(filename)
+
+	ext := strings.ToLower(path.Ext(name))
+	if len(l.AllowedExtensions) > 0 && !containsExtension(l.AllowedExtensions, ext) {
+		return nil, newUploadLimitError("Files with the extension '%s' are not allowed", ext)
+	}
+	if containsExtension(l.DeniedExtensions, ext) {
+		return nil, newUploadLimitError("Files with the extension '%s' are not allowed", ext)
+	}
+
+	if l.MaxFileSize > 0 {
+		err := newUploadSizeError("The file '%s' is too large. Max file size is %d bytes", name, l.MaxFileSize)
+		if size > l.MaxFileSize {
+			return nil, err
+		}
+		file = newLimitedReader(file, l.MaxFileSize, err)
+	}
+
+	if len(l.AllowedMimeTypes) == 0 && len(l.DeniedMimeTypes) == 0 {
+		return file, nil
+	}
+
+	// Peek doesn't consume anything, so the returned reader still contains the full file
+	buffered := bufio.NewReaderSize(file, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(l.AllowedMimeTypes) > 0 && !matchesMimeType(l.AllowedMimeTypes, mimeType) {
+		return nil, newUploadLimitError("Files of the type '%s' are not allowed", mimeType)
+	}
+	if matchesMimeType(l.DeniedMimeTypes, mimeType) {
+		return nil, newUploadLimitError("Files of the type '%s' are not allowed", mimeType)
+	}
+
+	return buffered, nil
+}
+
+// Returns true if the extension is in the list. The extensions in the list
+// can be specified both with and without the leading dot.
+func containsExtension(extensions []string, ext string) bool {
+	for _, e := range extensions {
+		e = strings.ToLower(e)
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the mime type matches any of the patterns. Patterns can either
+// be a full mime type, or a wildcard like "image/*".
+func matchesMimeType(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mimeType || pattern == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package gfs
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestUploadLimits(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A some image data")
+
+	t.Run("Extensions", func(t *testing.T) {
+		a := assert.New(t)
+		limits := UploadLimits{DeniedExtensions: []string{"exe", ".BAT"}}
+
+		_, err := limits.checkFile("/test/virus.exe", bytes.NewReader(png), -1)
+		a.IsType(&UploadLimitError{}, err)
+		a.False(isUploadTooLarge(err))
+
+		_, err = limits.checkFile("/test/script.bat", bytes.NewReader(png), -1)
+		a.IsType(&UploadLimitError{}, err)
+
+		_, err = limits.checkFile("/test/image.png", bytes.NewReader(png), -1)
+		a.NoError(err)
+	})
+
+	t.Run("Mime types are detected from the content", func(t *testing.T) {
+		a := assert.New(t)
+		limits := UploadLimits{AllowedMimeTypes: []string{"image/*"}}
+
+		reader, err := limits.checkFile("/test/image.txt", bytes.NewReader(png), -1)
+		if a.NoError(err) {
+			content, err := ioutil.ReadAll(reader)
+			a.NoError(err)
+			a.Equal(png, content, "The sniffed content should still be part of the file")
+		}
+
+		_, err = limits.checkFile("/test/image.png", bytes.NewBufferString("just some text"), -1)
+		if a.IsType(&UploadLimitError{}, err) {
+			a.Equal("Files of the type 'text/plain' are not allowed", err.Error())
+		}
+	})
+
+	t.Run("File size", func(t *testing.T) {
+		a := assert.New(t)
+		limits := UploadLimits{MaxFileSize: 10}
+
+		_, err := limits.checkFile("/test/image.png", bytes.NewReader(png), int64(len(png)))
+		a.True(isUploadTooLarge(err))
+
+		reader, err := limits.checkFile("/test/image.png", bytes.NewReader(png), -1)
+		if a.NoError(err) {
+			_, err = ioutil.ReadAll(reader)
+			a.True(isUploadTooLarge(err))
+		}
+	})
+}
+
+func TestLimitedReader(t *testing.T) {
+	tooLarge := errors.New("Too large")
+
+	t.Run("Keeps failing once exceeded", func(t *testing.T) {
+		a := assert.New(t)
+		reader := newLimitedReader(bytes.NewReader(make([]byte, 100)), 10, tooLarge)
+
+		buf := make([]byte, 8)
+		n, err := reader.Read(buf)
+		a.Equal(8, n)
+		a.NoError(err)
+		_, err = reader.Read(buf)
+		a.Equal(tooLarge, err)
+		a.True(reader.exceeded)
+
+		// The remaining bytes must not be let through, even though the limit is now negative
+		n, err = reader.Read(buf)
+		a.Equal(0, n)
+		a.Equal(tooLarge, err)
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		a := assert.New(t)
+		reader := newLimitedReader(bytes.NewReader(make([]byte, 100)), -1, tooLarge)
+
+		content, err := ioutil.ReadAll(reader)
+		a.NoError(err)
+		a.Len(content, 100)
+		a.False(reader.exceeded)
+	})
+
+	t.Run("Exactly the limit", func(t *testing.T) {
+		a := assert.New(t)
+		reader := newLimitedReader(bytes.NewReader(make([]byte, 10)), 10, tooLarge)
+
+		content, err := ioutil.ReadAll(reader)
+		a.NoError(err)
+		a.Len(content, 10)
+	})
+}
@@ -0,0 +1,93 @@
+package gfs
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	//language=html
+	UsageHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>Storage usage</title>
+</head>
+<body>
+<h1>Storage usage</h1>
+<hr />
+<table>
+    <thead>
+        <tr>
+            <th>Quota</th>
+            <th>Bytes</th>
+            <th>Max bytes</th>
+            <th>Files</th>
+            <th>Max files</th>
+        </tr>
+    </thead>
+    <tbody>
+		{{template "usage" .Global}}
+		{{template "usage" .User}}
+		{{range .Paths}}
+		{{template "usage" .}}
+		{{end}}
+    </tbody>
+</table>
+</body>
+</html>`
+
+	//language=html
+	usageRowHtml string = `<tr>
+	<td>{{.Name}}</td>
+	<td>{{.Bytes}}</td>
+	<td>{{if .MaxBytes}}{{.MaxBytes}}{{else}}Unlimited{{end}}</td>
+	<td>{{.Files}}</td>
+	<td>{{if .MaxFiles}}{{.MaxFiles}}{{else}}Unlimited{{end}}</td>
+</tr>`
+)
+
+// The current storage consumption
+type UsageResponse struct {
+	// Usage of everything in the serve path
+	Global QuotaUsage `json:"global" xml:"global"`
+	// Usage of the current user
+	User QuotaUsage `json:"user" xml:"user"`
+	// Usage of each of the path prefixes with a quota
+	Paths []QuotaUsage `json:"paths" xml:"paths"`
+}
+
+type UsageHandler struct {
+	responseHandler
+	quotas       *QuotaTracker
+	htmlTemplate *template.Template
+}
+
+func GetUsageHandler(quotas *QuotaTracker) (h *UsageHandler, err error) {
+	t := template.New("Usage Html Template")
+
+	if _, err = t.New("usage").Parse(usageRowHtml); err != nil {
+		return nil, err
+	}
+
+	t, err = t.Parse(UsageHtml)
+	if err != nil {
+		return nil, err
+	}
+	h = &UsageHandler{
+		quotas:       quotas,
+		htmlTemplate: t,
+	}
+
+	return h, nil
+}
+
+// Writes the storage usage of the given user to the response
+func (h *UsageHandler) Handle(writer http.ResponseWriter, user, format string) {
+	response := h.quotas.Usage(user)
+
+	err := h.responseHandler.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, response)
+	if err != nil {
+		slog.Error("Something went wrong when responding", "error", err)
+	}
+}
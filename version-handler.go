@@ -0,0 +1,99 @@
+package gfs
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	//language=html
+	VersionHtml string = `<!DOCTYPE html>
+<html>
+<head>
+<title>GFS {{.Version}}</title>
+</head>
+<body>
+<h1>GFS {{.Version}}</h1>
+<hr />
+<table>
+    <tbody>
+		<tr><td>Go version</td><td>{{.GoVersion}}</td></tr>
+		<tr><td>Platform</td><td>{{.Os}}/{{.Arch}}</td></tr>
+		{{if .Revision}}<tr><td>Revision</td><td>{{.Revision}}{{if .Modified}} (modified){{end}}</td></tr>{{end}}
+		{{if .BuildTime}}<tr><td>Build time</td><td>{{.BuildTime}}</td></tr>{{end}}
+		<tr><td>Update</td><td>
+			{{if .Update.Available}}A new update is available for download at <a href="{{.Update.Url}}">{{.Update.Url}}</a>
+			{{else if .Update.Error}}The update check failed: {{.Update.Error}}
+			{{else if .Update.Checked}}Up to date
+			{{else}}Not checked yet{{end}}
+		</td></tr>
+    </tbody>
+</table>
+</body>
+</html>`
+)
+
+// The version of gfs, and how it was built
+type VersionResponse struct {
+	Version   string `json:"version" xml:"version"`
+	GoVersion string `json:"go_version" xml:"go_version"`
+	Os        string `json:"os" xml:"os"`
+	Arch      string `json:"arch" xml:"arch"`
+	// The vcs revision gfs was built from, if known
+	Revision string `json:"revision,omitempty" xml:"revision,omitempty"`
+	// The time of the revision, if known
+	BuildTime string `json:"build_time,omitempty" xml:"build_time,omitempty"`
+	// True if gfs was built with uncommitted changes
+	Modified bool         `json:"modified,omitempty" xml:"modified,omitempty"`
+	Update   UpdateStatus `json:"update" xml:"update"`
+}
+
+type VersionHandler struct {
+	responseHandler
+	htmlTemplate *template.Template
+}
+
+func GetVersionHandler() (*VersionHandler, error) {
+	t, err := template.New("Version Html Template").Parse(VersionHtml)
+	if err != nil {
+		return nil, err
+	}
+	return &VersionHandler{htmlTemplate: t}, nil
+}
+
+// Writes the version of gfs to the response
+func (h *VersionHandler) Handle(writer http.ResponseWriter, format string) {
+	err := h.WriteResponse(writer, http.StatusOK, h.htmlTemplate, format, getVersion())
+	if err != nil {
+		slog.Error("Something went wrong when responding", "error", err)
+	}
+}
+
+func getVersion() VersionResponse {
+	version := VersionResponse{
+		Version:   GFSVersion,
+		GoVersion: runtime.Version(),
+		Os:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Update:    getUpdateStatus(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version.Revision = setting.Value
+		case "vcs.time":
+			version.BuildTime = setting.Value
+		case "vcs.modified":
+			version.Modified = setting.Value == "true"
+		}
+	}
+	return version
+}
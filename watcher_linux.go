@@ -0,0 +1,280 @@
+// +build linux
+
+package gfs
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// The changes the watched directories are notified about
+	watchMask uint32 = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	// How long to wait for the other half of a rename, if it wasn't in the same read
+	moveTimeout time.Duration = 50 * time.Millisecond
+)
+
+// A single event read from inotify
+type inotifyEvent struct {
+	wd     int32
+	mask   uint32
+	cookie uint32
+	name   string
+}
+
+// An entry that was moved away from a watched directory. It's only known to
+// be a rename if it's moved to another watched directory right after.
+type movedEntry struct {
+	cookie      uint32
+	path        string
+	isDirectory bool
+	staging     bool
+}
+
+// Publishes events for changes done to the serve path by other programs, using inotify
+type fsWatcher struct {
+	fd     int
+	serve  string
+	events *EventBus
+	// The watched directories, keyed by watch descriptor. The paths are relative
+	// to the serve root. Only used by the goroutine reading the events.
+	watches map[int32]string
+}
+
+// Starts watching the serve path for changes in the background
+func startWatching(serve string, events *EventBus) error {
+	// The serve path has to exist to be watched, and it will be created by the first upload anyway
+	err := os.MkdirAll(serve, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &fsWatcher{
+		fd:      fd,
+		serve:   serve,
+		events:  events,
+		watches: make(map[int32]string),
+	}
+	err = w.addRecursive("/", false)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go w.run()
+	return nil
+}
+
+// Watches the directory and all directories below it. If publish is true, created
+// events are published for the entries found, since they were created before they
+// could be watched.
+func (w *fsWatcher) addRecursive(p string, publish bool) error {
+	root := filepath.Join(w.serve, filepath.FromSlash(p))
+	return filepath.Walk(root, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(w.serve, fullpath)
+		if err != nil {
+			return err
+		}
+		entry := path.Join("/", filepath.ToSlash(rel))
+
+		if publish && entry != p && !isStagingFile(info.Name()) {
+			w.events.Publish(ChangeEvent{Type: EventCreated, Path: entry, IsDirectory: info.IsDir()})
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, fullpath, watchMask)
+		if err != nil {
+			if err == syscall.ENOENT {
+				return filepath.SkipDir
+			}
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.watches[int32(wd)] = entry
+		return nil
+	})
+}
+
+// Stops watching the directory and all directories below it
+func (w *fsWatcher) removeRecursive(p string) {
+	for wd, watched := range w.watches {
+		if hasPathPrefix(watched, p) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+// Updates the paths of the watches below a renamed directory
+func (w *fsWatcher) renameRecursive(oldPath, newPath string) {
+	for wd, watched := range w.watches {
+		if hasPathPrefix(watched, oldPath) {
+			w.watches[wd] = newPath + strings.TrimPrefix(watched, oldPath)
+		}
+	}
+}
+
+// Handles events until the watcher fails
+func (w *fsWatcher) run() {
+	reads := make(chan []inotifyEvent)
+	go w.read(reads)
+	w.process(reads)
+}
+
+// Reads events from inotify, and sends the events of each read to the channel.
+// The channel is closed when reading fails.
+func (w *fsWatcher) read(reads chan<- []inotifyEvent) {
+	defer close(reads)
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			slog.Error("Stopped watching the serve path for changes", "error", err)
+			return
+		}
+
+		var events []inotifyEvent
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			offset = nameStart + int(raw.Len)
+
+			events = append(events, inotifyEvent{wd: raw.Wd, mask: raw.Mask, cookie: raw.Cookie, name: name})
+		}
+		reads <- events
+	}
+}
+
+// Handles the events of each read. An entry moved away at the end of a read is
+// kept until the next read, since the matching move to might be in it.
+func (w *fsWatcher) process(reads <-chan []inotifyEvent) {
+	var moved *movedEntry
+	var timeout <-chan time.Time
+	for {
+		select {
+		case events, ok := <-reads:
+			if !ok {
+				if moved != nil {
+					w.movedAway(*moved)
+				}
+				return
+			}
+			for _, event := range events {
+				moved = w.handle(event.wd, event.mask, event.cookie, event.name, moved)
+			}
+		case <-timeout:
+			// The entry was moved somewhere that isn't watched
+			w.movedAway(*moved)
+			moved = nil
+		}
+
+		timeout = nil
+		if moved != nil {
+			timeout = time.After(moveTimeout)
+		}
+	}
+}
+
+// Handles a single inotify event. Returns the entry that was moved away, if the
+// event was a move away.
+func (w *fsWatcher) handle(wd int32, mask, cookie uint32, name string, moved *movedEntry) *movedEntry {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		slog.Warn("Too many changes in the serve path at once, some change events were lost")
+		return moved
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+		return moved
+	}
+
+	dir, ok := w.watches[wd]
+	if !ok || name == "" {
+		return moved
+	}
+	p := path.Join(dir, name)
+	isDirectory := mask&syscall.IN_ISDIR != 0
+	staging := isStagingFile(name)
+
+	if moved != nil && (mask&syscall.IN_MOVED_TO == 0 || cookie != moved.cookie) {
+		w.movedAway(*moved)
+		moved = nil
+	}
+
+	switch {
+	case mask&syscall.IN_MOVED_FROM != 0:
+		return &movedEntry{
+			cookie:      cookie,
+			path:        p,
+			isDirectory: isDirectory,
+			staging:     staging,
+		}
+	case mask&syscall.IN_MOVED_TO != 0 && moved != nil:
+		// Uploads are moved into place from staging files, and are published by the upload handler
+		if moved.staging || staging {
+			return nil
+		}
+		w.renameRecursive(moved.path, p)
+		w.events.Publish(ChangeEvent{Type: EventRenamed, Path: p, OldPath: moved.path, IsDirectory: isDirectory})
+	case staging:
+	case mask&syscall.IN_MOVED_TO != 0:
+		// Moved in from somewhere that isn't watched
+		w.events.Publish(ChangeEvent{Type: EventCreated, Path: p, IsDirectory: isDirectory})
+		if isDirectory {
+			w.addDirectory(p, false)
+		}
+	case mask&syscall.IN_CREATE != 0:
+		w.events.Publish(ChangeEvent{Type: EventCreated, Path: p, IsDirectory: isDirectory})
+		if isDirectory {
+			w.addDirectory(p, true)
+		}
+	case mask&syscall.IN_CLOSE_WRITE != 0:
+		w.events.Publish(ChangeEvent{Type: EventModified, Path: p})
+	case mask&syscall.IN_DELETE != 0:
+		w.events.Publish(ChangeEvent{Type: EventDeleted, Path: p, IsDirectory: isDirectory})
+	}
+
+	return nil
+}
+
+func (w *fsWatcher) addDirectory(p string, publish bool) {
+	err := w.addRecursive(p, publish)
+	if err != nil {
+		slog.Warn("Unable to watch directory for changes", "path", p, "error", err)
+	}
+}
+
+// Handles an entry that was moved out of the serve path
+func (w *fsWatcher) movedAway(moved movedEntry) {
+	if moved.staging {
+		return
+	}
+	if moved.isDirectory {
+		w.removeRecursive(moved.path)
+	}
+	w.events.Publish(ChangeEvent{Type: EventDeleted, Path: moved.path, IsDirectory: moved.isDirectory})
+}
@@ -0,0 +1,97 @@
+// +build linux
+
+package gfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-watcher")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	bus := NewEventBus()
+	_, subscription := bus.Subscribe("/", 0)
+	defer subscription.Close()
+	if !a.NoError(startWatching(dir, bus)) {
+		return
+	}
+
+	next := func() ChangeEvent {
+		select {
+		case event := <-subscription.Events():
+			return event
+		case <-time.After(5 * time.Second):
+			a.Fail("No event received")
+			return ChangeEvent{}
+		}
+	}
+
+	a.NoError(os.Mkdir(filepath.Join(dir, "builds"), os.ModePerm))
+	a.Equal(ChangeEvent{Type: EventCreated, Path: "/builds", IsDirectory: true}, withoutIDAndTime(next()))
+
+	// Directories created are watched as well
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, "builds", "a.zip"), []byte("a"), 0644))
+	a.Equal(ChangeEvent{Type: EventCreated, Path: "/builds/a.zip"}, withoutIDAndTime(next()))
+	a.Equal(ChangeEvent{Type: EventModified, Path: "/builds/a.zip"}, withoutIDAndTime(next()))
+
+	a.NoError(os.Rename(filepath.Join(dir, "builds", "a.zip"), filepath.Join(dir, "b.zip")))
+	a.Equal(ChangeEvent{Type: EventRenamed, Path: "/b.zip", OldPath: "/builds/a.zip"}, withoutIDAndTime(next()))
+
+	// Staging files are ignored, since the upload handler publishes the uploads
+	staging := filepath.Join(dir, stagingFilePrefix+"c.zip")
+	a.NoError(ioutil.WriteFile(staging, []byte("c"), 0644))
+	a.NoError(os.Rename(staging, filepath.Join(dir, "c.zip")))
+
+	a.NoError(os.Remove(filepath.Join(dir, "b.zip")))
+	a.Equal(ChangeEvent{Type: EventDeleted, Path: "/b.zip"}, withoutIDAndTime(next()))
+}
+
+func TestWatcher_MoveAcrossReads(t *testing.T) {
+	a := assert.New(t)
+
+	bus := NewEventBus()
+	_, subscription := bus.Subscribe("/", 0)
+	defer subscription.Close()
+
+	w := &fsWatcher{events: bus, watches: map[int32]string{1: "/", 2: "/builds"}}
+	reads := make(chan []inotifyEvent)
+	go w.process(reads)
+	defer close(reads)
+
+	next := func() ChangeEvent {
+		select {
+		case event := <-subscription.Events():
+			return event
+		case <-time.After(5 * time.Second):
+			a.Fail("No event received")
+			return ChangeEvent{}
+		}
+	}
+
+	// The move from is the last event of one read, and the move to the first of the next
+	reads <- []inotifyEvent{{wd: 2, mask: syscall.IN_MOVED_FROM, cookie: 1, name: "a.zip"}}
+	reads <- []inotifyEvent{{wd: 1, mask: syscall.IN_MOVED_TO, cookie: 1, name: "b.zip"}}
+	a.Equal(ChangeEvent{Type: EventRenamed, Path: "/b.zip", OldPath: "/builds/a.zip"}, withoutIDAndTime(next()))
+
+	// Without a move to, the entry was moved out of the serve path
+	reads <- []inotifyEvent{{wd: 1, mask: syscall.IN_MOVED_FROM, cookie: 2, name: "b.zip"}}
+	a.Equal(ChangeEvent{Type: EventDeleted, Path: "/b.zip"}, withoutIDAndTime(next()))
+}
+
+func withoutIDAndTime(event ChangeEvent) ChangeEvent {
+	event.ID = 0
+	event.Time = time.Time{}
+	return event
+}
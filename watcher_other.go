@@ -0,0 +1,16 @@
+// +build !linux
+
+package gfs
+
+import (
+	"errors"
+)
+
+var (
+	ErrWatchingNotSupported = errors.New("Watching the serve path for changes is only supported on Linux")
+)
+
+// Starts watching the serve path for changes in the background
+func startWatching(serve string, events *EventBus) error {
+	return ErrWatchingNotSupported
+}
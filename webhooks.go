@@ -0,0 +1,286 @@
+package gfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// The name of the file in the data path failed deliveries are written to
+	webhookDeadLetterFilename string = "webhooks-dead-letter.log"
+	// The number of times a delivery is attempted before giving up
+	maxWebhookAttempts int = 6
+	// How long to wait before the first retry. Doubles with every retry
+	webhookRetryDelay time.Duration = time.Second
+	// How long to wait for the receiver to respond
+	webhookTimeout time.Duration = 10 * time.Second
+	// The number of events that can be waiting to be delivered to each hook
+	webhookQueueSize int = 1000
+)
+
+var (
+	ErrWebhookQueueFull = errors.New("Too many deliveries waiting for the webhook")
+)
+
+// A url that is notified about changes
+type WebhookConfig struct {
+	// The url the events are posted to
+	URL string `json:"url"`
+	// Used to sign the payloads. The signature is sent in the X-Gfs-Signature header. Required
+	Secret string `json:"secret"`
+	// Only changes below this path are sent. Defaults to everything
+	Path string `json:"path"`
+	// The types of events that are sent. Defaults to all types
+	Events []string `json:"events"`
+}
+
+// Checks if the event should be sent to the hook
+func (c WebhookConfig) matches(event ChangeEvent) bool {
+	if !event.isBelow(c.Path) {
+		return false
+	}
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, t := range c.Events {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (c WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Invalid webhook url '%s'", c.URL)
+	}
+	// Receivers can't tell the payloads from forged ones without a signature
+	if c.Secret == "" {
+		return fmt.Errorf("The webhook '%s' needs a secret to sign the payloads with", c.URL)
+	}
+	for _, t := range c.Events {
+		switch t {
+		case EventCreated, EventModified, EventDeleted, EventRenamed:
+		default:
+			return fmt.Errorf("Invalid webhook event '%s'. Valid events are: '%s', '%s', '%s' and '%s'", t, EventCreated, EventModified, EventDeleted, EventRenamed)
+		}
+	}
+	return nil
+}
+
+// Signs the timestamp and payload with the secret of the hook. The timestamp is
+// signed as well, so receivers can reject old deliveries being replayed.
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Gets the number of events that were published after lastID, but are missing from
+// the missed events, because they have already left the history of the bus
+func countDroppedEvents(lastID uint64, missed []ChangeEvent) uint64 {
+	if lastID == 0 || len(missed) == 0 || missed[0].ID <= lastID+1 {
+		return 0
+	}
+	return missed[0].ID - lastID - 1
+}
+
+// A delivery that failed every attempt
+type deadLetter struct {
+	Time     time.Time   `json:"time"`
+	URL      string      `json:"url"`
+	Event    ChangeEvent `json:"event"`
+	Attempts int         `json:"attempts"`
+	Error    string      `json:"error"`
+}
+
+// A webhook, and the events waiting to be delivered to it
+type webhook struct {
+	config WebhookConfig
+	queue  chan ChangeEvent
+}
+
+// Sends change events to the configured webhooks. Each hook gets its events in
+// order, and a hook that is down doesn't delay the others.
+type WebhookDispatcher struct {
+	config     *Config
+	client     http.Client
+	hooks      []*webhook
+	retryDelay time.Duration
+	// Only one dead letter is written at a time
+	deadLetterLock sync.Mutex
+}
+
+func NewWebhookDispatcher(config *Config) (*WebhookDispatcher, error) {
+	d := &WebhookDispatcher{
+		config: config,
+		client: http.Client{
+			Timeout: webhookTimeout,
+		},
+		retryDelay: webhookRetryDelay,
+	}
+
+	for _, hookConfig := range config.Webhooks {
+		err := hookConfig.validate()
+		if err != nil {
+			return nil, err
+		}
+		d.hooks = append(d.hooks, &webhook{
+			config: hookConfig,
+			queue:  make(chan ChangeEvent, webhookQueueSize),
+		})
+	}
+
+	return d, nil
+}
+
+// Delivers the events published to the bus until the program stops
+func (d *WebhookDispatcher) run(events *EventBus) {
+	for _, hook := range d.hooks {
+		go d.deliverQueued(hook)
+	}
+
+	var lastID uint64
+	for {
+		missed, subscription := events.Subscribe("/", lastID)
+		if dropped := countDroppedEvents(lastID, missed); dropped > 0 {
+			slog.Error("Webhook events were lost, as the dispatcher fell too far behind", "after", lastID, "before", missed[0].ID, "count", dropped)
+		}
+		for _, event := range missed {
+			d.enqueue(event)
+			lastID = event.ID
+		}
+		// The channel is closed if the dispatcher falls behind, in which case it resumes
+		for event := range subscription.Events() {
+			d.enqueue(event)
+			lastID = event.ID
+		}
+	}
+}
+
+// Queues the event for delivery to the hooks it matches
+func (d *WebhookDispatcher) enqueue(event ChangeEvent) {
+	for _, hook := range d.hooks {
+		if !hook.config.matches(event) {
+			continue
+		}
+		select {
+		case hook.queue <- event:
+		default:
+			d.writeDeadLetter(hook, event, 0, ErrWebhookQueueFull)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliverQueued(hook *webhook) {
+	for event := range hook.queue {
+		d.deliver(hook, event)
+	}
+}
+
+// Sends the event to the hook, retrying with exponential backoff. Deliveries that
+// fail every attempt are written to the dead letter log.
+func (d *WebhookDispatcher) deliver(hook *webhook, event ChangeEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Unable to create webhook payload", "error", err)
+		return
+	}
+
+	delay := d.retryDelay
+	for attempt := 1; ; attempt++ {
+		err = d.send(hook, event, payload)
+		if err == nil {
+			return
+		}
+		slog.Warn("Webhook delivery failed", "url", hook.config.URL, "attempt", attempt, "error", err)
+
+		if attempt == maxWebhookAttempts {
+			d.writeDeadLetter(hook, event, attempt, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (d *WebhookDispatcher) send(hook *webhook, event ChangeEvent, payload []byte) error {
+	req, err := http.NewRequest("POST", hook.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", FormatJson)
+	req.Header.Set("User-Agent", "gfs/"+GFSVersion)
+	req.Header.Set("X-Gfs-Event", event.Type)
+	req.Header.Set("X-Gfs-Delivery", strconv.FormatUint(event.ID, 10))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Gfs-Timestamp", timestamp)
+	req.Header.Set("X-Gfs-Signature", signWebhookPayload(hook.config.Secret, timestamp, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response '%s'", resp.Status)
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) getDeadLetterPath() string {
+	return path.Join(d.config.getDataPath(), webhookDeadLetterFilename)
+}
+
+// Appends the failed delivery to the dead letter log, so it can be sent manually later
+func (d *WebhookDispatcher) writeDeadLetter(hook *webhook, event ChangeEvent, attempts int, deliveryErr error) {
+	slog.Error("Giving up on webhook delivery", "url", hook.config.URL, "event", event.ID, "error", deliveryErr)
+
+	line, err := json.Marshal(deadLetter{
+		Time:     time.Now(),
+		URL:      hook.config.URL,
+		Event:    event,
+		Attempts: attempts,
+		Error:    deliveryErr.Error(),
+	})
+	if err != nil {
+		slog.Error("Unable to write webhook dead letter", "error", err)
+		return
+	}
+
+	d.deadLetterLock.Lock()
+	defer d.deadLetterLock.Unlock()
+
+	err = os.MkdirAll(d.config.getDataPath(), os.ModePerm)
+	if err != nil {
+		slog.Error("Unable to write webhook dead letter", "error", err)
+		return
+	}
+	file, err := os.OpenFile(d.getDeadLetterPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Unable to write webhook dead letter", "error", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("Unable to write webhook dead letter", "error", err)
+	}
+}
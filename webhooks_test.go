@@ -0,0 +1,144 @@
+package gfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gfs-webhooks")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	var received []ChangeEvent
+	attempts := 0
+	delivered := make(chan struct{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		// Fail the first attempt, to test that deliveries are retried
+		attempts++
+		if attempts == 1 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(request.Body)
+		a.NoError(err)
+		timestamp := request.Header.Get("X-Gfs-Timestamp")
+		a.NotEmpty(timestamp)
+		a.Equal(signWebhookPayload("secret", timestamp, payload), request.Header.Get("X-Gfs-Signature"))
+		a.NotEqual(signWebhookPayload("secret", "0", payload), request.Header.Get("X-Gfs-Signature"), "The timestamp should be signed")
+		a.Equal(EventCreated, request.Header.Get("X-Gfs-Event"))
+
+		var event ChangeEvent
+		a.NoError(json.Unmarshal(payload, &event))
+		received = append(received, event)
+		delivered <- struct{}{}
+	}))
+	defer receiver.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	config := &Config{
+		Data: dir,
+		Webhooks: []WebhookConfig{
+			{URL: receiver.URL, Secret: "secret", Path: "/builds", Events: []string{EventCreated}},
+			{URL: failing.URL, Secret: "other secret", Path: "/builds"},
+		},
+	}
+	d, err := NewWebhookDispatcher(config)
+	if !a.NoError(err) {
+		return
+	}
+	d.retryDelay = time.Millisecond
+
+	bus := NewEventBus()
+	go d.run(bus)
+	// Wait for the dispatcher to subscribe
+	for i := 0; i < 100; i++ {
+		bus.lock.Lock()
+		subscribed := len(bus.subscribers) > 0
+		bus.lock.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bus.Publish(ChangeEvent{Type: EventDeleted, Path: "/builds/old.zip"})
+	bus.Publish(ChangeEvent{Type: EventCreated, Path: "/other/a.zip"})
+	bus.Publish(ChangeEvent{Type: EventCreated, Path: "/builds/a.zip", User: "username"})
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		a.Fail("The webhook was never delivered")
+		return
+	}
+	lock.Lock()
+	if a.Len(received, 1) {
+		a.Equal("/builds/a.zip", received[0].Path)
+		a.Equal("username", received[0].User)
+	}
+	a.Equal(2, attempts)
+	lock.Unlock()
+
+	// Both events fail every attempt for the failing hook
+	var letters []deadLetter
+	for i := 0; i < 500 && len(letters) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		letters = nil
+		file, err := os.Open(d.getDeadLetterPath())
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var letter deadLetter
+			a.NoError(json.Unmarshal(scanner.Bytes(), &letter))
+			letters = append(letters, letter)
+		}
+		file.Close()
+	}
+	if a.Len(letters, 2) {
+		a.Equal(failing.URL, letters[0].URL)
+		a.Equal("/builds/old.zip", letters[0].Event.Path)
+		a.Equal(maxWebhookAttempts, letters[0].Attempts)
+	}
+}
+
+func TestWebhookConfig_Validate(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(WebhookConfig{URL: "https://example.com/hook", Secret: "secret", Events: []string{EventCreated, EventRenamed}}.validate())
+	a.Error(WebhookConfig{URL: "example.com/hook", Secret: "secret"}.validate())
+	a.Error(WebhookConfig{URL: "https://example.com/hook", Secret: "secret", Events: []string{"uploaded"}}.validate())
+	a.Error(WebhookConfig{URL: "https://example.com/hook"}.validate(), "Unsigned payloads can be forged")
+}
+
+func TestWebhookDispatcher_DroppedEvents(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(uint64(0), countDroppedEvents(0, []ChangeEvent{{ID: 10}}), "Nothing is missed on the first subscription")
+	a.Equal(uint64(0), countDroppedEvents(9, []ChangeEvent{{ID: 10}, {ID: 11}}))
+	a.Equal(uint64(0), countDroppedEvents(9, nil))
+	a.Equal(uint64(5), countDroppedEvents(4, []ChangeEvent{{ID: 10}, {ID: 11}}))
+}
@@ -0,0 +1,228 @@
+package gfs
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A minimal server side implementation of websockets (RFC 6455). Only
+// what is needed to push messages to clients is supported.
+
+const (
+	// Used to calculate the Sec-WebSocket-Accept header
+	webSocketGUID string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// Messages from clients larger than this are rejected
+	maxWebSocketFrameSize uint64 = 64 << 10
+)
+
+// Websocket frame opcodes
+const (
+	webSocketText  byte = 0x1
+	webSocketClose byte = 0x8
+	webSocketPing  byte = 0x9
+	webSocketPong  byte = 0xA
+)
+
+var (
+	ErrInvalidWebSocketRequest = errors.New("Invalid websocket request. Only version 13 is supported")
+	ErrWebSocketFrameTooLarge  = errors.New("Websocket frame too large")
+	ErrWebSocketNotMasked      = errors.New("Websocket frames from clients have to be masked")
+	ErrWebSocketCrossOrigin    = errors.New("Websockets can't be opened from other sites")
+)
+
+// Checks if the client is asking to upgrade the connection to a websocket
+func isWebSocketRequest(request *http.Request) bool {
+	if !strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(request.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the websocket is opened by a page on gfs itself. Browsers send the cookies
+// of gfs no matter which site opens the websocket, so any site could otherwise read
+// what the user can. Clients that aren't browsers don't send an origin.
+func isSameOriginWebSocket(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, getRequestHost(request))
+}
+
+// Gets the value of the Sec-WebSocket-Accept header for the given key
+func getWebSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+type webSocketConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	// Frames can be written from multiple goroutines, e.g. pongs while sending messages
+	writeLock sync.Mutex
+}
+
+// Completes the websocket handshake, and takes over the connection
+func upgradeWebSocket(writer http.ResponseWriter, request *http.Request) (*webSocketConn, error) {
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if request.Method != "GET" || key == "" || request.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, ErrInvalidWebSocketRequest
+	}
+	if !isSameOriginWebSocket(request) {
+		return nil, ErrWebSocketCrossOrigin
+	}
+
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("The connection can't be upgraded to a websocket")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + getWebSocketAccept(key) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocketConn{
+		conn: conn,
+		rw:   rw,
+	}, nil
+}
+
+// Writes a single unfragmented frame
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	header := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	_, err := c.rw.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = c.rw.Write(payload)
+	if err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// Sends a text message
+func (c *webSocketConn) WriteText(message []byte) error {
+	return c.writeFrame(webSocketText, message)
+}
+
+// Reads a single frame from the client
+func (c *webSocketConn) readFrame() (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	_, err = io.ReadFull(c.rw, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return 0, nil, ErrWebSocketNotMasked
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(c.rw, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(c.rw, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxWebSocketFrameSize {
+		return 0, nil, ErrWebSocketFrameTooLarge
+	}
+
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(c.rw, mask)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.rw, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return opcode, payload, nil
+}
+
+// Reads frames until the client closes the connection, answering pings
+// on the way. Messages from the client are ignored.
+func (c *webSocketConn) readUntilClosed() error {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case webSocketPing:
+			err = c.writeFrame(webSocketPong, payload)
+			if err != nil {
+				return err
+			}
+		case webSocketClose:
+			// Echo the close frame to complete the closing handshake
+			c.writeFrame(webSocketClose, payload)
+			return nil
+		}
+	}
+}
+
+func (c *webSocketConn) Close() error {
+	return c.conn.Close()
+}